@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	envstruct "code.cloudfoundry.org/go-envstruct"
 	"code.cloudfoundry.org/log-cache/internal/tls"
 )
@@ -14,6 +16,16 @@ type Config struct {
 	HealthPort   int      `env:"HEALTH_PORT, report"`
 	ShardId      string   `env:"SHARD_ID, required, report"`
 	Selectors    []string `env:"SELECTORS, required, report"`
+	DryRun       bool     `env:"DRY_RUN, report"`
+
+	// SelectorProbeShardId is the shard ID the selectors the logs provider
+	// supports are probed with at startup. The probe is skipped if it is
+	// empty.
+	SelectorProbeShardId string `env:"SELECTOR_PROBE_SHARD_ID, report"`
+
+	// DrainTimeout is how long the nozzle keeps writing buffered envelopes
+	// on SIGTERM before exiting.
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT, report"`
 
 	LogCacheTLS tls.TLS
 }
@@ -32,6 +44,9 @@ func LoadConfig() (*Config, error) {
 		HealthPort:   6061,
 		ShardId:      "log-cache",
 		Selectors:    []string{"log", "gauge", "counter", "timer", "event"},
+		DrainTimeout: 10 * time.Second,
+
+		SelectorProbeShardId: "log-cache-selector-probe",
 	}
 
 	if err := envstruct.Load(&c); err != nil {
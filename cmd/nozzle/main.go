@@ -6,10 +6,13 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 
 	envstruct "code.cloudfoundry.org/go-envstruct"
 	"code.cloudfoundry.org/log-cache/internal/metrics"
 	. "code.cloudfoundry.org/log-cache/internal/nozzle"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	loggregator "code.cloudfoundry.org/go-loggregator"
@@ -52,10 +55,7 @@ func main() {
 		}),
 	)
 
-	nozzle := NewNozzle(
-		streamConnector,
-		cfg.LogCacheAddr,
-		cfg.ShardId,
+	opts := []NozzleOption{
 		WithLogger(log.New(os.Stderr, "", log.LstdFlags)),
 		WithMetrics(m),
 		WithDialOpts(
@@ -64,6 +64,23 @@ func main() {
 			),
 		),
 		WithSelectors(cfg.Selectors...),
+	}
+
+	if cfg.DryRun {
+		opts = append(opts, WithDryRun())
+	}
+
+	if cfg.SelectorProbeShardId != "" {
+		opts = append(opts, WithSelectorProber(
+			NewStreamSelectorProber(streamConnector, cfg.SelectorProbeShardId),
+		))
+	}
+
+	nozzle := NewNozzle(
+		streamConnector,
+		cfg.LogCacheAddr,
+		cfg.ShardId,
+		opts...,
 	)
 
 	go nozzle.Start()
@@ -72,5 +89,20 @@ func main() {
 	http.Handle("/metrics", m)
 
 	// health endpoints (pprof and prometheus)
-	log.Printf("Health: %s", http.ListenAndServe(fmt.Sprintf("localhost:%d", cfg.HealthPort), nil))
+	go func() {
+		log.Printf("Health: %s", http.ListenAndServe(fmt.Sprintf("localhost:%d", cfg.HealthPort), nil))
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	<-sigs
+
+	log.Print("Draining LogCache Nozzle...")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+
+	if undrained := nozzle.Drain(ctx); undrained > 0 {
+		log.Printf("Dropped %d undrained envelopes", undrained)
+	}
+	nozzle.Stop()
 }
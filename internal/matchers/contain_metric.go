@@ -29,6 +29,17 @@ func ContainGaugeMetric(expectedName, expectedUnit string, expectedValue float64
 	}
 }
 
+func ContainHistogramMetric(expectedName, expectedUnit string, expectedSampleCount uint64) types.GomegaMatcher {
+	return &containMetricMatcher{
+		expectedName:  expectedName,
+		expectedValue: float64(expectedSampleCount),
+		expectedUnit:  expectedUnit,
+		valueExtractor: func(metric *io_prometheus_client.Metric) float64 {
+			return float64(metric.GetHistogram().GetSampleCount())
+		},
+	}
+}
+
 type containMetricMatcher struct {
 	expectedName   string
 	expectedValue  float64
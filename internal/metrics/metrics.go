@@ -1,8 +1,12 @@
 package metrics
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -19,6 +23,21 @@ type Initializer interface {
 
 	// NewGauge returns a function to set the value for the given metric.
 	NewGauge(name, unit string) func(value float64)
+
+	// NewHistogram returns a function to observe a value for the given
+	// metric. The given labels are constant for the returned function. A nil
+	// set of buckets uses the prometheus default buckets.
+	NewHistogram(name, unit string, buckets []float64, labels map[string]string) func(value float64)
+
+	// NewNativeHistogram returns a function to observe a value for the given
+	// metric. It is published as a native (exponential) histogram to
+	// scrapers that support them, and with classic buckets otherwise.
+	NewNativeHistogram(name string) func(value float64)
+
+	// NewCounterVec returns a function to increment the given metric for the
+	// given label values. The label values must be given in the same order as
+	// the label names.
+	NewCounterVec(name string, labelNames []string, opts ...CounterVecOption) func(delta uint64, labelValues ...string)
 }
 
 // NullMetrics are the default metrics.
@@ -36,16 +55,81 @@ func (m NullMetrics) NewGauge(name, unit string) func(float64) {
 	return func(float64) {}
 }
 
-// Metrics stores health metrics for the process. It has a gauge and counter
-// metrics.
+func (m NullMetrics) NewHistogram(name, unit string, buckets []float64, labels map[string]string) func(float64) {
+	return func(float64) {}
+}
+
+func (m NullMetrics) NewNativeHistogram(name string) func(float64) {
+	return func(float64) {}
+}
+
+func (m NullMetrics) NewCounterVec(name string, labelNames []string, opts ...CounterVecOption) func(uint64, ...string) {
+	return func(uint64, ...string) {}
+}
+
+// Metrics stores health metrics for the process. It has gauge, counter and
+// histogram metrics.
 type Metrics struct {
-	Registry *prometheus.Registry
+	mu              sync.RWMutex
+	Registry        *prometheus.Registry
+	incUnknownUnits func(delta uint64)
+
+	// registerer and gatherer are only set by NewWithRegisterer. Every
+	// collector registered with them is kept to unregister it on Reset.
+	registerer prometheus.Registerer
+	gatherer   prometheus.Gatherer
+	collectors []prometheus.Collector
 }
 
-// New returns a new Metrics.
+// New returns a new Metrics with its own, isolated registry.
 func New() *Metrics {
+	registry, incUnknownUnits := newRegistry()
+
 	return &Metrics{
-		Registry: prometheus.NewRegistry(),
+		Registry:        registry,
+		incUnknownUnits: incUnknownUnits,
+	}
+}
+
+// NewWithRegisterer returns a new Metrics that registers its metrics with
+// the given registerer instead of an own registry, e.g., to publish them
+// alongside the other metrics of an application. ServeHTTP serves the
+// metrics of the given gatherer. The Registry field is nil.
+func NewWithRegisterer(r prometheus.Registerer, g prometheus.Gatherer) *Metrics {
+	m := &Metrics{
+		registerer: r,
+		gatherer:   g,
+	}
+	m.incUnknownUnits = m.newUnknownUnitsCounter()
+
+	return m
+}
+
+// newRegistry returns a registry with the metrics every registry publishes.
+func newRegistry() (*prometheus.Registry, func(uint64)) {
+	registry := prometheus.NewRegistry()
+
+	unknownUnits := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "metrics_unknown_units",
+	})
+	registry.MustRegister(unknownUnits)
+
+	return registry, func(d uint64) {
+		unknownUnits.Add(float64(d))
+	}
+}
+
+// newUnknownUnitsCounter registers the metrics_unknown_units counter with
+// the registerer given to NewWithRegisterer.
+func (m *Metrics) newUnknownUnitsCounter() func(uint64) {
+	unknownUnits := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "metrics_unknown_units",
+	})
+	m.registerer.MustRegister(unknownUnits)
+	m.collectors = append(m.collectors, unknownUnits)
+
+	return func(d uint64) {
+		unknownUnits.Add(float64(d))
 	}
 }
 
@@ -54,7 +138,7 @@ func (m *Metrics) NewCounter(name string) func(delta uint64) {
 	prometheusCounterMetric := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: name,
 	})
-	m.Registry.MustRegister(prometheusCounterMetric)
+	m.mustRegister(prometheusCounterMetric)
 
 	return func(d uint64) {
 		prometheusCounterMetric.Add(float64(d))
@@ -67,7 +151,7 @@ func (m *Metrics) NewPerNodeCounter(name string, nodeIndex int) func(delta uint6
 		Name:        name,
 		ConstLabels: prometheus.Labels{"nodeIndex": strconv.Itoa(nodeIndex)},
 	})
-	m.Registry.MustRegister(prometheusCounterMetric)
+	m.mustRegister(prometheusCounterMetric)
 
 	return func(d uint64) {
 		prometheusCounterMetric.Add(float64(d))
@@ -75,18 +159,371 @@ func (m *Metrics) NewPerNodeCounter(name string, nodeIndex int) func(delta uint6
 }
 
 // NewGauge returns a func to be used to set the value of a gauge metric.
+//
+// The unit should be one of the known units (see KnownUnit). An unknown unit
+// is still published, but increments the metrics_unknown_units counter.
 func (m *Metrics) NewGauge(name, unit string) func(value float64) {
+	m.checkUnit(unit)
+
 	prometheusGaugeMetric := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: name,
 		ConstLabels: map[string]string{
 			"unit": unit,
 		},
 	})
-	m.Registry.MustRegister(prometheusGaugeMetric)
+	m.mustRegister(prometheusGaugeMetric)
 
 	return prometheusGaugeMetric.Set
 }
 
+// NewHistogram returns a func to be used to observe a value of a histogram
+// metric. Like with NewGauge, the unit should be one of the known units.
+func (m *Metrics) NewHistogram(name, unit string, buckets []float64, labels map[string]string) func(value float64) {
+	m.checkUnit(unit)
+
+	constLabels := prometheus.Labels{"unit": unit}
+	for k, v := range labels {
+		constLabels[k] = v
+	}
+
+	prometheusHistogramMetric := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        name,
+		Buckets:     buckets,
+		ConstLabels: constLabels,
+	})
+	m.mustRegister(prometheusHistogramMetric)
+
+	return prometheusHistogramMetric.Observe
+}
+
+// nativeHistogramBucketFactor is the maximum growth factor between two
+// adjacent buckets of a native histogram. 1.1 yields a relative error of at
+// most 5% while keeping the number of populated buckets small.
+const nativeHistogramBucketFactor = 1.1
+
+// NewNativeHistogram returns a func to be used to observe a value of a
+// native histogram metric. Native histograms are only exposed to scrapers
+// that negotiate the protobuf exposition format (e.g., Prometheus with
+// native histograms enabled). Every other scraper is served the classic
+// default buckets, which are configured as well.
+func (m *Metrics) NewNativeHistogram(name string) func(value float64) {
+	prometheusHistogramMetric := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        name,
+		Buckets:                     prometheus.DefBuckets,
+		NativeHistogramBucketFactor: nativeHistogramBucketFactor,
+	})
+	m.mustRegister(prometheusHistogramMetric)
+
+	return prometheusHistogramMetric.Observe
+}
+
+// OverflowLabelValue is used for every label of a counter vector once its
+// maximum cardinality has been reached.
+const OverflowLabelValue = "__other__"
+
+// CounterVecOption configures a counter vector.
+type CounterVecOption func(*CounterVecConfig)
+
+// CounterVecConfig is the configuration of a counter vector. It is exported
+// so other Initializers can honor the given options.
+type CounterVecConfig struct {
+	MaxCardinality int
+}
+
+// WithMaxCardinality caps the number of distinct label combinations a
+// counter vector publishes. Once n combinations have been seen, increments
+// for any new combination are bucketed into a single series where every
+// label is set to OverflowLabelValue, and the <name>_dropped_labels counter
+// is incremented.
+//
+// This trades accuracy for safety: the counts of the overflowing
+// combinations are still accounted for, but can no longer be told apart.
+// A label with unbounded values (e.g., a raw source ID) can otherwise create
+// a series per value and exhaust the memory of both the process and
+// Prometheus. It defaults to no cap.
+func WithMaxCardinality(n int) CounterVecOption {
+	return func(c *CounterVecConfig) {
+		c.MaxCardinality = n
+	}
+}
+
+// NewCounterVec returns a func to be used to increment the counter total for
+// the given label values.
+func (m *Metrics) NewCounterVec(name string, labelNames []string, opts ...CounterVecOption) func(delta uint64, labelValues ...string) {
+	var conf CounterVecConfig
+	for _, o := range opts {
+		o(&conf)
+	}
+
+	prometheusCounterVecMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+	}, labelNames)
+	m.mustRegister(prometheusCounterVecMetric)
+
+	if conf.MaxCardinality <= 0 {
+		return func(d uint64, labelValues ...string) {
+			prometheusCounterVecMetric.WithLabelValues(labelValues...).Add(float64(d))
+		}
+	}
+
+	droppedLabels := m.NewCounter(name + "_dropped_labels")
+
+	overflowLabelValues := make([]string, len(labelNames))
+	for i := range overflowLabelValues {
+		overflowLabelValues[i] = OverflowLabelValue
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+
+	return func(d uint64, labelValues ...string) {
+		key := strings.Join(labelValues, "\xff")
+
+		mu.Lock()
+		_, ok := seen[key]
+		if !ok && len(seen) < conf.MaxCardinality {
+			seen[key] = struct{}{}
+			ok = true
+		}
+		mu.Unlock()
+
+		if !ok {
+			droppedLabels(1)
+			labelValues = overflowLabelValues
+		}
+
+		prometheusCounterVecMetric.WithLabelValues(labelValues...).Add(float64(d))
+	}
+}
+
+// Reset replaces the registry with an empty one, which zeroes every metric.
+// It is mainly intended to isolate tests from each other, but can also be
+// used by long running processes to periodically zero operational counters.
+//
+// Reset invalidates every function previously returned by NewCounter,
+// NewPerNodeCounter, NewGauge, NewHistogram and NewCounterVec. They can still
+// be invoked, but no longer affect the published metrics. To keep publishing
+// a metric, it has to be registered again by invoking the according New
+// method.
+//
+// For a Metrics returned by NewWithRegisterer, Reset unregisters every
+// metric from the given registerer instead.
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.registerer != nil {
+		for _, c := range m.collectors {
+			m.registerer.Unregister(c)
+		}
+		m.collectors = nil
+		m.incUnknownUnits = m.newUnknownUnitsCounter()
+
+		return
+	}
+
+	m.Registry, m.incUnknownUnits = newRegistry()
+}
+
+func (m *Metrics) checkUnit(unit string) {
+	if KnownUnit(unit) {
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	m.incUnknownUnits(1)
+}
+
+// mustRegister registers the given collector with the registry or the
+// registerer given to NewWithRegisterer.
+func (m *Metrics) mustRegister(c prometheus.Collector) {
+	if m.registerer == nil {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		m.Registry.MustRegister(c)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.registerer.MustRegister(c)
+	m.collectors = append(m.collectors, c)
+}
+
+// currentGatherer returns the gatherer of the published metrics.
+func (m *Metrics) currentGatherer() prometheus.Gatherer {
+	if m.gatherer != nil {
+		return m.gatherer
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.Registry
+}
+
 func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	promhttp.HandlerFor(m.currentGatherer(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// ServeHTTPOpenMetrics serves the metrics like ServeHTTP, but negotiates the
+// OpenMetrics format (and therefore exemplars) with scrapers that ask for it.
+// Scrapers that don't ask for it are still served the text format.
+func (m *Metrics) ServeHTTPOpenMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(m.currentGatherer(), promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}).ServeHTTP(w, r)
+}
+
+// Snapshot returns the current value of every metric. Metrics without
+// labels are keyed by their name. Metrics with labels are keyed by their
+// name and their labels sorted by name, e.g., `some_counter{a=x,b=y}`. The
+// unit label is omitted. Histograms are flattened into a <name>_count and a
+// <name>_sum entry. Metrics that fail to be gathered are omitted.
+func (m *Metrics) Snapshot() map[string]float64 {
+	// Gather returns every family it could gather, even on an error.
+	families, _ := m.currentGatherer().Gather()
+
+	snapshot := make(map[string]float64)
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			labels := make([]string, 0, len(metric.GetLabel()))
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "unit" {
+					continue
+				}
+				labels = append(labels, fmt.Sprintf("%s=%s", l.GetName(), l.GetValue()))
+			}
+			sort.Strings(labels)
+
+			key := func(name string) string {
+				if len(labels) == 0 {
+					return name
+				}
+				return fmt.Sprintf("%s{%s}", name, strings.Join(labels, ","))
+			}
+
+			switch {
+			case metric.Counter != nil:
+				snapshot[key(f.GetName())] = metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				snapshot[key(f.GetName())] = metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				snapshot[key(f.GetName()+"_count")] = float64(metric.GetHistogram().GetSampleCount())
+				snapshot[key(f.GetName()+"_sum")] = metric.GetHistogram().GetSampleSum()
+			case metric.Summary != nil:
+				snapshot[key(f.GetName()+"_count")] = float64(metric.GetSummary().GetSampleCount())
+				snapshot[key(f.GetName()+"_sum")] = metric.GetSummary().GetSampleSum()
+			case metric.Untyped != nil:
+				snapshot[key(f.GetName())] = metric.GetUntyped().GetValue()
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// RegisteredNames returns the sorted names of every published metric,
+// including metrics_unknown_units. Like with Snapshot, metrics that fail to
+// be gathered are omitted, as are counter vectors that have not been
+// incremented for any label values yet.
+func (m *Metrics) RegisteredNames() []string {
+	// Gather returns every family it could gather, even on an error.
+	families, _ := m.currentGatherer().Gather()
+
+	seen := make(map[string]bool, len(families))
+	names := make([]string, 0, len(families))
+	for _, f := range families {
+		if seen[f.GetName()] {
+			continue
+		}
+		seen[f.GetName()] = true
+		names = append(names, f.GetName())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// knownUnits are the units metrics are expected to be published with. They
+// are UCUM-style full names, in plural.
+var knownUnits = map[string]bool{
+	"nanoseconds":  true,
+	"microseconds": true,
+	"milliseconds": true,
+	"seconds":      true,
+	"minutes":      true,
+	"hours":        true,
+	"bytes":        true,
+	"kilobytes":    true,
+	"megabytes":    true,
+	"gigabytes":    true,
+	"percentage":   true,
+	"ratio":        true,
+	"entries":      true,
+	"boolean":      true,
+}
+
+// unitAliases maps common abbreviations and spellings to a known unit.
+var unitAliases = map[string]string{
+	"ns":          "nanoseconds",
+	"nanosecond":  "nanoseconds",
+	"us":          "microseconds",
+	"µs":          "microseconds",
+	"microsecond": "microseconds",
+	"ms":          "milliseconds",
+	"millis":      "milliseconds",
+	"millisecond": "milliseconds",
+	"s":           "seconds",
+	"sec":         "seconds",
+	"secs":        "seconds",
+	"second":      "seconds",
+	"m":           "minutes",
+	"min":         "minutes",
+	"mins":        "minutes",
+	"minute":      "minutes",
+	"h":           "hours",
+	"hr":          "hours",
+	"hrs":         "hours",
+	"hour":        "hours",
+	"b":           "bytes",
+	"byte":        "bytes",
+	"kb":          "kilobytes",
+	"kilobyte":    "kilobytes",
+	"mb":          "megabytes",
+	"megabyte":    "megabytes",
+	"gb":          "gigabytes",
+	"gigabyte":    "gigabytes",
+	"%":           "percentage",
+	"percent":     "percentage",
+	"pct":         "percentage",
+	"entry":       "entries",
+	"bool":        "boolean",
+}
+
+// KnownUnit reports whether the given unit is one of the known units.
+// Aliases (e.g., "ms") are not known units, they have to be normalized via
+// NormalizeUnit first.
+func KnownUnit(unit string) bool {
+	return knownUnits[unit]
+}
+
+// NormalizeUnit returns the known unit for the given alias (e.g., "sec"
+// yields "seconds"). Units that are neither known nor an alias are returned
+// unchanged.
+func NormalizeUnit(unit string) string {
+	u := strings.ToLower(strings.TrimSpace(unit))
+	if knownUnits[u] {
+		return u
+	}
+
+	if normalized, ok := unitAliases[u]; ok {
+		return normalized
+	}
+
+	return unit
 }
@@ -1,8 +1,12 @@
 package metrics_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+
 	. "code.cloudfoundry.org/log-cache/internal/matchers"
 	"code.cloudfoundry.org/log-cache/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -32,4 +36,217 @@ var _ = Describe("Metrics", func() {
 
 		Expect(m.Registry).To(ContainGaugeMetric("some_gauge", "some_unit", 101.1))
 	})
+
+	It("counts gauges registered with an unknown unit", func() {
+		m.NewGauge("some_gauge", "seconds")
+		Expect(m.Registry).To(ContainCounterMetric("metrics_unknown_units", 0))
+
+		m.NewGauge("some_other_gauge", "sec")
+		Expect(m.Registry).To(ContainCounterMetric("metrics_unknown_units", 1))
+	})
+
+	It("normalizes unit aliases", func() {
+		Expect(metrics.NormalizeUnit("sec")).To(Equal("seconds"))
+		Expect(metrics.NormalizeUnit("MS")).To(Equal("milliseconds"))
+		Expect(metrics.NormalizeUnit("%")).To(Equal("percentage"))
+		Expect(metrics.NormalizeUnit("bytes")).To(Equal("bytes"))
+		Expect(metrics.NormalizeUnit("furlongs")).To(Equal("furlongs"))
+
+		Expect(metrics.KnownUnit("seconds")).To(BeTrue())
+		Expect(metrics.KnownUnit("ratio")).To(BeTrue())
+		Expect(metrics.KnownUnit("sec")).To(BeFalse())
+	})
+
+	It("publishes the observations of a histogram", func() {
+		h := m.NewHistogram("some_histogram", "some_unit", []float64{1, 10}, nil)
+		h(0.5)
+		h(5)
+		h(50)
+
+		Expect(m.Registry).To(ContainHistogramMetric("some_histogram", "some_unit", 3))
+	})
+
+	It("publishes a native histogram with classic buckets", func() {
+		h := m.NewNativeHistogram("some_native_histogram")
+		h(0.002)
+		h(3)
+
+		families, err := m.Registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+
+		var found bool
+		for _, f := range families {
+			if f.GetName() != "some_native_histogram" {
+				continue
+			}
+			found = true
+
+			histogram := f.GetMetric()[0].GetHistogram()
+			Expect(histogram.GetSampleCount()).To(BeEquivalentTo(2))
+			Expect(histogram.GetBucket()).ToNot(BeEmpty())
+			Expect(histogram.GetSchema()).ToNot(BeZero())
+		}
+		Expect(found).To(BeTrue())
+	})
+
+	It("publishes the totals of a counter vector", func() {
+		c := m.NewCounterVec("some_counter_vec", []string{"source_id"})
+		c(1, "a")
+		c(2, "a")
+		c(5, "b")
+
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec", 3))
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec", 5))
+	})
+
+	It("buckets label combinations beyond the max cardinality", func() {
+		c := m.NewCounterVec("some_counter_vec", []string{"source_id"}, metrics.WithMaxCardinality(2))
+		c(1, "a")
+		c(2, "b")
+		c(4, "c")
+		c(8, "d")
+		c(16, "a")
+
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec", 17))
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec", 2))
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec", 12))
+		Expect(m.Registry).To(ContainCounterMetric("some_counter_vec_dropped_labels", 2))
+
+		families, err := m.Registry.Gather()
+		Expect(err).ToNot(HaveOccurred())
+
+		var labelValues []string
+		for _, f := range families {
+			if f.GetName() != "some_counter_vec" {
+				continue
+			}
+			for _, metric := range f.GetMetric() {
+				labelValues = append(labelValues, metric.GetLabel()[0].GetValue())
+			}
+		}
+		Expect(labelValues).To(ConsistOf("a", "b", metrics.OverflowLabelValue))
+	})
+
+	It("publishes histograms that only differ by their labels", func() {
+		success := m.NewHistogram("some_histogram", "some_unit", nil, map[string]string{"result": "success"})
+		failure := m.NewHistogram("some_histogram", "some_unit", nil, map[string]string{"result": "failure"})
+		success(1)
+		success(2)
+		failure(3)
+
+		Expect(m.Registry).To(ContainHistogramMetric("some_histogram", "some_unit", 2))
+		Expect(m.Registry).To(ContainHistogramMetric("some_histogram", "some_unit", 1))
+	})
+
+	It("zeroes every metric on reset", func() {
+		c := m.NewCounter("some_counter")
+		c(99)
+
+		m.Reset()
+		Expect(m.Registry).ToNot(ContainCounterMetric("some_counter", 99))
+
+		c(1)
+		Expect(m.Registry).ToNot(ContainCounterMetric("some_counter", 1))
+
+		c = m.NewCounter("some_counter")
+		c(1)
+		Expect(m.Registry).To(ContainCounterMetric("some_counter", 1))
+	})
+
+	It("snapshots the value of every metric", func() {
+		m.NewCounter("some_counter")(99)
+		m.NewGauge("some_gauge", "seconds")(1.5)
+		m.NewHistogram("some_histogram", "seconds", nil, map[string]string{"result": "success"})(2)
+		c := m.NewCounterVec("some_counter_vec", []string{"source_id", "app"})
+		c(3, "a", "x")
+
+		snapshot := m.Snapshot()
+		Expect(snapshot).To(HaveKeyWithValue("some_counter", 99.0))
+		Expect(snapshot).To(HaveKeyWithValue("some_gauge", 1.5))
+		Expect(snapshot).To(HaveKeyWithValue("some_histogram_count{result=success}", 1.0))
+		Expect(snapshot).To(HaveKeyWithValue("some_histogram_sum{result=success}", 2.0))
+		Expect(snapshot).To(HaveKeyWithValue("some_counter_vec{app=x,source_id=a}", 3.0))
+	})
+
+	It("returns the names of every registered metric", func() {
+		m.NewGauge("some_gauge", "seconds")
+		m.NewCounter("some_counter")
+		m.NewPerNodeCounter("some_node_counter", 0)
+		m.NewPerNodeCounter("some_node_counter", 1)
+
+		Expect(m.RegisteredNames()).To(Equal([]string{
+			"metrics_unknown_units",
+			"some_counter",
+			"some_gauge",
+			"some_node_counter",
+		}))
+	})
+
+	Describe("NewWithRegisterer", func() {
+		var registry *prometheus.Registry
+
+		BeforeEach(func() {
+			registry = prometheus.NewRegistry()
+			m = metrics.NewWithRegisterer(registry, registry)
+		})
+
+		It("registers metrics with the given registerer", func() {
+			m.NewCounter("some_counter")(99)
+
+			Expect(m.Registry).To(BeNil())
+			Expect(registry).To(ContainCounterMetric("some_counter", 99))
+		})
+
+		It("serves the metrics of the given gatherer", func() {
+			m.NewCounter("some_counter")(99)
+			registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+				Name: "host_counter",
+			}))
+
+			recorder := httptest.NewRecorder()
+			m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			Expect(recorder.Body.String()).To(ContainSubstring("some_counter 99"))
+			Expect(recorder.Body.String()).To(ContainSubstring("host_counter 0"))
+		})
+
+		It("unregisters every metric on reset", func() {
+			m.NewCounter("some_counter")(99)
+
+			m.Reset()
+			Expect(registry).ToNot(ContainCounterMetric("some_counter", 99))
+
+			m.NewCounter("some_counter")(1)
+			Expect(registry).To(ContainCounterMetric("some_counter", 1))
+		})
+	})
+
+	Describe("ServeHTTPOpenMetrics", func() {
+		var req *http.Request
+
+		BeforeEach(func() {
+			m.NewCounter("some_counter")(99)
+
+			req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		})
+
+		It("serves the OpenMetrics format when asked for", func() {
+			recorder := httptest.NewRecorder()
+			m.ServeHTTPOpenMetrics(recorder, req)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("application/openmetrics-text"))
+			Expect(recorder.Body.String()).To(ContainSubstring("some_counter_total 99"))
+			Expect(recorder.Body.String()).To(HaveSuffix("# EOF\n"))
+		})
+
+		It("leaves ServeHTTP serving the text format", func() {
+			recorder := httptest.NewRecorder()
+			m.ServeHTTP(recorder, req)
+
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		})
+	})
 })
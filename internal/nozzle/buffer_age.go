@@ -0,0 +1,71 @@
+package nozzle
+
+import (
+	"sync"
+	"time"
+)
+
+// bufferAge tracks the batches that are being assembled or waiting to be
+// written, along with the time their oldest envelope was buffered, and
+// publishes the age of the oldest one. As the writers write the batches
+// concurrently, they are not done in order. It is safe for concurrent use.
+type bufferAge struct {
+	mu      sync.Mutex
+	set     func(float64)
+	next    uint64
+	pending map[uint64]time.Time
+}
+
+func newBufferAge(set func(float64)) *bufferAge {
+	return &bufferAge{
+		set:     set,
+		pending: make(map[uint64]time.Time),
+	}
+}
+
+// add tracks a batch whose oldest envelope was buffered at the given time.
+// It returns the ID to remove the batch by once it is written or dropped.
+func (a *bufferAge) add(oldest time.Time) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.next++
+	a.pending[a.next] = oldest
+	a.publishLocked()
+
+	return a.next
+}
+
+// remove stops tracking the batch with the given ID.
+func (a *bufferAge) remove(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.pending, id)
+	a.publishLocked()
+}
+
+// publish publishes the age of the oldest batch, e.g., to report it rising
+// while the writers are blocked.
+func (a *bufferAge) publish() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.publishLocked()
+}
+
+func (a *bufferAge) publishLocked() {
+	var oldest time.Time
+	for _, t := range a.pending {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	if oldest.IsZero() {
+		a.set(0)
+		return
+	}
+
+	a.set(time.Since(oldest).Seconds())
+}
@@ -0,0 +1,81 @@
+package nozzle
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxCounterRateSources is the number of source and instance IDs the
+// counterRater keeps the last total of. Once reached, the total of the
+// least recently seen one is evicted.
+const maxCounterRateSources = 10000
+
+// counterRater computes the rate of a counter keyed by source and instance
+// ID. It is not safe for concurrent use.
+type counterRater struct {
+	window     time.Duration
+	maxSources int
+
+	samples map[counterRateKey]*list.Element
+	lru     *list.List
+}
+
+type counterRateKey struct {
+	sourceID   string
+	instanceID string
+}
+
+type counterSample struct {
+	key       counterRateKey
+	total     uint64
+	timestamp int64
+}
+
+func newCounterRater(window time.Duration, maxSources int) *counterRater {
+	return &counterRater{
+		window:     window,
+		maxSources: maxSources,
+		samples:    make(map[counterRateKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// rate records the given total and returns the per second rate since the
+// last recorded total. It reports false if there is no rate yet, i.e., for
+// the first total, for totals within the window of the last recorded one
+// and for totals older than it. A total below the last recorded one is a
+// reset and yields a rate of 0.
+func (r *counterRater) rate(sourceID, instanceID string, total uint64, timestamp int64) (float64, bool) {
+	key := counterRateKey{sourceID: sourceID, instanceID: instanceID}
+
+	e, ok := r.samples[key]
+	if !ok {
+		if r.lru.Len() >= r.maxSources {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.samples, oldest.Value.(*counterSample).key)
+		}
+
+		r.samples[key] = r.lru.PushFront(&counterSample{
+			key:       key,
+			total:     total,
+			timestamp: timestamp,
+		})
+		return 0, false
+	}
+	r.lru.MoveToFront(e)
+
+	s := e.Value.(*counterSample)
+	elapsed := time.Duration(timestamp - s.timestamp)
+	if elapsed <= 0 || elapsed < r.window {
+		return 0, false
+	}
+
+	var rate float64
+	if total >= s.total {
+		rate = float64(total-s.total) / elapsed.Seconds()
+	}
+	s.total, s.timestamp = total, timestamp
+
+	return rate, true
+}
@@ -0,0 +1,322 @@
+package nozzle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/golang/protobuf/proto"
+)
+
+// The disk buffer is a single append-only file. It starts with a header:
+//
+//	magic   [4]byte  "LCDB"
+//	version uint8    1
+//	cursor  uint64   offset of the oldest unread record
+//
+// The header is followed by the records:
+//
+//	length uint32  length of the payload
+//	count  uint32  number of envelopes in the payload
+//	crc    uint32  CRC-32 (IEEE) of the payload
+//	payload        protobuf encoded loggregator_v2.EnvelopeBatch
+//
+// All integers are big endian. A record that was only partially written
+// before a crash fails its CRC and is truncated on open.
+const (
+	diskBufferFile    = "buffer.log"
+	diskBufferVersion = 1
+
+	diskBufferHeaderLen = 4 + 1 + 8
+	diskRecordHeaderLen = 4 + 4 + 4
+)
+
+var diskBufferMagic = []byte("LCDB")
+
+// diskBuffer is a bounded on-disk queue of envelope batches. It is safe for
+// concurrent use.
+type diskBuffer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+
+	// cursor is the offset of the oldest unread record and size the offset
+	// right after the newest one.
+	cursor int64
+	size   int64
+
+	// head is the number of records removed so far. Unlike the cursor, it
+	// identifies the oldest unread record across compactions.
+	head uint64
+}
+
+// openDiskBuffer opens the disk buffer in the given directory, creating it
+// if necessary. Only up to maxBytes of unread records are kept.
+func openDiskBuffer(dir string, maxBytes int64) (*diskBuffer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	b := &diskBuffer{
+		path:     filepath.Join(dir, diskBufferFile),
+		maxBytes: maxBytes,
+	}
+
+	f, err := os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	b.f = f
+
+	if err := b.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// recover reads the header, or writes it to a new file, and truncates any
+// partially written record.
+func (b *diskBuffer) recover() error {
+	info, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		b.cursor, b.size = diskBufferHeaderLen, diskBufferHeaderLen
+		return writeDiskBufferHeader(b.f, b.cursor)
+	}
+
+	header := make([]byte, diskBufferHeaderLen)
+	if _, err := b.f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read disk buffer header of %s: %s", b.path, err)
+	}
+
+	if !bytes.Equal(header[:4], diskBufferMagic) || header[4] != diskBufferVersion {
+		return fmt.Errorf("%s is not a disk buffer of version %d", b.path, diskBufferVersion)
+	}
+
+	b.cursor = int64(binary.BigEndian.Uint64(header[5:]))
+	if b.cursor < diskBufferHeaderLen || b.cursor > info.Size() {
+		return fmt.Errorf("invalid cursor of disk buffer %s: %d", b.path, b.cursor)
+	}
+
+	b.size = b.cursor
+	for b.size < info.Size() {
+		length, _, err := b.readRecord(b.size)
+		if err != nil {
+			break
+		}
+		b.size += diskRecordHeaderLen + length
+	}
+
+	return b.f.Truncate(b.size)
+}
+
+func writeDiskBufferHeader(w io.WriterAt, cursor int64) error {
+	header := make([]byte, diskBufferHeaderLen)
+	copy(header, diskBufferMagic)
+	header[4] = diskBufferVersion
+	binary.BigEndian.PutUint64(header[5:], uint64(cursor))
+
+	_, err := w.WriteAt(header, 0)
+	return err
+}
+
+// readRecord reads the record at the given offset and returns the length
+// of its payload along with the decoded envelopes.
+func (b *diskBuffer) readRecord(offset int64) (int64, []*loggregator_v2.Envelope, error) {
+	header := make([]byte, diskRecordHeaderLen)
+	if _, err := b.f.ReadAt(header, offset); err != nil {
+		return 0, nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header))
+	payload := make([]byte, length)
+	if _, err := b.f.ReadAt(payload, offset+diskRecordHeaderLen); err != nil {
+		return 0, nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[8:]) {
+		return 0, nil, errors.New("corrupt disk buffer record")
+	}
+
+	var batch loggregator_v2.EnvelopeBatch
+	if err := proto.Unmarshal(payload, &batch); err != nil {
+		return 0, nil, err
+	}
+
+	return length, batch.GetBatch(), nil
+}
+
+// recordCount returns the length of the payload and the number of
+// envelopes of the record at the given offset without decoding it.
+func (b *diskBuffer) recordCount(offset int64) (int64, int, error) {
+	header := make([]byte, diskRecordHeaderLen)
+	if _, err := b.f.ReadAt(header, offset); err != nil {
+		return 0, 0, err
+	}
+
+	return int64(binary.BigEndian.Uint32(header)), int(binary.BigEndian.Uint32(header[4:])), nil
+}
+
+// push appends the given envelopes. If the unread records would exceed the
+// max size, the oldest ones are dropped. It returns the number of dropped
+// envelopes.
+func (b *diskBuffer) push(envelopes []*loggregator_v2.Envelope) (int, error) {
+	payload, err := proto.Marshal(&loggregator_v2.EnvelopeBatch{Batch: envelopes})
+	if err != nil {
+		return 0, err
+	}
+
+	record := make([]byte, diskRecordHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(envelopes)))
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(payload))
+	copy(record[diskRecordHeaderLen:], payload)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if int64(len(record)) > b.maxBytes {
+		return len(envelopes), nil
+	}
+
+	var dropped, evicted int
+	cursor := b.cursor
+	for b.size-cursor+int64(len(record)) > b.maxBytes {
+		length, count, err := b.recordCount(cursor)
+		if err != nil {
+			return 0, err
+		}
+		cursor += diskRecordHeaderLen + length
+		dropped += count
+		evicted++
+	}
+
+	if _, err := b.f.WriteAt(record, b.size); err != nil {
+		return 0, err
+	}
+	b.size += int64(len(record))
+
+	if cursor != b.cursor {
+		b.head += uint64(evicted)
+		if err := b.advance(cursor); err != nil {
+			return dropped, err
+		}
+	}
+
+	return dropped, nil
+}
+
+// peek returns the envelopes of the oldest unread record, or nil if there
+// is none, along with the head to pop it by.
+func (b *diskBuffer) peek() ([]*loggregator_v2.Envelope, uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cursor == b.size {
+		return nil, b.head, nil
+	}
+
+	_, envelopes, err := b.readRecord(b.cursor)
+	return envelopes, b.head, err
+}
+
+// pop removes the oldest unread record if it is still the one at the given
+// head, i.e., it has not been dropped by a push since it was peeked.
+func (b *diskBuffer) pop(head uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cursor == b.size || b.head != head {
+		return nil
+	}
+
+	length, _, err := b.recordCount(b.cursor)
+	if err != nil {
+		return err
+	}
+	b.head++
+
+	return b.advance(b.cursor + diskRecordHeaderLen + length)
+}
+
+// advance moves the cursor to the given offset. The file is truncated once
+// every record is read, and compacted once the read records exceed the max
+// size.
+func (b *diskBuffer) advance(cursor int64) error {
+	b.cursor = cursor
+
+	if b.cursor == b.size {
+		b.cursor, b.size = diskBufferHeaderLen, diskBufferHeaderLen
+		if err := writeDiskBufferHeader(b.f, b.cursor); err != nil {
+			return err
+		}
+		return b.f.Truncate(b.size)
+	}
+
+	if b.cursor-diskBufferHeaderLen > b.maxBytes {
+		return b.compact()
+	}
+
+	return writeDiskBufferHeader(b.f, b.cursor)
+}
+
+// compact rewrites the file without the read records. The new file
+// atomically replaces the old one, so a crash leaves either of them.
+func (b *diskBuffer) compact() error {
+	tmp, err := os.OpenFile(b.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	unread := io.NewSectionReader(b.f, b.cursor, b.size-b.cursor)
+	if _, err := tmp.Seek(diskBufferHeaderLen, io.SeekStart); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(tmp, unread); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := writeDiskBufferHeader(tmp, diskBufferHeaderLen); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	b.f.Close()
+	b.f = tmp
+	b.size = diskBufferHeaderLen + b.size - b.cursor
+	b.cursor = diskBufferHeaderLen
+
+	return nil
+}
+
+func (b *diskBuffer) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.f.Close()
+}
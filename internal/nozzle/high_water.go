@@ -0,0 +1,59 @@
+package nozzle
+
+import "container/list"
+
+// maxHighWaterSources is the number of sources the highWaterMarks keeps the
+// newest timestamp of. Once reached, the one of the least recently seen
+// source is evicted.
+const maxHighWaterSources = 10000
+
+// highWaterMarks tracks the newest timestamp per source ID. It is not safe
+// for concurrent use.
+type highWaterMarks struct {
+	maxSources int
+
+	marks map[string]*list.Element
+	lru   *list.List
+}
+
+type highWaterMark struct {
+	sourceID  string
+	timestamp int64
+}
+
+func newHighWaterMarks(maxSources int) *highWaterMarks {
+	return &highWaterMarks{
+		maxSources: maxSources,
+		marks:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// observe records the given timestamp of the given source. It returns the
+// newest timestamp of the source seen before, and reports whether the given
+// timestamp is older than it.
+func (h *highWaterMarks) observe(sourceID string, timestamp int64) (int64, bool) {
+	e, ok := h.marks[sourceID]
+	if !ok {
+		if h.lru.Len() >= h.maxSources {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.marks, oldest.Value.(*highWaterMark).sourceID)
+		}
+
+		h.marks[sourceID] = h.lru.PushFront(&highWaterMark{
+			sourceID:  sourceID,
+			timestamp: timestamp,
+		})
+		return timestamp, false
+	}
+	h.lru.MoveToFront(e)
+
+	m := e.Value.(*highWaterMark)
+	if timestamp < m.timestamp {
+		return m.timestamp, true
+	}
+	m.timestamp = timestamp
+
+	return timestamp, false
+}
@@ -1,18 +1,37 @@
 package nozzle
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	diodes "code.cloudfoundry.org/go-diodes"
 	"code.cloudfoundry.org/go-loggregator"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"code.cloudfoundry.org/log-cache/internal/metrics"
+	"code.cloudfoundry.org/log-cache/internal/tls"
 	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 // Nozzle reads envelopes and writes them to LogCache.
@@ -20,18 +39,92 @@ type Nozzle struct {
 	log          *log.Logger
 	s            StreamConnector
 	metrics      metrics.Initializer
+	metricPrefix string
 	shardId      string
+	nodeIndex    int
 	selectors    []string
+	prober       SelectorProber
+	supported    []string
 	streamBuffer *diodes.OneToOne
+	dryRun       bool
+
+	sinkMu sync.Mutex
+	sink   io.Writer
+
+	groupBySource bool
+
+	sampleRate            float64
+	deterministicSampling bool
+
+	timerGaugeName      string
+	dropConvertedTimers bool
+
+	counterRateName       string
+	counterRater          *counterRater
+	dropConvertedCounters bool
+
+	routingRules []RoutingRule
+	tagKey       string
+	tagRoutes    map[string]string
+	rateLimiter  *sourceRateLimiter
+
+	validSourceID func(string) bool
+
+	highWaterMarks  *highWaterMarks
+	clampOutOfOrder bool
+
+	maxPayloadBytes int
+	maxEnvelopeAge  time.Duration
+	now             func() time.Time
+	writeTimeout    time.Duration
+
+	heartbeatInterval  time.Duration
+	successRatioWindow time.Duration
+
+	diskBufferDir      string
+	diskBufferMaxBytes int64
+	diskBuffer         *diskBuffer
+
+	lastErrMu sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
 
 	// LogCache
 	addr string
 	opts []grpc.DialOption
+
+	// ctx is cancelled to stop reading from the logs provider.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stopped     chan struct{}
+	stopOnce    sync.Once
+	draining    chan struct{}
+	drainOnce   sync.Once
+	readerDone  chan struct{}
+	writersDone chan struct{}
+
+	// pending is the number of envelopes that have been read, but neither
+	// written nor dropped yet.
+	pending int64
 }
 
 const (
 	BATCH_FLUSH_INTERVAL = 500 * time.Millisecond
 	BATCH_CHANNEL_SIZE   = 512
+
+	// DEFAULT_WRITE_TIMEOUT is how long a single write to LogCache may take
+	// unless configured with WithWriteTimeout.
+	DEFAULT_WRITE_TIMEOUT = 6 * BATCH_FLUSH_INTERVAL
+
+	// MAX_SOURCES_PER_FLUSH is the number of sources a flush is split into
+	// at most if configured WithGroupBySource. The envelopes of any further
+	// sources are written together in one more batch.
+	MAX_SOURCES_PER_FLUSH = 100
+
+	// MAX_SOURCE_ID_LENGTH is the maximum length of a source ID accepted
+	// by ValidSourceID.
+	MAX_SOURCE_ID_LENGTH = 256
 )
 
 // StreamConnector reads envelopes from the the logs provider.
@@ -40,17 +133,49 @@ type StreamConnector interface {
 	Stream(ctx context.Context, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream
 }
 
-// NewNozzle creates a new Nozzle.
+// NewNozzle creates a new Nozzle. Configured selectors the logs provider
+// does not support are logged as warnings.
 func NewNozzle(c StreamConnector, logCacheAddr string, shardId string, opts ...NozzleOption) *Nozzle {
+	n := newNozzle(c, logCacheAddr, shardId, opts...)
+	if err := n.checkSelectors(); err != nil {
+		n.log.Printf("warning: %s", err)
+	}
+
+	return n
+}
+
+// NewNozzleE creates a new Nozzle like NewNozzle, but returns an error when
+// a configured selector is not supported by the logs provider.
+func NewNozzleE(c StreamConnector, logCacheAddr string, shardId string, opts ...NozzleOption) (*Nozzle, error) {
+	n := newNozzle(c, logCacheAddr, shardId, opts...)
+	if err := n.checkSelectors(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func newNozzle(c StreamConnector, logCacheAddr string, shardId string, opts ...NozzleOption) *Nozzle {
 	n := &Nozzle{
-		s:         c,
-		addr:      logCacheAddr,
-		opts:      []grpc.DialOption{grpc.WithInsecure()},
-		log:       log.New(ioutil.Discard, "", 0),
-		metrics:   metrics.NullMetrics{},
-		shardId:   shardId,
-		selectors: []string{},
+		s:            c,
+		addr:         logCacheAddr,
+		opts:         []grpc.DialOption{grpc.WithInsecure()},
+		log:          log.New(ioutil.Discard, "", 0),
+		metrics:      metrics.NullMetrics{},
+		metricPrefix: "nozzle",
+		shardId:      shardId,
+		nodeIndex:    -1,
+		selectors:    []string{},
+		sampleRate:   1,
+		now:          time.Now,
+		writeTimeout: DEFAULT_WRITE_TIMEOUT,
+
+		stopped:     make(chan struct{}),
+		draining:    make(chan struct{}),
+		readerDone:  make(chan struct{}),
+		writersDone: make(chan struct{}),
 	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
 
 	for _, o := range opts {
 		o(n)
@@ -58,6 +183,7 @@ func NewNozzle(c StreamConnector, logCacheAddr string, shardId string, opts ...N
 
 	n.streamBuffer = diodes.NewOneToOne(100000, diodes.AlertFunc(func(missed int) {
 		n.log.Printf("stream buffer dropped %d points", missed)
+		atomic.AddInt64(&n.pending, -int64(missed))
 	}))
 
 	return n
@@ -67,7 +193,8 @@ func NewNozzle(c StreamConnector, logCacheAddr string, shardId string, opts ...N
 type NozzleOption func(*Nozzle)
 
 // WithLogger returns a NozzleOption that configures a nozzle's logger.
-// It defaults to silent logging.
+// Failed writes, draining and stopping are logged, while successful writes
+// are not. It defaults to silent logging.
 func WithLogger(l *log.Logger) NozzleOption {
 	return func(n *Nozzle) {
 		n.log = l
@@ -82,6 +209,45 @@ func WithMetrics(metrics metrics.Initializer) NozzleOption {
 	}
 }
 
+// WithMetricPrefix returns a NozzleOption that configures the prefix of the
+// names of the Nozzle metrics. The metrics are named <prefix>_ingress,
+// <prefix>_egress and so on. This allows several Nozzles to publish their
+// metrics to the same registry. It defaults to "nozzle".
+func WithMetricPrefix(prefix string) NozzleOption {
+	return func(n *Nozzle) {
+		n.metricPrefix = prefix
+	}
+}
+
+// NodeTag is the tag of the envelopes written by a Nozzle configured
+// WithNodeIndex.
+const NodeTag = "nozzle_node"
+
+// WithNodeIndex returns a NozzleOption that configures the index of the
+// node the Nozzle runs on in a multi-node deployment. Each envelope is
+// tagged with it as nozzle_node, unless it already has such a tag, and the
+// counters of the Nozzle are registered per node. It defaults to no index.
+func WithNodeIndex(i int) NozzleOption {
+	return func(n *Nozzle) {
+		n.nodeIndex = i
+	}
+}
+
+// newCounter registers the counter of the given name with the metric
+// prefix, per node if configured WithNodeIndex.
+func (n *Nozzle) newCounter(name string) func(uint64) {
+	if n.nodeIndex < 0 {
+		return n.metrics.NewCounter(n.metricName(name))
+	}
+
+	return n.metrics.NewPerNodeCounter(n.metricName(name), n.nodeIndex)
+}
+
+// metricName returns the name of the given metric with the metric prefix.
+func (n *Nozzle) metricName(name string) string {
+	return n.metricPrefix + "_" + name
+}
+
 // WithDialOpts returns a NozzleOption that configures the dial options
 // for dialing the LogCache. It defaults to grpc.WithInsecure().
 func WithDialOpts(opts ...grpc.DialOption) NozzleOption {
@@ -90,71 +256,632 @@ func WithDialOpts(opts ...grpc.DialOption) NozzleOption {
 	}
 }
 
+// WithReloadableTLS returns a NozzleOption that configures the Nozzle to
+// dial the LogCache via mutual TLS, and to load the certificate, key and CA
+// from the given paths on each handshake. Connections that are established
+// after the files were rotated therefore use the new certificate without a
+// restart. The certificate of LogCache has to be issued for "log-cache". It
+// replaces the dial options set via WithDialOpts.
+func WithReloadableTLS(certPath, keyPath, caPath string) NozzleOption {
+	return func(n *Nozzle) {
+		n.opts = []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(
+				tls.NewReloadableMutualTLSConfig(caPath, certPath, keyPath, "log-cache"),
+			)),
+		}
+	}
+}
+
 func WithSelectors(selectors ...string) NozzleOption {
 	return func(n *Nozzle) {
 		n.selectors = selectors
 	}
 }
 
+// SelectorProber discovers which selectors the logs provider accepts.
+type SelectorProber interface {
+	// SupportedSelectors returns the supported selector types, e.g. "log"
+	// or "gauge".
+	SupportedSelectors(ctx context.Context) ([]string, error)
+}
+
+// SelectorProberFunc is an adapter to allow ordinary functions to be used
+// as SelectorProbers.
+type SelectorProberFunc func(ctx context.Context) ([]string, error)
+
+// SupportedSelectors implements SelectorProber.
+func (f SelectorProberFunc) SupportedSelectors(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// WithSelectorProber returns a NozzleOption that configures the
+// SelectorProber that is queried at startup for the selectors the logs
+// provider supports (see NewStreamSelectorProber). Without one, every known
+// selector type is assumed to be supported.
+func WithSelectorProber(p SelectorProber) NozzleOption {
+	return func(n *Nozzle) {
+		n.prober = p
+	}
+}
+
+// NewStreamSelectorProber returns a SelectorProber that streams every
+// selector type from the logs provider under the given shard ID, and
+// reports the types of the envelopes it receives until the probe's context
+// is done. The logs provider has no API to query its capabilities, so a
+// disabled type and a type no source emits both look like silence and are
+// reported as unsupported. The shard ID must differ from the one of the
+// Nozzle, otherwise the probe takes envelopes from it.
+func NewStreamSelectorProber(c StreamConnector, shardID string) SelectorProber {
+	return SelectorProberFunc(func(ctx context.Context) ([]string, error) {
+		types := make([]string, 0, len(selectorTypes))
+		for t := range selectorTypes {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+
+		req := &loggregator_v2.EgressBatchRequest{
+			ShardId:          shardID,
+			UsePreferredTags: true,
+		}
+		for _, t := range types {
+			req.Selectors = append(req.Selectors, selectorTypes[t])
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		rx := c.Stream(ctx, req)
+
+		seen := make(map[string]bool)
+		for ctx.Err() == nil && len(seen) < len(types) {
+			for _, e := range rx() {
+				if t := envelopeSelectorType(e); t != "" {
+					seen[t] = true
+				}
+			}
+		}
+
+		if len(seen) == 0 {
+			return nil, errors.New("no envelopes received from the logs provider")
+		}
+
+		supported := make([]string, 0, len(seen))
+		for t := range seen {
+			supported = append(supported, t)
+		}
+
+		return supported, nil
+	})
+}
+
+// envelopeSelectorType returns the selector type that selects the given
+// envelope, or an empty string for an envelope without a message.
+func envelopeSelectorType(e *loggregator_v2.Envelope) string {
+	switch e.Message.(type) {
+	case *loggregator_v2.Envelope_Log:
+		return "log"
+	case *loggregator_v2.Envelope_Gauge:
+		return "gauge"
+	case *loggregator_v2.Envelope_Counter:
+		return "counter"
+	case *loggregator_v2.Envelope_Timer:
+		return "timer"
+	case *loggregator_v2.Envelope_Event:
+		return "event"
+	default:
+		return ""
+	}
+}
+
+// WithWriteTimeout returns a NozzleOption that configures how long a single
+// write to LogCache may take before it is abandoned and counted as an
+// error. It defaults to DEFAULT_WRITE_TIMEOUT.
+func WithWriteTimeout(d time.Duration) NozzleOption {
+	return func(n *Nozzle) {
+		n.writeTimeout = d
+	}
+}
+
+// WithDiskBuffer returns a NozzleOption that configures the Nozzle to
+// spill the envelopes it can't write to LogCache, because LogCache is
+// unavailable or the Nozzle falls behind, to a queue on disk in the given
+// directory. The spilled envelopes are written once LogCache recovers,
+// also after a restart. They are written at least once, and possibly more
+// often. Up to maxBytes are kept on disk, beyond which the oldest envelopes
+// are dropped. The spilled envelopes are counted by
+// nozzle_disk_buffer_spilled and the dropped ones by
+// nozzle_disk_buffer_dropped. It is disabled by default.
+func WithDiskBuffer(dir string, maxBytes int64) NozzleOption {
+	return func(n *Nozzle) {
+		n.diskBufferDir = dir
+		n.diskBufferMaxBytes = maxBytes
+	}
+}
+
+// WithHeartbeat returns a NozzleOption that configures the Nozzle to
+// increment the nozzle_heartbeat counter on the given interval, regardless
+// of traffic. Its absence tells a dead or stuck Nozzle apart from an idle
+// one. It is disabled by default.
+func WithHeartbeat(interval time.Duration) NozzleOption {
+	return func(n *Nozzle) {
+		n.heartbeatInterval = interval
+	}
+}
+
+// WithSuccessRatioWindow returns a NozzleOption that configures the Nozzle
+// to publish the nozzle_write_success_ratio gauge. It is the ratio of
+// successful writes to LogCache among all writes within the sliding window
+// of the given duration, so a single number to alert on. Unlike
+// nozzle_egress, it counts writes rather than envelopes, like nozzle_err.
+// It is 1 without any traffic in the window. It is disabled by default.
+func WithSuccessRatioWindow(d time.Duration) NozzleOption {
+	return func(n *Nozzle) {
+		n.successRatioWindow = d
+	}
+}
+
+// WithGroupBySource returns a NozzleOption that configures the Nozzle to
+// split each flush into one write per source ID, which improves the write
+// locality of LogCache. A flush is split into at most MAX_SOURCES_PER_FLUSH
+// writes, plus one for the envelopes of any further sources. The number of
+// distinct sources per flush is reported by the nozzle_sources_per_flush
+// gauge.
+func WithGroupBySource() NozzleOption {
+	return func(n *Nozzle) {
+		n.groupBySource = true
+	}
+}
+
+// WithDryRun returns a NozzleOption that configures the Nozzle to read and
+// process envelopes without ever writing them to LogCache. The egress metric
+// then reports what would have been written. It is useful to measure the
+// volume of a set of selectors. The nozzle_dry_run gauge is set to 1 while
+// enabled.
+func WithDryRun() NozzleOption {
+	return func(n *Nozzle) {
+		n.dryRun = true
+	}
+}
+
+// WithEnvelopeSink returns a NozzleOption that configures the Nozzle to
+// render each envelope it writes to LogCache as one line of protobuf text
+// to the given writer, e.g. os.Stdout to debug selectors and filters. In
+// combination with WithDryRun, the envelopes are only rendered. It defaults
+// to no sink.
+func WithEnvelopeSink(w io.Writer) NozzleOption {
+	return func(n *Nozzle) {
+		n.sink = w
+	}
+}
+
+// WithSampleRate returns a NozzleOption that configures the Nozzle to only
+// write the given fraction of envelopes. Every other envelope is dropped
+// before it is written and counted by nozzle_sampled_out. The rate is
+// clamped to [0, 1] and defaults to 1, writing every envelope.
+func WithSampleRate(rate float64) NozzleOption {
+	return func(n *Nozzle) {
+		n.sampleRate = math.Max(0, math.Min(1, rate))
+	}
+}
+
+// WithDeterministicSampling returns a NozzleOption that configures the
+// Nozzle to sample by a hash of the source ID and timestamp of each
+// envelope instead of randomly. An envelope is therefore always sampled the
+// same way. It only has an effect together with WithSampleRate.
+func WithDeterministicSampling() NozzleOption {
+	return func(n *Nozzle) {
+		n.deterministicSampling = true
+	}
+}
+
+// WithTimerToGauge returns a NozzleOption that configures the Nozzle to
+// write an additional gauge envelope for each timer envelope. The gauge has
+// a single metric with the given name and the duration of the timer in
+// nanoseconds. It keeps the timestamp, source ID, instance ID and tags of
+// the timer. It defaults to no conversion.
+func WithTimerToGauge(metricName string) NozzleOption {
+	return func(n *Nozzle) {
+		n.timerGaugeName = metricName
+	}
+}
+
+// WithDropConvertedTimers returns a NozzleOption that configures the Nozzle
+// to only write the gauge envelope of timer envelopes converted via
+// WithTimerToGauge, and to drop the timer envelope itself.
+func WithDropConvertedTimers() NozzleOption {
+	return func(n *Nozzle) {
+		n.dropConvertedTimers = true
+	}
+}
+
+// WithCounterRate returns a NozzleOption that configures the Nozzle to
+// write an additional gauge envelope for counter envelopes with the given
+// name. The gauge has a single metric named <name>_rate with the per second
+// rate of the counter total since the last gauge of the same source and
+// instance ID. A gauge is written at most once per the given window. A reset
+// of the counter yields a rate of 0. Only the most recently seen 10000
+// source and instance IDs are tracked. It defaults to no conversion.
+func WithCounterRate(metricName string, window time.Duration) NozzleOption {
+	return func(n *Nozzle) {
+		n.counterRateName = metricName
+		n.counterRater = newCounterRater(window, maxCounterRateSources)
+	}
+}
+
+// WithDropConvertedCounters returns a NozzleOption that configures the
+// Nozzle to drop the counter envelopes converted via WithCounterRate instead
+// of writing them alongside their gauge.
+func WithDropConvertedCounters() NozzleOption {
+	return func(n *Nozzle) {
+		n.dropConvertedCounters = true
+	}
+}
+
+// RoutingRule routes the envelopes of every source ID that matches the
+// SourceIDPattern to the LogCache at Addr. The pattern uses the syntax of
+// path.Match (e.g., "tenant-a-*").
+type RoutingRule struct {
+	SourceIDPattern string
+	Addr            string
+}
+
+// WithSourceRouting returns a NozzleOption that configures the Nozzle to
+// write the envelopes of each source to the LogCache of the first matching
+// rule. Envelopes of a source that matches no rule are written to the
+// LogCache address given to NewNozzle. If that address is empty, they are
+// dropped and counted by nozzle_unrouted. The egress of each LogCache is
+// counted by nozzle_egress_per_target. It defaults to writing every
+// envelope to the LogCache address given to NewNozzle.
+func WithSourceRouting(rules []RoutingRule) NozzleOption {
+	return func(n *Nozzle) {
+		n.routingRules = rules
+	}
+}
+
+// WithTagRouting returns a NozzleOption that configures the Nozzle to
+// write the envelopes to the LogCache that the value of their tag with the
+// given key maps to (e.g., a "tenant" tag). Envelopes without the tag, or
+// with a value that maps to no LogCache, are routed like without tag
+// routing, i.e., via WithSourceRouting or to the LogCache address given to
+// NewNozzle. If that address is empty, they are dropped and counted by
+// nozzle_unrouted. Tag routing takes precedence over source routing.
+func WithTagRouting(tagKey string, routes map[string]string) NozzleOption {
+	return func(n *Nozzle) {
+		n.tagKey = tagKey
+		n.tagRoutes = routes
+	}
+}
+
+// WithPerSourceRateLimit returns a NozzleOption that configures the Nozzle
+// to limit the envelopes of each source ID to the given rate per second,
+// allowing bursts of the given size. Envelopes beyond the rate are dropped
+// and counted by nozzle_rate_limited. Only the most recently seen 10000
+// sources are tracked. It defaults to no rate limit.
+func WithPerSourceRateLimit(eventsPerSecond float64, burst int) NozzleOption {
+	return func(n *Nozzle) {
+		n.rateLimiter = newSourceRateLimiter(eventsPerSecond, burst, maxRateLimitedSources)
+	}
+}
+
+// WithSourceIDValidator returns a NozzleOption that configures the Nozzle
+// to drop envelopes with a source ID the given function rejects instead of
+// writing them. They are counted by nozzle_invalid_source. This keeps bad
+// source IDs from exploding the number of sources in LogCache. See
+// ValidSourceID for a default. It defaults to no validation.
+func WithSourceIDValidator(f func(sourceID string) bool) NozzleOption {
+	return func(n *Nozzle) {
+		n.validSourceID = f
+	}
+}
+
+// ValidSourceID reports whether the given source ID is neither empty nor
+// longer than MAX_SOURCE_ID_LENGTH.
+func ValidSourceID(sourceID string) bool {
+	return sourceID != "" && len(sourceID) <= MAX_SOURCE_ID_LENGTH
+}
+
+// WithMonotonicTimestamps returns a NozzleOption that configures the Nozzle
+// to drop envelopes with a timestamp older than the newest one it has seen
+// of the same source, as they confuse consumers that assume ordered
+// ingestion. They are counted by nozzle_out_of_order. Only the most
+// recently seen 10000 sources are tracked. It defaults to keeping the
+// envelopes in any order.
+func WithMonotonicTimestamps() NozzleOption {
+	return func(n *Nozzle) {
+		n.highWaterMarks = newHighWaterMarks(maxHighWaterSources)
+	}
+}
+
+// WithClampOutOfOrder returns a NozzleOption that configures the Nozzle to
+// set the timestamp of the envelopes that are out of order to the newest
+// timestamp of their source instead of dropping them. They are still
+// counted by nozzle_out_of_order. It only has an effect in combination with
+// WithMonotonicTimestamps.
+func WithClampOutOfOrder() NozzleOption {
+	return func(n *Nozzle) {
+		n.clampOutOfOrder = true
+	}
+}
+
+// TruncationMarker is appended to the payload of log envelopes that are
+// truncated via WithMaxPayloadBytes.
+const TruncationMarker = "...[truncated]"
+
+// WithMaxPayloadBytes returns a NozzleOption that configures the Nozzle to
+// truncate the payload of log envelopes to at most the given number of
+// bytes. A truncated payload ends with the TruncationMarker and is counted
+// by nozzle_truncated. Other envelope types are not affected. It defaults to
+// no limit.
+func WithMaxPayloadBytes(n int) NozzleOption {
+	return func(nz *Nozzle) {
+		nz.maxPayloadBytes = n
+	}
+}
+
+// WithMaxEnvelopeAge returns a NozzleOption that configures the Nozzle to
+// drop envelopes with a timestamp older than the given age instead of
+// writing them. They are counted by nozzle_too_old. This avoids writing a
+// backlog of envelopes that LogCache would evict right away. It defaults to
+// no maximum age.
+func WithMaxEnvelopeAge(d time.Duration) NozzleOption {
+	return func(n *Nozzle) {
+		n.maxEnvelopeAge = d
+	}
+}
+
+// WithClock returns a NozzleOption that configures the function the Nozzle
+// uses to get the current time. It defaults to time.Now.
+func WithClock(now func() time.Time) NozzleOption {
+	return func(n *Nozzle) {
+		n.now = now
+	}
+}
+
 // Start starts reading envelopes from the logs provider and writes them to
-// LogCache. It blocks indefinitely.
+// LogCache. It blocks until the Nozzle is stopped or drained.
 func (n *Nozzle) Start() {
-	rx := n.s.Stream(context.Background(), n.buildBatchReq())
+	rx := n.s.Stream(n.ctx, n.buildBatchReq())
 
-	conn, err := grpc.Dial(n.addr, n.opts...)
-	if err != nil {
-		log.Fatalf("failed to dial %s: %s", n.addr, err)
+	clients := make(map[string]logcache_v1.IngressClient)
+	setDryRun := n.metrics.NewGauge(n.metricName("dry_run"), "boolean")
+	if n.dryRun {
+		n.log.Printf("DRY RUN: envelopes will not be written to %s", n.addr)
+		setDryRun(1)
+	} else {
+		for _, addr := range n.targets() {
+			conn, err := grpc.Dial(addr, n.opts...)
+			if err != nil {
+				log.Fatalf("failed to dial %s: %s", addr, err)
+			}
+			clients[addr] = logcache_v1.NewIngressClient(conn)
+		}
+	}
+
+	rm := readerMetrics{
+		ingressInc:       n.newCounter("ingress"),
+		sampledOutInc:    n.newCounter("sampled_out"),
+		rateLimitedInc:   n.newCounter("rate_limited"),
+		truncatedInc:     n.newCounter("truncated"),
+		tooOldInc:        n.newCounter("too_old"),
+		invalidSourceInc: n.newCounter("invalid_source"),
+		outOfOrderInc:    n.newCounter("out_of_order"),
+		readBatchSize:    n.metrics.NewHistogram(n.metricName("read_batch_size"), "entries", readBatchSizeBuckets, nil),
+	}
+	m := writerMetrics{
+		egressInc:            n.newCounter("egress"),
+		errInc:               n.newCounter("err"),
+		unroutedInc:          n.newCounter("unrouted"),
+		targetEgressInc:      func(uint64, ...string) {},
+		writeDurationSuccess: n.metrics.NewHistogram(n.metricName("write_duration_seconds"), "seconds", nil, map[string]string{"result": "success"}),
+		writeDurationFailure: n.metrics.NewHistogram(n.metricName("write_duration_seconds"), "seconds", nil, map[string]string{"result": "failure"}),
+		individualRetryInc:   n.newCounter("individual_retries"),
+		poisonInc:            n.newCounter("poison"),
+		setSourcesPerFlush:   func(float64) {},
+		bufferAge:            newBufferAge(n.metrics.NewGauge(n.metricName("buffer_oldest_age_seconds"), "seconds")),
+		diskSpilledInc:       func(uint64) {},
+		diskDroppedInc:       func(uint64) {},
+	}
+	if n.groupBySource {
+		m.setSourcesPerFlush = n.metrics.NewGauge(n.metricName("sources_per_flush"), "entries")
 	}
-	client := logcache_v1.NewIngressClient(conn)
+	if n.routing() {
+		m.targetEgressInc = n.metrics.NewCounterVec(n.metricName("egress_per_target"), []string{"target"})
+	}
+
+	if n.diskBufferDir != "" && !n.dryRun {
+		b, err := openDiskBuffer(n.diskBufferDir, n.diskBufferMaxBytes)
+		if err != nil {
+			log.Fatalf("failed to open disk buffer in %s: %s", n.diskBufferDir, err)
+		}
+		n.diskBuffer = b
+		m.diskSpilledInc = n.newCounter("disk_buffer_spilled")
+		m.diskDroppedInc = n.newCounter("disk_buffer_dropped")
 
-	ingressInc := n.metrics.NewCounter("nozzle_ingress")
-	egressInc := n.metrics.NewCounter("nozzle_egress")
-	errInc := n.metrics.NewCounter("nozzle_err")
+		go n.replayDiskBuffer(clients, m)
+	}
 
-	go n.envelopeReader(rx, ingressInc)
+	if n.heartbeatInterval > 0 {
+		go n.heartbeat(n.newCounter("heartbeat"))
+	}
 
-	ch := make(chan []*loggregator_v2.Envelope, BATCH_CHANNEL_SIZE)
+	if n.successRatioWindow > 0 {
+		r := newSuccessRatio(n.successRatioWindow, successRatioSlots)
+		egressInc, errInc := m.egressInc, m.errInc
+		m.egressInc = func(d uint64) {
+			egressInc(d)
+			// Each call is a successful write of d envelopes.
+			r.add(time.Now(), 1, 0)
+		}
+		m.errInc = func(d uint64) {
+			errInc(d)
+			r.add(time.Now(), 0, d)
+		}
 
-	log.Printf("Starting %d nozzle workers...", 2*runtime.NumCPU())
+		go n.publishSuccessRatio(r, n.metrics.NewGauge(n.metricName("write_success_ratio"), "ratio"))
+	}
+
+	go n.envelopeReader(rx, rm)
+
+	ch := make(chan envelopeBatch, BATCH_CHANNEL_SIZE)
+
+	var wg sync.WaitGroup
+	n.log.Printf("Starting %d nozzle workers...", 2*runtime.NumCPU())
 	for i := 0; i < 2*runtime.NumCPU(); i++ {
-		go n.envelopeWriter(ch, client, errInc, egressInc)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.envelopeWriter(ch, clients, m)
+		}()
+	}
+
+	// The batcher blocks until the Nozzle is stopped or drained.
+	n.envelopeBatcher(ch, m)
+
+	close(ch)
+	wg.Wait()
+	close(n.writersDone)
+}
+
+// Stop stops reading and writing envelopes. Envelopes that have been read,
+// but not written yet are dropped. Use Drain to write them first.
+func (n *Nozzle) Stop() {
+	if undrained := n.undrained(); undrained > 0 {
+		n.log.Printf("stopping nozzle, dropping %d unwritten envelopes", undrained)
+	}
+	n.cancel()
+	n.stopOnce.Do(func() {
+		close(n.stopped)
+	})
+}
+
+// heartbeat increments the given counter on the heartbeat interval until
+// the Nozzle is stopped.
+func (n *Nozzle) heartbeat(inc func(uint64)) {
+	t := time.NewTicker(n.heartbeatInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			inc(1)
+		case <-n.stopped:
+			return
+		}
+	}
+}
+
+// publishSuccessRatio sets the given gauge to the success ratio once per
+// slot of its window until the Nozzle is stopped.
+func (n *Nozzle) publishSuccessRatio(r *successRatio, set func(float64)) {
+	t := time.NewTicker(time.Duration(r.slotSize))
+	defer t.Stop()
+
+	set(r.ratio(time.Now()))
+	for {
+		select {
+		case <-t.C:
+			set(r.ratio(time.Now()))
+		case <-n.stopped:
+			return
+		}
+	}
+}
+
+// Drain stops reading envelopes, and keeps writing the envelopes that have
+// been read until there are none left or the given context is done. It
+// returns the number of envelopes that were not written yet when the
+// context was done. These are dropped by a subsequent Stop.
+func (n *Nozzle) Drain(ctx context.Context) int {
+	n.log.Printf("draining nozzle")
+	n.cancel()
+
+	select {
+	case <-n.readerDone:
+	case <-ctx.Done():
+		n.log.Printf("failed to drain nozzle: %s", ctx.Err())
+		return n.undrained()
+	}
+
+	n.drainOnce.Do(func() {
+		close(n.draining)
+	})
+
+	select {
+	case <-n.writersDone:
+	case <-ctx.Done():
+		n.log.Printf("failed to drain nozzle: %s", ctx.Err())
+	}
+
+	return n.undrained()
+}
+
+func (n *Nozzle) undrained() int {
+	pending := atomic.LoadInt64(&n.pending)
+	if pending < 0 {
+		return 0
 	}
 
-	// The batcher will block indefinitely.
-	n.envelopeBatcher(ch)
+	return int(pending)
 }
 
-func (n *Nozzle) envelopeBatcher(ch chan []*loggregator_v2.Envelope) {
+func (n *Nozzle) envelopeBatcher(ch chan envelopeBatch, m writerMetrics) {
 	poller := diodes.NewPoller(n.streamBuffer)
-	envelopes := make([]*loggregator_v2.Envelope, 0)
+	batch := envelopeBatch{envelopes: make([]*loggregator_v2.Envelope, 0)}
 	t := time.NewTimer(BATCH_FLUSH_INTERVAL)
 	for {
+		select {
+		case <-n.stopped:
+			return
+		default:
+		}
+
 		data, found := poller.TryNext()
 
 		if found {
-			envelopes = append(envelopes, (*loggregator_v2.Envelope)(data))
+			b := (*bufferedEnvelope)(data)
+			if len(batch.envelopes) == 0 {
+				batch.ageID = m.bufferAge.add(b.enqueued)
+			}
+			batch.envelopes = append(batch.envelopes, b.envelope)
+		}
+
+		if !found && n.isDraining() {
+			// The reader is done, so the buffer is empty for good.
+			if len(batch.envelopes) > 0 {
+				select {
+				case ch <- batch:
+				case <-n.stopped:
+				}
+			}
+			return
 		}
 
 		select {
 		case <-t.C:
-			if len(envelopes) > 0 {
+			if len(batch.envelopes) > 0 {
 				select {
-				case ch <- envelopes:
-					envelopes = make([]*loggregator_v2.Envelope, 0)
+				case ch <- batch:
+					batch = envelopeBatch{envelopes: make([]*loggregator_v2.Envelope, 0)}
 				default:
 					// if we can't write into the channel, it must be full, so
 					// we probably need to drop these envelopes on the floor
-					envelopes = envelopes[:0]
+					n.spill(batch.envelopes, m)
+					atomic.AddInt64(&n.pending, -int64(len(batch.envelopes)))
+					m.bufferAge.remove(batch.ageID)
+					batch.envelopes = batch.envelopes[:0]
 				}
 			}
+			m.bufferAge.publish()
 			t.Reset(BATCH_FLUSH_INTERVAL)
 		default:
-			if len(envelopes) >= BATCH_CHANNEL_SIZE {
+			if len(batch.envelopes) >= BATCH_CHANNEL_SIZE {
 				select {
-				case ch <- envelopes:
-					envelopes = make([]*loggregator_v2.Envelope, 0)
+				case ch <- batch:
+					batch = envelopeBatch{envelopes: make([]*loggregator_v2.Envelope, 0)}
 				default:
-					envelopes = envelopes[:0]
+					n.spill(batch.envelopes, m)
+					atomic.AddInt64(&n.pending, -int64(len(batch.envelopes)))
+					m.bufferAge.remove(batch.ageID)
+					batch.envelopes = batch.envelopes[:0]
 				}
 				t.Reset(BATCH_FLUSH_INTERVAL)
 			}
@@ -165,36 +892,644 @@ func (n *Nozzle) envelopeBatcher(ch chan []*loggregator_v2.Envelope) {
 	}
 }
 
-func (n *Nozzle) envelopeWriter(ch chan []*loggregator_v2.Envelope, client logcache_v1.IngressClient, errInc, egressInc func(uint64)) {
+// bufferedEnvelope is an envelope in the stream buffer.
+type bufferedEnvelope struct {
+	envelope *loggregator_v2.Envelope
+	enqueued time.Time
+}
+
+// envelopeBatch is a batch of envelopes to write, along with its ID in the
+// bufferAge.
+type envelopeBatch struct {
+	envelopes []*loggregator_v2.Envelope
+	ageID     uint64
+}
+
+// writerMetrics are the metrics of the envelopeWriter.
+type writerMetrics struct {
+	egressInc            func(uint64)
+	errInc               func(uint64)
+	unroutedInc          func(uint64)
+	targetEgressInc      func(uint64, ...string)
+	writeDurationSuccess func(float64)
+	writeDurationFailure func(float64)
+	individualRetryInc   func(uint64)
+	poisonInc            func(uint64)
+	setSourcesPerFlush   func(float64)
+	bufferAge            *bufferAge
+	diskSpilledInc       func(uint64)
+	diskDroppedInc       func(uint64)
+}
+
+func (n *Nozzle) isDraining() bool {
+	select {
+	case <-n.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Nozzle) envelopeWriter(ch chan envelopeBatch, clients map[string]logcache_v1.IngressClient, m writerMetrics) {
 	for {
-		envelopes := <-ch
+		var batch envelopeBatch
+		select {
+		case <-n.stopped:
+			return
+		case b, ok := <-ch:
+			if !ok {
+				return
+			}
+			batch = b
+		}
 
-		ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-		_, err := client.Send(ctx, &logcache_v1.SendRequest{
-			Envelopes: &loggregator_v2.EnvelopeBatch{
-				Batch: envelopes,
-			},
-		})
+		n.write(batch.envelopes, clients, m)
+		atomic.AddInt64(&n.pending, -int64(len(batch.envelopes)))
+		m.bufferAge.remove(batch.ageID)
+	}
+}
+
+// write writes the given envelopes to their LogCaches.
+func (n *Nozzle) write(envelopes []*loggregator_v2.Envelope, clients map[string]logcache_v1.IngressClient, m writerMetrics) {
+	for addr, batch := range n.route(envelopes, m.unroutedInc) {
+		if !n.groupBySource {
+			n.writeBatch(addr, batch, clients, m)
+			continue
+		}
+
+		batches, sources := groupBySource(batch, MAX_SOURCES_PER_FLUSH)
+		m.setSourcesPerFlush(float64(sources))
+		for _, b := range batches {
+			n.writeBatch(addr, b, clients, m)
+		}
+	}
+}
+
+func (n *Nozzle) writeBatch(addr string, batch []*loggregator_v2.Envelope, clients map[string]logcache_v1.IngressClient, m writerMetrics) {
+	if n.dryRun {
+		n.render(batch)
+		m.egressInc(uint64(len(batch)))
+		m.targetEgressInc(uint64(len(batch)), addr)
+		return
+	}
+
+	// The write duration is recorded for failed writes as well, as a
+	// write that times out is the most telling sign of backpressure.
+	start := time.Now()
+	err := n.send(clients[addr], batch)
+
+	if err != nil {
+		n.log.Printf("failed to write %d envelopes to %s: %s", len(batch), addr, err)
+		m.writeDurationFailure(time.Since(start).Seconds())
+		m.errInc(1)
+
+		if rejected(err) {
+			n.writeIndividually(clients[addr], addr, batch, m)
+		} else {
+			n.spill(batch, m)
+		}
+		return
+	}
+
+	m.writeDurationSuccess(time.Since(start).Seconds())
+
+	n.render(batch)
+	m.egressInc(uint64(len(batch)))
+	m.targetEgressInc(uint64(len(batch)), addr)
+}
+
+// render writes the given envelopes to the envelope sink, one per line.
+func (n *Nozzle) render(batch []*loggregator_v2.Envelope) {
+	if n.sink == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, e := range batch {
+		buf.WriteString(proto.CompactTextString(e))
+		buf.WriteByte('\n')
+	}
+
+	n.sinkMu.Lock()
+	defer n.sinkMu.Unlock()
+
+	if _, err := n.sink.Write(buf.Bytes()); err != nil {
+		n.log.Printf("failed to render %d envelopes: %s", len(batch), err)
+	}
+}
+
+// groupBySource splits the given envelopes into one batch per source ID,
+// in the order the sources first appear. The envelopes of the sources
+// beyond maxSources are put into one more batch. It also returns the number
+// of distinct sources.
+func groupBySource(envelopes []*loggregator_v2.Envelope, maxSources int) ([][]*loggregator_v2.Envelope, int) {
+	var (
+		batches [][]*loggregator_v2.Envelope
+		rest    []*loggregator_v2.Envelope
+	)
+	index := make(map[string]int)
+	overflow := make(map[string]bool)
+
+	for _, e := range envelopes {
+		sourceID := e.GetSourceId()
+		if i, ok := index[sourceID]; ok {
+			batches[i] = append(batches[i], e)
+			continue
+		}
+
+		if len(batches) >= maxSources {
+			overflow[sourceID] = true
+			rest = append(rest, e)
+			continue
+		}
+
+		index[sourceID] = len(batches)
+		batches = append(batches, []*loggregator_v2.Envelope{e})
+	}
+
+	if len(rest) > 0 {
+		batches = append(batches, rest)
+	}
+
+	return batches, len(index) + len(overflow)
+}
+
+// maxPoisonAttempts is the number of times an envelope is written on its
+// own before it is dropped as poison.
+const maxPoisonAttempts = 3
+
+// writeIndividually writes each of the given envelopes on its own to isolate
+// the envelopes that made the write of the whole batch fail. An envelope
+// that is rejected maxPoisonAttempts times is dropped and counted by
+// nozzle_poison. If a write fails for another reason, the rest of the batch
+// is spilled instead.
+func (n *Nozzle) writeIndividually(client logcache_v1.IngressClient, addr string, batch []*loggregator_v2.Envelope, m writerMetrics) {
+	for i, e := range batch {
+		var err error
+		for attempt := 0; attempt < maxPoisonAttempts; attempt++ {
+			m.individualRetryInc(1)
+			if err = n.send(client, []*loggregator_v2.Envelope{e}); err == nil {
+				break
+			}
+
+			m.errInc(1)
+			if !rejected(err) {
+				break
+			}
+		}
+
+		if err != nil && !rejected(err) {
+			n.log.Printf("failed to write %d envelopes individually to %s: %s", len(batch)-i, addr, err)
+			n.spill(batch[i:], m)
+			return
+		}
 
 		if err != nil {
-			errInc(1)
+			n.log.Printf("dropping envelope of %s after %d failed writes to %s: %s", e.GetSourceId(), maxPoisonAttempts, addr, err)
+			m.poisonInc(1)
 			continue
 		}
 
-		egressInc(uint64(len(envelopes)))
+		n.render([]*loggregator_v2.Envelope{e})
+		m.egressInc(1)
+		m.targetEgressInc(1, addr)
 	}
 }
 
-func (n *Nozzle) envelopeReader(rx loggregator.EnvelopeStream, ingressInc func(uint64)) {
+// spill writes the given envelopes to the disk buffer, if there is one.
+func (n *Nozzle) spill(batch []*loggregator_v2.Envelope, m writerMetrics) {
+	if n.diskBuffer == nil {
+		return
+	}
+
+	dropped, err := n.diskBuffer.push(batch)
+	if err != nil {
+		n.log.Printf("failed to spill %d envelopes to disk: %s", len(batch), err)
+		return
+	}
+
+	m.diskSpilledInc(uint64(len(batch)))
+	if dropped > 0 {
+		n.log.Printf("disk buffer is full, dropped %d envelopes", dropped)
+		m.diskDroppedInc(uint64(dropped))
+	}
+}
+
+// replayDiskBuffer writes the envelopes of the disk buffer to LogCache
+// until the Nozzle is stopped, and closes the disk buffer once the writers
+// are done spilling to it.
+func (n *Nozzle) replayDiskBuffer(clients map[string]logcache_v1.IngressClient, m writerMetrics) {
+	t := time.NewTicker(BATCH_FLUSH_INTERVAL)
+	defer t.Stop()
+
+	// done holds the LogCaches that took their envelopes of the record at
+	// doneHead, so that retrying the record only writes to the others.
+	// After a restart, the record is written to every LogCache again.
+	var (
+		done     map[string]bool
+		doneHead uint64
+	)
+
 	for {
+		select {
+		case <-t.C:
+		case <-n.stopped:
+			<-n.writersDone
+			if err := n.diskBuffer.close(); err != nil {
+				n.log.Printf("failed to close disk buffer: %s", err)
+			}
+			return
+		}
+
+		for {
+			batch, head, err := n.diskBuffer.peek()
+			if done == nil || head != doneHead {
+				done, doneHead = make(map[string]bool), head
+			}
+
+			if err != nil {
+				n.log.Printf("dropping unreadable disk buffer record: %s", err)
+			} else if batch == nil || !n.replay(batch, done, clients, m) {
+				break
+			}
+
+			if err := n.diskBuffer.pop(head); err != nil {
+				n.log.Printf("failed to remove disk buffer record: %s", err)
+				break
+			}
+		}
+	}
+}
+
+// replay writes the given envelopes from the disk buffer to their
+// LogCaches, except for the ones in done. It adds each LogCache that took
+// or rejected its envelopes to done, and returns false if a LogCache is
+// still unavailable.
+func (n *Nozzle) replay(batch []*loggregator_v2.Envelope, done map[string]bool, clients map[string]logcache_v1.IngressClient, m writerMetrics) bool {
+	for addr, b := range n.route(batch, func(uint64) {}) {
+		if done[addr] {
+			continue
+		}
+
+		if err := n.send(clients[addr], b); err != nil {
+			if !rejected(err) {
+				return false
+			}
+
+			n.log.Printf("dropping %d envelopes of the disk buffer rejected by %s: %s", len(b), addr, err)
+			m.poisonInc(uint64(len(b)))
+			done[addr] = true
+			continue
+		}
+		done[addr] = true
+
+		n.render(b)
+		m.egressInc(uint64(len(b)))
+		m.targetEgressInc(uint64(len(b)), addr)
+	}
+
+	return true
+}
+
+// send writes the given envelopes to a LogCache. The write is abandoned
+// after the write timeout.
+func (n *Nozzle) send(client logcache_v1.IngressClient, batch []*loggregator_v2.Envelope) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.writeTimeout)
+	defer cancel()
+
+	_, err := client.Send(ctx, &logcache_v1.SendRequest{
+		Envelopes: &loggregator_v2.EnvelopeBatch{
+			Batch: batch,
+		},
+	})
+	n.setLastError(err)
+
+	return err
+}
+
+// LastError returns the error of the last write to LogCache along with
+// when it failed. It returns nil once a write succeeds again. It is safe
+// to call while the Nozzle is running, e.g., from a health check.
+func (n *Nozzle) LastError() (error, time.Time) {
+	n.lastErrMu.Lock()
+	defer n.lastErrMu.Unlock()
+
+	return n.lastErr, n.lastErrAt
+}
+
+func (n *Nozzle) setLastError(err error) {
+	n.lastErrMu.Lock()
+	defer n.lastErrMu.Unlock()
+
+	if err == nil {
+		n.lastErr, n.lastErrAt = nil, time.Time{}
+		return
+	}
+
+	n.lastErr, n.lastErrAt = err, n.now()
+}
+
+// rejected reports whether the given write error is caused by the
+// envelopes rather than by LogCache (e.g., it is unavailable or denies the
+// Nozzle). Writing the envelopes of a batch individually is only worth it
+// in the former case.
+func rejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return true
+	default:
+		return false
+	}
+}
+
+// targets returns the address of every LogCache the Nozzle writes to.
+func (n *Nozzle) targets() []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{n.addr}, n.ruleAddrs()...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		targets = append(targets, addr)
+	}
+
+	return targets
+}
+
+func (n *Nozzle) ruleAddrs() []string {
+	addrs := make([]string, 0, len(n.routingRules)+len(n.tagRoutes))
+	for _, r := range n.routingRules {
+		addrs = append(addrs, r.Addr)
+	}
+
+	tagAddrs := make([]string, 0, len(n.tagRoutes))
+	for _, addr := range n.tagRoutes {
+		tagAddrs = append(tagAddrs, addr)
+	}
+	sort.Strings(tagAddrs)
+
+	return append(addrs, tagAddrs...)
+}
+
+// route groups the given envelopes by the address of the LogCache they are
+// written to. Envelopes without a LogCache are dropped.
+func (n *Nozzle) route(envelopes []*loggregator_v2.Envelope, unroutedInc func(uint64)) map[string][]*loggregator_v2.Envelope {
+	if !n.routing() {
+		return map[string][]*loggregator_v2.Envelope{n.addr: envelopes}
+	}
+
+	batches := make(map[string][]*loggregator_v2.Envelope)
+	for _, e := range envelopes {
+		addr := n.routeEnvelope(e)
+		if addr == "" {
+			unroutedInc(1)
+			continue
+		}
+
+		batches[addr] = append(batches[addr], e)
+	}
+
+	return batches
+}
+
+// routing reports whether any routing is configured.
+func (n *Nozzle) routing() bool {
+	return len(n.routingRules) > 0 || len(n.tagRoutes) > 0
+}
+
+// routeEnvelope returns the address of the LogCache to write the given
+// envelope to. It is empty if the envelope is unrouted.
+func (n *Nozzle) routeEnvelope(e *loggregator_v2.Envelope) string {
+	if value, ok := e.GetTags()[n.tagKey]; ok && n.tagKey != "" {
+		if addr, ok := n.tagRoutes[value]; ok {
+			return addr
+		}
+	}
+
+	for _, r := range n.routingRules {
+		if ok, _ := path.Match(r.SourceIDPattern, e.GetSourceId()); ok {
+			return r.Addr
+		}
+	}
+
+	return n.addr
+}
+
+// readerMetrics are the metrics of the envelopeReader.
+type readerMetrics struct {
+	ingressInc       func(uint64)
+	sampledOutInc    func(uint64)
+	rateLimitedInc   func(uint64)
+	truncatedInc     func(uint64)
+	tooOldInc        func(uint64)
+	invalidSourceInc func(uint64)
+	outOfOrderInc    func(uint64)
+	readBatchSize    func(float64)
+}
+
+// readBatchSizeBuckets are the buckets of the nozzle_read_batch_size
+// histogram. The logs provider sends batches of up to 100 envelopes by
+// default.
+var readBatchSizeBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+func (n *Nozzle) envelopeReader(rx loggregator.EnvelopeStream, m readerMetrics) {
+	defer close(n.readerDone)
+
+	for n.ctx.Err() == nil {
 		envelopeBatch := rx()
+
+		// An empty batch is only returned once the stream is cancelled.
+		if len(envelopeBatch) > 0 {
+			m.readBatchSize(float64(len(envelopeBatch)))
+		}
+
 		for _, envelope := range envelopeBatch {
-			n.streamBuffer.Set(diodes.GenericDataType(envelope))
-			ingressInc(1)
+			m.ingressInc(1)
+
+			if gauge := n.timerGauge(envelope); gauge != nil {
+				n.buffer(gauge, m)
+
+				if n.dropConvertedTimers {
+					continue
+				}
+			}
+
+			if n.counterRated(envelope) {
+				if gauge := n.counterRateGauge(envelope); gauge != nil {
+					n.buffer(gauge, m)
+				}
+
+				if n.dropConvertedCounters {
+					continue
+				}
+			}
+
+			n.buffer(envelope, m)
 		}
 	}
 }
 
+// buffer sets the given envelope on the stream buffer unless its source ID
+// is invalid, or it is too old, out of order, sampled out or rate limited.
+func (n *Nozzle) buffer(e *loggregator_v2.Envelope, m readerMetrics) {
+	if n.validSourceID != nil && !n.validSourceID(e.GetSourceId()) {
+		m.invalidSourceInc(1)
+		return
+	}
+
+	if n.maxEnvelopeAge > 0 && e.GetTimestamp() < n.now().Add(-n.maxEnvelopeAge).UnixNano() {
+		m.tooOldInc(1)
+		return
+	}
+
+	if n.highWaterMarks != nil {
+		if newest, outOfOrder := n.highWaterMarks.observe(e.GetSourceId(), e.GetTimestamp()); outOfOrder {
+			m.outOfOrderInc(1)
+			if !n.clampOutOfOrder {
+				return
+			}
+			e.Timestamp = newest
+		}
+	}
+
+	if !n.sampled(e) {
+		m.sampledOutInc(1)
+		return
+	}
+
+	if n.rateLimiter != nil && !n.rateLimiter.allow(e.GetSourceId()) {
+		m.rateLimitedInc(1)
+		return
+	}
+
+	if n.truncate(e) {
+		m.truncatedInc(1)
+	}
+
+	n.tagNode(e)
+
+	atomic.AddInt64(&n.pending, 1)
+	n.streamBuffer.Set(diodes.GenericDataType(&bufferedEnvelope{
+		envelope: e,
+		enqueued: time.Now(),
+	}))
+}
+
+// truncate truncates the payload of the given log envelope to the
+// maxPayloadBytes. It reports whether the payload was truncated.
+func (n *Nozzle) truncate(e *loggregator_v2.Envelope) bool {
+	l := e.GetLog()
+	if n.maxPayloadBytes <= 0 || l == nil || len(l.Payload) <= n.maxPayloadBytes {
+		return false
+	}
+
+	if n.maxPayloadBytes <= len(TruncationMarker) {
+		l.Payload = l.Payload[:n.maxPayloadBytes]
+		return true
+	}
+
+	keep := n.maxPayloadBytes - len(TruncationMarker)
+	payload := make([]byte, 0, n.maxPayloadBytes)
+	payload = append(payload, l.Payload[:keep]...)
+	l.Payload = append(payload, TruncationMarker...)
+
+	return true
+}
+
+// tagNode tags the given envelope with the node index, unless it is
+// already tagged.
+func (n *Nozzle) tagNode(e *loggregator_v2.Envelope) {
+	if n.nodeIndex < 0 {
+		return
+	}
+
+	if _, ok := e.GetTags()[NodeTag]; ok {
+		return
+	}
+
+	if e.Tags == nil {
+		e.Tags = make(map[string]string)
+	}
+	e.Tags[NodeTag] = strconv.Itoa(n.nodeIndex)
+}
+
+// timerGauge returns the gauge envelope for the given timer envelope. It
+// returns nil for any other envelope or if timers are not converted.
+func (n *Nozzle) timerGauge(e *loggregator_v2.Envelope) *loggregator_v2.Envelope {
+	timer := e.GetTimer()
+	if n.timerGaugeName == "" || timer == nil {
+		return nil
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp:  e.GetTimestamp(),
+		SourceId:   e.GetSourceId(),
+		InstanceId: e.GetInstanceId(),
+		Tags:       e.GetTags(),
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					n.timerGaugeName: {
+						Unit:  "nanoseconds",
+						Value: float64(timer.GetStop() - timer.GetStart()),
+					},
+				},
+			},
+		},
+	}
+}
+
+// counterRated reports whether the given envelope is a counter converted
+// via WithCounterRate.
+func (n *Nozzle) counterRated(e *loggregator_v2.Envelope) bool {
+	return n.counterRateName != "" && e.GetCounter().GetName() == n.counterRateName
+}
+
+// counterRateGauge returns the rate gauge envelope for the given counter
+// envelope. It returns nil if there is no rate yet.
+func (n *Nozzle) counterRateGauge(e *loggregator_v2.Envelope) *loggregator_v2.Envelope {
+	rate, ok := n.counterRater.rate(e.GetSourceId(), e.GetInstanceId(), e.GetCounter().GetTotal(), e.GetTimestamp())
+	if !ok {
+		return nil
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp:  e.GetTimestamp(),
+		SourceId:   e.GetSourceId(),
+		InstanceId: e.GetInstanceId(),
+		Tags:       e.GetTags(),
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					n.counterRateName + "_rate": {
+						Unit:  "per_second",
+						Value: rate,
+					},
+				},
+			},
+		},
+	}
+}
+
+// sampled reports whether the given envelope is to be written according to
+// the sample rate.
+func (n *Nozzle) sampled(e *loggregator_v2.Envelope) bool {
+	if n.sampleRate >= 1 {
+		return true
+	}
+
+	if !n.deterministicSampling {
+		return rand.Float64() < n.sampleRate
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(e.GetSourceId()))
+	binary.Write(h, binary.BigEndian, e.GetTimestamp())
+
+	return float64(h.Sum64()) < n.sampleRate*math.MaxUint64
+}
+
 var selectorTypes = map[string]*loggregator_v2.Selector{
 	"log": {
 		Message: &loggregator_v2.Selector_Log{
@@ -223,6 +1558,55 @@ var selectorTypes = map[string]*loggregator_v2.Selector{
 	},
 }
 
+// selectorProbeTimeout is how long the startup probe for the supported
+// selectors may take.
+const selectorProbeTimeout = 5 * time.Second
+
+// SupportedSelectors returns the selector types the logs provider was
+// discovered to support at startup.
+func (n *Nozzle) SupportedSelectors() []string {
+	return append([]string(nil), n.supported...)
+}
+
+// checkSelectors discovers the supported selectors and returns an error
+// naming every configured selector that is unknown or unsupported.
+func (n *Nozzle) checkSelectors() error {
+	n.supported = make([]string, 0, len(selectorTypes))
+	for t := range selectorTypes {
+		n.supported = append(n.supported, t)
+	}
+
+	if n.prober != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), selectorProbeTimeout)
+		defer cancel()
+
+		supported, err := n.prober.SupportedSelectors(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to probe supported selectors: %s", err)
+		}
+		n.supported = supported
+	}
+	sort.Strings(n.supported)
+
+	isSupported := make(map[string]bool, len(n.supported))
+	for _, t := range n.supported {
+		isSupported[t] = true
+	}
+
+	var unsupported []string
+	for _, t := range n.selectors {
+		if _, ok := selectorTypes[t]; !ok || !isSupported[t] {
+			unsupported = append(unsupported, t)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("unsupported selectors: %s", strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
 func (n *Nozzle) buildBatchReq() *loggregator_v2.EgressBatchRequest {
 	var selectors []*loggregator_v2.Selector
 
@@ -1,18 +1,30 @@
 package nozzle_test
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/go-loggregator"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	. "code.cloudfoundry.org/log-cache/internal/nozzle"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	"code.cloudfoundry.org/log-cache/internal/testing"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var _ = Describe("Nozzle", func() {
@@ -71,6 +83,1206 @@ var _ = Describe("Nozzle", func() {
 		})
 	})
 
+	Context("With dry run enabled", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithDryRun(),
+			)
+			go n.Start()
+		})
+
+		It("processes envelopes without writing them to the LogCache", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+			addEnvelope(2, "some-source-id", streamConnector)
+
+			Eventually(spyMetrics.Getter("nozzle_egress")).Should(Equal(2.0))
+			Expect(spyMetrics.Get("nozzle_ingress")).To(Equal(2.0))
+			Expect(spyMetrics.Get("nozzle_dry_run")).To(Equal(1.0))
+			Consistently(logCache.GetEnvelopes).Should(BeEmpty())
+		})
+	})
+
+	Context("With an envelope sink", func() {
+		var sink *gbytes.Buffer
+
+		BeforeEach(func() {
+			streamConnector = newSpyStreamConnector()
+			sink = gbytes.NewBuffer()
+
+			n = NewNozzle(streamConnector, "localhost:1", "log-cache",
+				WithDryRun(),
+				WithEnvelopeSink(sink),
+			)
+			go n.Start()
+		})
+
+		It("renders each envelope as a line", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+			addEnvelope(2, "some-source-id", streamConnector)
+
+			rendered := func() string { return string(sink.Contents()) }
+			Eventually(rendered).Should(And(
+				ContainSubstring(`timestamp:1 source_id:"some-source-id"`),
+				ContainSubstring(`timestamp:2 source_id:"some-source-id"`),
+			))
+			Expect(strings.Count(rendered(), "\n")).To(Equal(2))
+		})
+	})
+
+	Context("With a logger", func() {
+		var logs *gbytes.Buffer
+
+		BeforeEach(func() {
+			streamConnector = newSpyStreamConnector()
+			logs = gbytes.NewBuffer()
+
+			// Nothing listens on the LogCache address so every write fails.
+			n = NewNozzle(streamConnector, "localhost:1", "log-cache",
+				WithLogger(log.New(logs, "", 0)),
+			)
+			go n.Start()
+		})
+
+		It("logs failed writes", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(logs, 5).Should(gbytes.Say("failed to write 1 envelopes to localhost:1"))
+		})
+	})
+
+	Context("With a selector prober", func() {
+		var prober SelectorProberFunc
+
+		BeforeEach(func() {
+			streamConnector = newSpyStreamConnector()
+			prober = func(context.Context) ([]string, error) {
+				return []string{"log", "gauge", "counter"}, nil
+			}
+		})
+
+		It("exposes the supported selectors", func() {
+			n, err := NewNozzleE(streamConnector, "localhost:1", "log-cache",
+				WithSelectorProber(prober),
+				WithSelectors("log", "gauge"),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n.SupportedSelectors()).To(Equal([]string{"counter", "gauge", "log"}))
+		})
+
+		It("returns an error for an unsupported selector", func() {
+			_, err := NewNozzleE(streamConnector, "localhost:1", "log-cache",
+				WithSelectorProber(prober),
+				WithSelectors("log", "timer"),
+			)
+			Expect(err).To(MatchError("unsupported selectors: timer"))
+		})
+
+		It("returns an error when the probe fails", func() {
+			prober = func(context.Context) ([]string, error) {
+				return nil, errors.New("some-error")
+			}
+
+			_, err := NewNozzleE(streamConnector, "localhost:1", "log-cache",
+				WithSelectorProber(prober),
+			)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("warns about an unsupported selector", func() {
+			logs := gbytes.NewBuffer()
+			NewNozzle(streamConnector, "localhost:1", "log-cache",
+				WithLogger(log.New(logs, "", 0)),
+				WithSelectorProber(prober),
+				WithSelectors("timer"),
+			)
+
+			Expect(logs).To(gbytes.Say("warning: unsupported selectors: timer"))
+		})
+
+		It("probes the selectors of the envelopes the logs provider streams", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{SourceId: "some-source-id", Message: &loggregator_v2.Envelope_Log{Log: &loggregator_v2.Log{}}},
+				{SourceId: "some-source-id", Message: &loggregator_v2.Envelope_Gauge{Gauge: &loggregator_v2.Gauge{}}},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			supported, err := NewStreamSelectorProber(streamConnector, "some-probe-shard").SupportedSelectors(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(supported).To(ConsistOf("log", "gauge"))
+
+			Expect(streamConnector.requests()).To(HaveLen(1))
+			Expect(streamConnector.requests()[0].ShardId).To(Equal("some-probe-shard"))
+			Expect(streamConnector.requests()[0].Selectors).To(HaveLen(5))
+		})
+
+		It("fails to probe if the logs provider streams no envelopes", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := NewStreamSelectorProber(streamConnector, "some-probe-shard").SupportedSelectors(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("assumes every known selector is supported without a prober", func() {
+			n, err := NewNozzleE(streamConnector, "localhost:1", "log-cache",
+				WithSelectors("timer"),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n.SupportedSelectors()).To(ConsistOf("log", "gauge", "counter", "timer", "event"))
+		})
+	})
+
+	Context("With a metric prefix", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithMetricPrefix("app_nozzle"),
+			)
+			go n.Start()
+		})
+
+		It("prefixes the name of each metric", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(spyMetrics.Getter("app_nozzle_egress")).Should(Equal(1.0))
+			Expect(spyMetrics.Get("app_nozzle_ingress")).To(Equal(1.0))
+			Expect(spyMetrics.Get("nozzle_ingress")).To(Equal(testing.UNDEFINED_METRIC))
+		})
+	})
+
+	Context("With deterministic sampling", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithSampleRate(0.5),
+				WithDeterministicSampling(),
+			)
+			go n.Start()
+		})
+
+		It("only writes a fraction of the envelopes", func() {
+			for i := int64(0); i < 100; i++ {
+				addEnvelope(i, "some-source-id", streamConnector)
+			}
+
+			Eventually(spyMetrics.Getter("nozzle_ingress")).Should(Equal(100.0))
+			sampledOut := spyMetrics.Get("nozzle_sampled_out")
+			Expect(sampledOut).To(And(BeNumerically(">", 0), BeNumerically("<", 100)))
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(100 - int(sampledOut)))
+		})
+	})
+
+	Context("With timers converted to gauges", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithTimerToGauge("http_duration"),
+			)
+			go n.Start()
+		})
+
+		It("writes a gauge with the duration of each timer", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{
+					Timestamp: 1,
+					SourceId:  "some-source-id",
+					Tags:      map[string]string{"a": "b"},
+					Message: &loggregator_v2.Envelope_Timer{
+						Timer: &loggregator_v2.Timer{Name: "http", Start: 100, Stop: 350},
+					},
+				},
+			}
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+
+			gauge := logCache.GetEnvelopes()[0]
+			Expect(gauge.SourceId).To(Equal("some-source-id"))
+			Expect(gauge.Tags).To(Equal(map[string]string{"a": "b"}))
+			Expect(gauge.GetGauge().GetMetrics()).To(HaveKeyWithValue("http_duration",
+				&loggregator_v2.GaugeValue{Unit: "nanoseconds", Value: 250},
+			))
+			Expect(logCache.GetEnvelopes()[1].GetTimer()).ToNot(BeNil())
+		})
+	})
+
+	Context("With a node index", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithNodeIndex(2),
+			)
+			go n.Start()
+		})
+
+		It("tags the envelopes and counts per node", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "some-source-id"},
+				{Timestamp: 2, SourceId: "some-source-id", Tags: map[string]string{"nozzle_node": "7"}},
+			}
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+			Expect(logCache.GetEnvelopes()[0].Tags).To(HaveKeyWithValue("nozzle_node", "2"))
+			Expect(logCache.GetEnvelopes()[1].Tags).To(HaveKeyWithValue("nozzle_node", "7"))
+
+			Eventually(func() float64 {
+				return spyMetrics.Get("nozzle_egress-node2")
+			}).Should(Equal(2.0))
+			Expect(spyMetrics.Get("nozzle_egress")).To(Equal(testing.UNDEFINED_METRIC))
+		})
+	})
+
+	Context("With counters converted to rates", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithCounterRate("requests", 10*time.Second),
+				WithDropConvertedCounters(),
+			)
+			go n.Start()
+		})
+
+		It("writes a gauge with the rate of the counter per window", func() {
+			counter := func(timestamp time.Duration, total uint64) *loggregator_v2.Envelope {
+				return &loggregator_v2.Envelope{
+					Timestamp: int64(timestamp),
+					SourceId:  "some-source-id",
+					Message: &loggregator_v2.Envelope_Counter{
+						Counter: &loggregator_v2.Counter{Name: "requests", Total: total},
+					},
+				}
+			}
+
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				counter(0, 100),
+				counter(5*time.Second, 150),
+				counter(10*time.Second, 300),
+				counter(20*time.Second, 50),
+				{
+					Timestamp: 1,
+					SourceId:  "some-source-id",
+					Message: &loggregator_v2.Envelope_Counter{
+						Counter: &loggregator_v2.Counter{Name: "other", Total: 1},
+					},
+				},
+			}
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(3))
+			Consistently(logCache.GetEnvelopes).Should(HaveLen(3))
+
+			envelopes := logCache.GetEnvelopes()
+			Expect(envelopes[0].GetGauge().GetMetrics()).To(HaveKeyWithValue("requests_rate",
+				&loggregator_v2.GaugeValue{Unit: "per_second", Value: 20},
+			))
+			Expect(envelopes[1].GetGauge().GetMetrics()).To(HaveKeyWithValue("requests_rate",
+				&loggregator_v2.GaugeValue{Unit: "per_second", Value: 0},
+			))
+			Expect(envelopes[2].GetCounter().GetName()).To(Equal("other"))
+		})
+	})
+
+	Context("With a per source rate limit", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithPerSourceRateLimit(0.001, 2),
+			)
+			go n.Start()
+		})
+
+		It("drops the envelopes of a source beyond its rate", func() {
+			for i := 0; i < 5; i++ {
+				addEnvelope(int64(i), "noisy-source-id", streamConnector)
+			}
+			addEnvelope(5, "quiet-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(3))
+			Eventually(func() float64 {
+				return spyMetrics.Get("nozzle_rate_limited")
+			}).Should(Equal(3.0))
+		})
+	})
+
+	Context("With a max payload size", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithMaxPayloadBytes(20),
+			)
+			go n.Start()
+		})
+
+		It("truncates the payload of large log envelopes", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{
+					Timestamp: 1,
+					SourceId:  "some-source-id",
+					Message: &loggregator_v2.Envelope_Log{
+						Log: &loggregator_v2.Log{Payload: []byte("a very long log line indeed")},
+					},
+				},
+				{
+					Timestamp: 2,
+					SourceId:  "some-source-id",
+					Message: &loggregator_v2.Envelope_Log{
+						Log: &loggregator_v2.Log{Payload: []byte("short")},
+					},
+				},
+			}
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+			Expect(string(logCache.GetEnvelopes()[0].GetLog().GetPayload())).To(Equal("a very" + TruncationMarker))
+			Expect(string(logCache.GetEnvelopes()[1].GetLog().GetPayload())).To(Equal("short"))
+			Expect(spyMetrics.Get("nozzle_truncated")).To(Equal(1.0))
+		})
+	})
+
+	Context("With a poison envelope", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			logCache.SendError = func(batch []*loggregator_v2.Envelope) error {
+				for _, e := range batch {
+					if e.GetSourceId() == "poison-source-id" {
+						return status.Error(codes.InvalidArgument, "invalid envelope")
+					}
+				}
+				return nil
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+			)
+			go n.Start()
+		})
+
+		It("writes the other envelopes of the batch and drops the poison", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "some-source-id"},
+				{Timestamp: 2, SourceId: "poison-source-id"},
+				{Timestamp: 3, SourceId: "some-source-id"},
+			}
+
+			Eventually(func() float64 {
+				return spyMetrics.Get("nozzle_poison")
+			}).Should(Equal(1.0))
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+			Expect(spyMetrics.Get("nozzle_individual_retries")).To(BeNumerically(">=", 3))
+			Expect(spyMetrics.Get("nozzle_egress")).To(Equal(2.0))
+
+			// The failed batch and each failed write of the poison.
+			Expect(spyMetrics.Get("nozzle_err")).To(Equal(4.0))
+		})
+	})
+
+	Context("With LogCache becoming unavailable while isolating a poison envelope", func() {
+		var dir string
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			dir, err = ioutil.TempDir("", "nozzle-disk-buffer")
+			Expect(err).ToNot(HaveOccurred())
+
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			// The batch is rejected, then LogCache becomes unavailable.
+			var writes int32
+			logCache.SendError = func([]*loggregator_v2.Envelope) error {
+				if atomic.AddInt32(&writes, 1) == 1 {
+					return status.Error(codes.InvalidArgument, "invalid envelope")
+				}
+				return status.Error(codes.Unavailable, "unavailable")
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithDiskBuffer(dir, 1<<20),
+			)
+			go n.Start()
+		})
+
+		AfterEach(func() {
+			n.Stop()
+			os.RemoveAll(dir)
+		})
+
+		It("spills the rest of the batch rather than dropping it as poison", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "some-source-id"},
+				{Timestamp: 2, SourceId: "some-source-id"},
+				{Timestamp: 3, SourceId: "some-source-id"},
+			}
+
+			Eventually(spyMetrics.Getter("nozzle_disk_buffer_spilled")).Should(Equal(3.0))
+			Expect(spyMetrics.Get("nozzle_individual_retries")).To(Equal(1.0))
+			Expect(spyMetrics.Get("nozzle_poison")).To(Equal(0.0))
+		})
+	})
+
+	Context("With a write timeout", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+
+			// The first write blocks for much longer than the write timeout.
+			var once sync.Once
+			logCache.SendError = func([]*loggregator_v2.Envelope) error {
+				once.Do(func() { time.Sleep(time.Second) })
+				return nil
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithWriteTimeout(100*time.Millisecond),
+			)
+			go n.Start()
+		})
+
+		It("abandons a blocking write and recovers", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(func() float64 {
+				return spyMetrics.Get("nozzle_err")
+			}).Should(Equal(1.0))
+
+			addEnvelope(2, "some-source-id", streamConnector)
+
+			Eventually(func() float64 {
+				return spyMetrics.Get("nozzle_egress")
+			}, 3).Should(Equal(1.0))
+		})
+
+		It("exposes the last error until a write succeeds", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(func() error {
+				err, _ := n.LastError()
+				return err
+			}).Should(HaveOccurred())
+
+			_, failedAt := n.LastError()
+			Expect(failedAt).To(BeTemporally("~", time.Now(), time.Second))
+
+			addEnvelope(2, "some-source-id", streamConnector)
+
+			Eventually(func() error {
+				err, _ := n.LastError()
+				return err
+			}, 3).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("With a success ratio window", func() {
+		var failing int32
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+
+			atomic.StoreInt32(&failing, 0)
+			logCache.SendError = func([]*loggregator_v2.Envelope) error {
+				if atomic.LoadInt32(&failing) == 1 {
+					return errors.New("unavailable")
+				}
+				return nil
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSuccessRatioWindow(2*time.Second),
+			)
+			go n.Start()
+		})
+
+		It("publishes the ratio of successful writes within the window", func() {
+			ratio := spyMetrics.Getter("nozzle_write_success_ratio")
+
+			// Without any traffic, the ratio is 1.
+			Eventually(ratio).Should(Equal(1.0))
+			Expect(spyMetrics.GetUnit("nozzle_write_success_ratio")).To(Equal("ratio"))
+
+			atomic.StoreInt32(&failing, 1)
+			addEnvelope(1, "some-source-id", streamConnector)
+			Eventually(ratio).Should(Equal(0.0))
+
+			// A write of several envelopes counts once, like a failed one.
+			atomic.StoreInt32(&failing, 0)
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 2, SourceId: "some-source-id"},
+				{Timestamp: 3, SourceId: "some-source-id"},
+			}
+			Eventually(ratio).Should(Equal(0.5))
+
+			// The ratio recovers once the writes slid out of the window.
+			Eventually(ratio, 3).Should(Equal(1.0))
+		})
+	})
+
+	Context("With a heartbeat", func() {
+		BeforeEach(func() {
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+
+			n = NewNozzle(streamConnector, "localhost:1", "log-cache",
+				WithMetrics(spyMetrics),
+				WithHeartbeat(10*time.Millisecond),
+			)
+			go n.Start()
+		})
+
+		It("increments the heartbeat without traffic until stopped", func() {
+			heartbeat := spyMetrics.Getter("nozzle_heartbeat")
+			Eventually(heartbeat).ShouldNot(Equal(testing.UNDEFINED_METRIC))
+			Eventually(heartbeat).Should(BeNumerically(">=", 2))
+
+			n.Stop()
+			// A tick that raced with Stop may still be counted.
+			time.Sleep(20 * time.Millisecond)
+			stopped := heartbeat()
+			Consistently(heartbeat, 100*time.Millisecond).Should(Equal(stopped))
+		})
+	})
+
+	Context("Grouped by source", func() {
+		var (
+			mu      sync.Mutex
+			batches [][]string
+		)
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+
+			batches = nil
+			logCache.SendError = func(batch []*loggregator_v2.Envelope) error {
+				var sourceIDs []string
+				for _, e := range batch {
+					sourceIDs = append(sourceIDs, e.GetSourceId())
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				batches = append(batches, sourceIDs)
+				return nil
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithGroupBySource(),
+			)
+			go n.Start()
+		})
+
+		It("writes one batch per source", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "source-a"},
+				{Timestamp: 2, SourceId: "source-b"},
+				{Timestamp: 3, SourceId: "source-a"},
+			}
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(3))
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(batches).To(ConsistOf(
+				[]string{"source-a", "source-a"},
+				[]string{"source-b"},
+			))
+			Expect(spyMetrics.Get("nozzle_sources_per_flush")).To(Equal(2.0))
+			Expect(spyMetrics.GetUnit("nozzle_sources_per_flush")).To(Equal("entries"))
+		})
+
+		It("caps the number of batches per flush", func() {
+			var envelopes []*loggregator_v2.Envelope
+			for i := 0; i < MAX_SOURCES_PER_FLUSH+10; i++ {
+				envelopes = append(envelopes, &loggregator_v2.Envelope{
+					Timestamp: int64(i),
+					SourceId:  fmt.Sprintf("source-%d", i),
+				})
+			}
+			streamConnector.envelopes <- envelopes
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(MAX_SOURCES_PER_FLUSH + 10))
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(batches).To(HaveLen(MAX_SOURCES_PER_FLUSH + 1))
+			Expect(spyMetrics.Get("nozzle_sources_per_flush")).To(BeEquivalentTo(MAX_SOURCES_PER_FLUSH + 10))
+		})
+	})
+
+	Context("With a blocking LogCache", func() {
+		var unblock chan struct{}
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+
+			unblock = make(chan struct{})
+			logCache.SendError = func([]*loggregator_v2.Envelope) error {
+				<-unblock
+				return nil
+			}
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+			)
+			go n.Start()
+		})
+
+		It("reports the age of the oldest unwritten envelope", func() {
+			age := spyMetrics.Getter("nozzle_buffer_oldest_age_seconds")
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(age).Should(And(
+				BeNumerically(">", 0),
+				BeNumerically("<", testing.UNDEFINED_METRIC),
+			))
+			Expect(spyMetrics.GetUnit("nozzle_buffer_oldest_age_seconds")).To(Equal("seconds"))
+
+			// The age keeps rising while the write is blocked.
+			blocked := age()
+			Eventually(age).Should(BeNumerically(">", blocked))
+
+			close(unblock)
+			Eventually(age).Should(BeZero())
+		})
+	})
+
+	Context("With a disk buffer", func() {
+		var (
+			tlsConfig   *tls.Config
+			dir         string
+			addr        string
+			unavailable int32
+		)
+
+		newNozzle := func() *Nozzle {
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+
+			return NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithDiskBuffer(dir, 1<<20),
+			)
+		}
+
+		BeforeEach(func() {
+			var err error
+			tlsConfig, err = testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			dir, err = ioutil.TempDir("", "nozzle-disk-buffer")
+			Expect(err).ToNot(HaveOccurred())
+
+			atomic.StoreInt32(&unavailable, 1)
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			logCache.SendError = func([]*loggregator_v2.Envelope) error {
+				if atomic.LoadInt32(&unavailable) == 1 {
+					return status.Error(codes.Unavailable, "unavailable")
+				}
+				return nil
+			}
+			addr = logCache.Start()
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("writes the spilled envelopes once LogCache recovers", func() {
+			n = newNozzle()
+			go n.Start()
+			defer n.Stop()
+
+			addEnvelope(1, "some-source-id", streamConnector)
+			Eventually(spyMetrics.Getter("nozzle_disk_buffer_spilled")).Should(Equal(1.0))
+			Expect(logCache.GetEnvelopes()).To(BeEmpty())
+
+			atomic.StoreInt32(&unavailable, 0)
+			Eventually(logCache.GetEnvelopes, 3).Should(HaveLen(1))
+			Expect(spyMetrics.Get("nozzle_egress")).To(Equal(1.0))
+		})
+
+		It("writes the spilled envelopes after a restart", func() {
+			n = newNozzle()
+			go n.Start()
+
+			addEnvelope(1, "some-source-id", streamConnector)
+			Eventually(spyMetrics.Getter("nozzle_disk_buffer_spilled")).Should(Equal(1.0))
+			n.Stop()
+
+			atomic.StoreInt32(&unavailable, 0)
+			n = newNozzle()
+			go n.Start()
+			defer n.Stop()
+
+			Eventually(logCache.GetEnvelopes, 3).Should(HaveLen(1))
+			Expect(logCache.GetEnvelopes()[0].GetSourceId()).To(Equal("some-source-id"))
+		})
+	})
+
+	Context("With a max envelope age", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithMaxEnvelopeAge(time.Minute),
+				WithClock(func() time.Time {
+					return time.Unix(0, 0).Add(time.Hour)
+				}),
+			)
+			go n.Start()
+		})
+
+		It("drops envelopes older than the max age", func() {
+			addEnvelope(int64(30*time.Minute), "some-source-id", streamConnector)
+			addEnvelope(int64(59*time.Minute+30*time.Second), "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+			Expect(logCache.GetEnvelopes()[0].Timestamp).To(Equal(int64(59*time.Minute + 30*time.Second)))
+			Expect(spyMetrics.Get("nozzle_too_old")).To(Equal(1.0))
+		})
+	})
+
+	Context("With a source ID validator", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSourceIDValidator(ValidSourceID),
+			)
+			go n.Start()
+		})
+
+		It("drops envelopes with an invalid source ID", func() {
+			addEnvelope(1, "", streamConnector)
+			addEnvelope(2, strings.Repeat("a", MAX_SOURCE_ID_LENGTH+1), streamConnector)
+			addEnvelope(3, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+			Expect(logCache.GetEnvelopes()[0].SourceId).To(Equal("some-source-id"))
+			Expect(spyMetrics.Get("nozzle_invalid_source")).To(Equal(2.0))
+		})
+	})
+
+	Context("With monotonic timestamps", func() {
+		var (
+			addr      string
+			tlsConfig *tls.Config
+		)
+
+		BeforeEach(func() {
+			var err error
+			tlsConfig, err = testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr = logCache.Start()
+		})
+
+		start := func(opts ...NozzleOption) {
+			n = NewNozzle(streamConnector, addr, "log-cache", append([]NozzleOption{
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithMonotonicTimestamps(),
+			}, opts...)...)
+			go n.Start()
+		}
+
+		It("drops envelopes older than the newest of their source", func() {
+			start()
+
+			addEnvelope(2, "some-source-id", streamConnector)
+			addEnvelope(1, "some-source-id", streamConnector)
+			addEnvelope(1, "other-source-id", streamConnector)
+			addEnvelope(3, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(3))
+			Expect(spyMetrics.Get("nozzle_out_of_order")).To(Equal(1.0))
+		})
+
+		It("clamps the timestamps of envelopes out of order", func() {
+			start(WithClampOutOfOrder())
+
+			addEnvelope(2, "some-source-id", streamConnector)
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+			for _, e := range logCache.GetEnvelopes() {
+				Expect(e.Timestamp).To(Equal(int64(2)))
+			}
+			Expect(spyMetrics.Get("nozzle_out_of_order")).To(Equal(1.0))
+		})
+	})
+
+	Context("With reloadable TLS", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithReloadableTLS(
+					testing.Cert("log-cache.crt"),
+					testing.Cert("log-cache.key"),
+					testing.Cert("log-cache-ca.crt"),
+				),
+			)
+			go n.Start()
+		})
+
+		It("writes envelopes via mutual TLS", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+		})
+	})
+
+	Context("With source routing", func() {
+		var (
+			tenantLogCache *testing.SpyLogCache
+			tenantAddr     string
+		)
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+			tenantLogCache = testing.NewSpyLogCache(tlsConfig)
+			tenantAddr = tenantLogCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithSourceRouting([]RoutingRule{
+					{SourceIDPattern: "tenant-a-*", Addr: tenantAddr},
+				}),
+			)
+			go n.Start()
+		})
+
+		It("writes the envelopes of each source to its LogCache", func() {
+			addEnvelope(1, "tenant-a-app", streamConnector)
+			addEnvelope(2, "some-source-id", streamConnector)
+			addEnvelope(3, "tenant-a-other-app", streamConnector)
+
+			Eventually(tenantLogCache.GetEnvelopes).Should(HaveLen(2))
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+			Expect(logCache.GetEnvelopes()[0].SourceId).To(Equal("some-source-id"))
+
+			Eventually(spyMetrics.Getter("nozzle_egress")).Should(Equal(3.0))
+			Expect(spyMetrics.Get(testing.LabeledMetricName(
+				"nozzle_egress_per_target",
+				map[string]string{"target": tenantAddr},
+			))).To(Equal(2.0))
+			Expect(spyMetrics.Get("nozzle_unrouted")).To(BeZero())
+		})
+	})
+
+	Context("With source routing and no primary LogCache", func() {
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+
+			n = NewNozzle(streamConnector, "", "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithSelectors("log", "gauge", "counter", "timer", "event"),
+				WithSourceRouting([]RoutingRule{
+					{SourceIDPattern: "tenant-a-*", Addr: addr},
+				}),
+			)
+			go n.Start()
+		})
+
+		It("drops the envelopes of unrouted sources", func() {
+			addEnvelope(1, "tenant-a-app", streamConnector)
+			addEnvelope(2, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+			Eventually(spyMetrics.Getter("nozzle_unrouted")).Should(Equal(1.0))
+		})
+	})
+
+	Context("With tag routing", func() {
+		var (
+			tenantLogCache *testing.SpyLogCache
+			tenantAddr     string
+		)
+
+		BeforeEach(func() {
+			tlsConfig, err := testing.NewTLSConfig(
+				testing.Cert("log-cache-ca.crt"),
+				testing.Cert("log-cache.crt"),
+				testing.Cert("log-cache.key"),
+				"log-cache",
+			)
+			Expect(err).ToNot(HaveOccurred())
+			streamConnector = newSpyStreamConnector()
+			spyMetrics = testing.NewSpyMetrics()
+			logCache = testing.NewSpyLogCache(tlsConfig)
+			addr := logCache.Start()
+			tenantLogCache = testing.NewSpyLogCache(tlsConfig)
+			tenantAddr = tenantLogCache.Start()
+
+			n = NewNozzle(streamConnector, addr, "log-cache",
+				WithMetrics(spyMetrics),
+				WithDialOpts(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+				WithTagRouting("tenant", map[string]string{"a": tenantAddr}),
+			)
+			go n.Start()
+		})
+
+		It("writes the envelopes to the LogCache of their tag value", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "some-source-id", Tags: map[string]string{"tenant": "a"}},
+				{Timestamp: 2, SourceId: "some-source-id", Tags: map[string]string{"tenant": "b"}},
+				{Timestamp: 3, SourceId: "some-source-id"},
+			}
+
+			Eventually(tenantLogCache.GetEnvelopes).Should(HaveLen(1))
+			Expect(tenantLogCache.GetEnvelopes()[0].Timestamp).To(BeEquivalentTo(1))
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(2))
+
+			Eventually(spyMetrics.Getter("nozzle_egress")).Should(Equal(3.0))
+			Expect(spyMetrics.Get(testing.LabeledMetricName(
+				"nozzle_egress_per_target",
+				map[string]string{"target": tenantAddr},
+			))).To(Equal(1.0))
+		})
+	})
+
 	Context("With default envelope selectors", func() {
 		BeforeEach(func() {
 			tlsConfig, err := testing.NewTLSConfig(
@@ -156,6 +1368,60 @@ var _ = Describe("Nozzle", func() {
 			Expect(spyMetrics.Get("nozzle_ingress")).To(Equal(3.0))
 			Expect(spyMetrics.Get("nozzle_egress")).To(Equal(3.0))
 			Expect(spyMetrics.Get("nozzle_err")).To(BeZero())
+			Expect(spyMetrics.Get("nozzle_dry_run")).To(BeZero())
+			Expect(spyMetrics.Get("nozzle_sampled_out")).To(BeZero())
+		})
+
+		It("records the duration of each write", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+
+			Eventually(logCache.GetEnvelopes).Should(HaveLen(1))
+			successes := spyMetrics.HistogramObservationsGetter(
+				testing.LabeledMetricName("nozzle_write_duration_seconds", map[string]string{"result": "success"}),
+			)
+			Eventually(successes).Should(HaveLen(1))
+			Expect(successes()[0]).To(BeNumerically(">", 0))
+			Expect(spyMetrics.GetUnit(
+				testing.LabeledMetricName("nozzle_write_duration_seconds", map[string]string{"result": "success"}),
+			)).To(Equal("seconds"))
+
+			failures := spyMetrics.HistogramObservationsGetter(
+				testing.LabeledMetricName("nozzle_write_duration_seconds", map[string]string{"result": "failure"}),
+			)
+			Expect(failures()).To(BeEmpty())
+		})
+
+		It("records the size of each read batch", func() {
+			streamConnector.envelopes <- []*loggregator_v2.Envelope{
+				{Timestamp: 1, SourceId: "some-source-id"},
+				{Timestamp: 2, SourceId: "some-source-id"},
+			}
+			addEnvelope(3, "some-source-id", streamConnector)
+
+			Eventually(spyMetrics.HistogramObservationsGetter("nozzle_read_batch_size")).Should(ConsistOf(2.0, 1.0))
+			Expect(spyMetrics.GetUnit("nozzle_read_batch_size")).To(Equal("entries"))
+		})
+
+		It("writes the buffered envelopes on drain", func() {
+			addEnvelope(1, "some-source-id", streamConnector)
+			addEnvelope(2, "some-source-id", streamConnector)
+			addEnvelope(3, "some-source-id", streamConnector)
+			Eventually(streamConnector.envelopes).Should(HaveLen(0))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(n.Drain(ctx)).To(Equal(0))
+			Expect(logCache.GetEnvelopes()).To(HaveLen(3))
+		})
+
+		It("stops reading envelopes on drain", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(n.Drain(ctx)).To(Equal(0))
+
+			addEnvelope(1, "some-source-id", streamConnector)
+			Consistently(streamConnector.envelopes).Should(HaveLen(1))
+			Expect(logCache.GetEnvelopes()).To(BeEmpty())
 		})
 	})
 })
@@ -0,0 +1,75 @@
+package nozzle
+
+import (
+	"container/list"
+	"math"
+	"time"
+)
+
+// maxRateLimitedSources is the number of sources the sourceRateLimiter
+// keeps a token bucket for. Once reached, the bucket of the least recently
+// seen source is evicted.
+const maxRateLimitedSources = 10000
+
+// sourceRateLimiter is a token bucket rate limiter keyed by source ID. It
+// is not safe for concurrent use.
+type sourceRateLimiter struct {
+	rate       float64
+	burst      float64
+	maxSources int
+	now        func() time.Time
+
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	sourceID string
+	tokens   float64
+	last     time.Time
+}
+
+func newSourceRateLimiter(rate float64, burst, maxSources int) *sourceRateLimiter {
+	return &sourceRateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxSources: maxSources,
+		now:        time.Now,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// allow reports whether an envelope of the given source is within its rate
+// and takes a token if so.
+func (l *sourceRateLimiter) allow(sourceID string) bool {
+	now := l.now()
+
+	e, ok := l.buckets[sourceID]
+	if !ok {
+		if l.lru.Len() >= l.maxSources {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).sourceID)
+		}
+
+		e = l.lru.PushFront(&tokenBucket{
+			sourceID: sourceID,
+			tokens:   l.burst,
+			last:     now,
+		})
+		l.buckets[sourceID] = e
+	}
+	l.lru.MoveToFront(e)
+
+	b := e.Value.(*tokenBucket)
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
@@ -0,0 +1,90 @@
+package nozzle
+
+import (
+	"sync"
+	"time"
+)
+
+// successRatioSlots is the number of slots the window of the
+// nozzle_write_success_ratio gauge is divided into. The window slides by a
+// slot at a time.
+const successRatioSlots = 10
+
+// successRatio tracks the successful and failed writes within a sliding
+// window. It is safe for concurrent use.
+type successRatio struct {
+	mu       sync.Mutex
+	slotSize int64
+	egress   []uint64
+	errs     []uint64
+
+	// current is the number of the slot the current time falls into.
+	current int64
+}
+
+func newSuccessRatio(window time.Duration, slots int) *successRatio {
+	slotSize := int64(window) / int64(slots)
+	if slotSize <= 0 {
+		slotSize = 1
+	}
+
+	return &successRatio{
+		slotSize: slotSize,
+		egress:   make([]uint64, slots),
+		errs:     make([]uint64, slots),
+	}
+}
+
+// add adds the given number of successful and failed writes at the given
+// time.
+func (r *successRatio) add(now time.Time, egress, errs uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.advance(now)
+	r.egress[i] += egress
+	r.errs[i] += errs
+}
+
+// ratio returns egress/(egress+err) within the window that ends at the
+// given time. It is 1 without any traffic.
+func (r *successRatio) ratio(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.advance(now)
+
+	var egress, errs uint64
+	for i := range r.egress {
+		egress += r.egress[i]
+		errs += r.errs[i]
+	}
+
+	if egress+errs == 0 {
+		return 1
+	}
+
+	return float64(egress) / float64(egress+errs)
+}
+
+// advance clears the slots that slid out of the window since the last call
+// and returns the index of the slot of the given time.
+func (r *successRatio) advance(now time.Time) int {
+	slots := int64(len(r.egress))
+	slot := now.UnixNano() / r.slotSize
+
+	if slot > r.current {
+		cleared := slot - r.current
+		if cleared > slots {
+			cleared = slots
+		}
+
+		for s := slot - cleared + 1; s <= slot; s++ {
+			r.egress[s%slots] = 0
+			r.errs[s%slots] = 0
+		}
+		r.current = slot
+	}
+
+	return int(r.current % slots)
+}
@@ -71,10 +71,13 @@ func (q *PromQL) InstantQuery(ctx context.Context, req *logcache_v1.PromQL_Insta
 		errf: func(e error) { closureErr = e },
 	}
 
-	queryable := promql.NewEngine(nil, nil, 10, q.queryTimeout)
+	timeout, err := q.evaluationTimeout(req.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	queryable := promql.NewEngine(nil, nil, 10, timeout)
 
 	var requestTime time.Time
-	var err error
 	if req.Time == "" {
 		requestTime = time.Now().Truncate(time.Second)
 	} else {
@@ -101,6 +104,29 @@ func (q *PromQL) InstantQuery(ctx context.Context, req *logcache_v1.PromQL_Insta
 	return q.toInstantQueryResult(r)
 }
 
+// evaluationTimeout returns the timeout requested by the client. It is
+// capped by the configured query timeout, which is also the default.
+func (q *PromQL) evaluationTimeout(param string) (time.Duration, error) {
+	if param == "" {
+		return q.queryTimeout, nil
+	}
+
+	timeout, err := ParseDuration(param)
+	if err != nil {
+		return 0, err
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive: %s", param)
+	}
+
+	if timeout > q.queryTimeout {
+		return q.queryTimeout, nil
+	}
+
+	return timeout, nil
+}
+
 func (q *PromQL) toInstantQueryResult(r *promql.Result) (*logcache_v1.PromQL_InstantQueryResult, error) {
 	if r.Err != nil {
 		return nil, r.Err
@@ -190,7 +216,11 @@ func (q *PromQL) RangeQuery(ctx context.Context, req *logcache_v1.PromQL_RangeQu
 		// manually.
 		errf: func(e error) { closureErr = e },
 	}
-	queryable := promql.NewEngine(nil, nil, 10, q.queryTimeout)
+	timeout, err := q.evaluationTimeout(req.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	queryable := promql.NewEngine(nil, nil, 10, timeout)
 
 	step, err := ParseStep(req.Step)
 	if err != nil {
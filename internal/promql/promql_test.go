@@ -808,6 +808,14 @@ var _ = Describe("PromQL", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("returns an error for an invalid timeout", func() {
+			_, err := q.InstantQuery(
+				context.Background(),
+				&logcache_v1.PromQL_InstantQueryRequest{Query: `metric{source_id="some-id-1"}`, Timeout: "soon"},
+			)
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("returns an error if a metric does not have a source ID", func() {
 			_, err := q.InstantQuery(
 				context.Background(),
@@ -74,6 +74,7 @@ type SpyLogCache struct {
 	readRequests       []*rpc.ReadRequest
 	queryRequests      []*rpc.PromQL_InstantQueryRequest
 	QueryError         error
+	SendError          func(batch []*loggregator_v2.Envelope) error
 	rangeQueryRequests []*rpc.PromQL_RangeQueryRequest
 	ReadEnvelopes      map[string]func() []*loggregator_v2.Envelope
 	MetaResponses      map[string]*rpc.MetaInfo
@@ -142,6 +143,12 @@ func (s *SpyLogCache) Send(ctx context.Context, r *rpc.SendRequest) (*rpc.SendRe
 
 	s.localOnlyValues = append(s.localOnlyValues, r.LocalOnly)
 
+	if s.SendError != nil {
+		if err := s.SendError(r.Envelopes.Batch); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, e := range r.Envelopes.Batch {
 		s.envelopes = append(s.envelopes, e)
 	}
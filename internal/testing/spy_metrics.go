@@ -2,7 +2,11 @@ package testing
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+
+	"code.cloudfoundry.org/log-cache/internal/metrics"
 )
 
 const (
@@ -10,17 +14,19 @@ const (
 )
 
 type SpyMetrics struct {
-	values              map[string]float64
-	units               map[string]string
-	summaryObservations map[string][]float64
+	values                map[string]float64
+	units                 map[string]string
+	summaryObservations   map[string][]float64
+	histogramObservations map[string][]float64
 	sync.Mutex
 }
 
 func NewSpyMetrics() *SpyMetrics {
 	return &SpyMetrics{
-		values:              make(map[string]float64),
-		units:               make(map[string]string),
-		summaryObservations: make(map[string][]float64),
+		values:                make(map[string]float64),
+		units:                 make(map[string]string),
+		summaryObservations:   make(map[string][]float64),
+		histogramObservations: make(map[string][]float64),
 	}
 }
 
@@ -79,6 +85,80 @@ func (s *SpyMetrics) NewSummary(name, unit string) func(float64) {
 	}
 }
 
+// NewCounterVec keys each label combination by its name followed by its
+// sorted labels (e.g., name{a=b,c=d}). The options are ignored.
+func (s *SpyMetrics) NewCounterVec(name string, labelNames []string, opts ...metrics.CounterVecOption) func(uint64, ...string) {
+	return func(value uint64, labelValues ...string) {
+		s.Lock()
+		defer s.Unlock()
+
+		labels := make(map[string]string)
+		for i, labelName := range labelNames {
+			labels[labelName] = labelValues[i]
+		}
+
+		s.values[LabeledMetricName(name, labels)] += float64(value)
+	}
+}
+
+// NewHistogram records every observation. Histograms with labels are keyed
+// by their name followed by their sorted labels (e.g., name{a=b,c=d}).
+func (s *SpyMetrics) NewHistogram(name, unit string, buckets []float64, labels map[string]string) func(float64) {
+	s.Lock()
+	defer s.Unlock()
+	metricName := LabeledMetricName(name, labels)
+	s.histogramObservations[metricName] = make([]float64, 0)
+	s.units[metricName] = unit
+
+	return func(value float64) {
+		s.Lock()
+		defer s.Unlock()
+
+		s.histogramObservations[metricName] = append(s.histogramObservations[metricName], value)
+	}
+}
+
+// NewNativeHistogram records every observation like NewHistogram.
+func (s *SpyMetrics) NewNativeHistogram(name string) func(float64) {
+	return s.NewHistogram(name, "", nil, nil)
+}
+
+// LabeledMetricName returns the key the SpyMetrics uses for a histogram or
+// counter vector with the given labels.
+func LabeledMetricName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+// Reset zeroes every registered metric and discards every observation.
+// Unlike the prometheus backed metrics, previously returned functions remain
+// valid.
+func (s *SpyMetrics) Reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	for name := range s.values {
+		s.values[name] = 0
+	}
+
+	for name := range s.summaryObservations {
+		s.summaryObservations[name] = make([]float64, 0)
+	}
+
+	for name := range s.histogramObservations {
+		s.histogramObservations[name] = make([]float64, 0)
+	}
+}
+
 func (s *SpyMetrics) Getter(name string) func() float64 {
 	return func() float64 {
 		s.Lock()
@@ -112,3 +192,14 @@ func (s *SpyMetrics) SummaryObservationsGetter(name string) func() []float64 {
 		return value
 	}
 }
+
+func (s *SpyMetrics) HistogramObservationsGetter(name string) func() []float64 {
+	return func() []float64 {
+		s.Lock()
+		defer s.Unlock()
+
+		value := make([]float64, len(s.histogramObservations[name]))
+		copy(value, s.histogramObservations[name])
+		return value
+	}
+}
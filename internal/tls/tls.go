@@ -64,6 +64,66 @@ func NewMutualTLSConfig(caPath, certPath, keyPath, cn string) (*tls.Config, erro
 	return tlsConfig, nil
 }
 
+// NewReloadableMutualTLSConfig returns a config like NewMutualTLSConfig,
+// but loads the certificate, key and CA from disk on each handshake. A
+// rotated certificate is therefore used by the next connection without a
+// restart.
+func NewReloadableMutualTLSConfig(caPath, certPath, keyPath, cn string) *tls.Config {
+	tlsConfig := NewBaseTLSConfig()
+	tlsConfig.ServerName = cn
+
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cert, nil
+	}
+
+	// The default verification only supports a static CA pool. The server
+	// certificate is instead verified against the current CA by
+	// VerifyPeerCertificate.
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		caCertBytes, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+		if ok := roots.AppendCertsFromPEM(caCertBytes); !ok {
+			return errors.New("cannot parse ca cert")
+		}
+
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			certs[i], err = x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			DNSName:       cn,
+		})
+		return err
+	}
+
+	return tlsConfig
+}
+
 func NewBaseTLSConfig() *tls.Config {
 	return &tls.Config{
 		InsecureSkipVerify: false,
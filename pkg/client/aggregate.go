@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+// AggFunc is an aggregation over time that Aggregate applies.
+type AggFunc int
+
+const (
+	AggAvg AggFunc = iota + 1
+	AggSum
+	AggMin
+	AggMax
+	AggCount
+)
+
+// overTime returns the PromQL function that aggregates each series over
+// time, and the aggregation operator that combines the series (e.g., of
+// different instances).
+func (f AggFunc) overTime() (fn, op string, err error) {
+	switch f {
+	case AggAvg:
+		return "avg_over_time", "avg", nil
+	case AggSum:
+		return "sum_over_time", "sum", nil
+	case AggMin:
+		return "min_over_time", "min", nil
+	case AggMax:
+		return "max_over_time", "max", nil
+	case AggCount:
+		return "count_over_time", "sum", nil
+	default:
+		return "", "", fmt.Errorf("unknown aggregation function: %d", f)
+	}
+}
+
+// ErrNoData is returned by Aggregate if there is no data to aggregate, and
+// by Read for an empty result if configured WithEmptyResultError.
+var ErrNoData = errors.New("no data")
+
+// Aggregate aggregates the given metric of the given source over the
+// window that ends now, e.g., avg_over_time(cpu{source_id="x"}[1h]). If the
+// source has several series for the metric (e.g., one per instance), they
+// are combined as well. Counts are summed up. It returns ErrNoData if there
+// is nothing to aggregate.
+func (c *Client) Aggregate(
+	ctx context.Context,
+	metricName string,
+	sourceID string,
+	fn AggFunc,
+	window time.Duration,
+) (float64, error) {
+	overTime, op, err := fn.overTime()
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf("%s(%s(%s[%s]))",
+		op,
+		overTime,
+		BuildMatcher(metricName, map[string]string{"source_id": sourceID}),
+		formatPromQLDuration(window),
+	)
+
+	result, err := c.PromQL(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	samples := result.GetVector().GetSamples()
+	if len(samples) == 0 {
+		return 0, ErrNoData
+	}
+
+	return samples[0].GetPoint().GetValue(), nil
+}
+
+// Histogram counts the samples of the given metric of the given source over
+// the window that ends now, per bucket. Like the buckets of a Prometheus
+// histogram, the buckets are cumulative: each upper bound maps to the
+// number of samples less than or equal to it. The upper bounds must be
+// sorted in ascending order. A sample is the value of a gauge, or the total
+// of a counter. The envelopes are read in pages, so only their counts are
+// kept in memory.
+func (c *Client) Histogram(
+	ctx context.Context,
+	metricName string,
+	sourceID string,
+	buckets []float64,
+	window time.Duration,
+) (map[float64]float64, error) {
+	if len(buckets) == 0 {
+		return nil, errors.New("no buckets")
+	}
+
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return nil, fmt.Errorf("buckets must be sorted in ascending order: %v", buckets)
+		}
+	}
+
+	counts := make(map[float64]float64, len(buckets))
+	for _, le := range buckets {
+		counts[le] = 0
+	}
+
+	end := time.Now()
+	err := c.scan(ctx, sourceID, end.Add(-window), end,
+		[]ReadOption{
+			WithEnvelopeTypes(logcache_v1.EnvelopeType_GAUGE, logcache_v1.EnvelopeType_COUNTER),
+			WithNameFilter("^" + regexp.QuoteMeta(metricName) + "$"),
+		},
+		func(envelopes []*loggregator_v2.Envelope) error {
+			for _, e := range envelopes {
+				var value float64
+				if m, ok := e.GetGauge().GetMetrics()[metricName]; ok {
+					value = m.GetValue()
+				} else if e.GetCounter().GetName() == metricName {
+					value = float64(e.GetCounter().GetTotal())
+				} else {
+					continue
+				}
+
+				for _, le := range buckets {
+					if value <= le {
+						counts[le]++
+					}
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// BucketCount is the number of envelopes of a time bucket.
+type BucketCount struct {
+	BucketStart time.Time
+	Count       int
+}
+
+// scanPageSize is the limit of each read of scan.
+const scanPageSize = 1000
+
+// Buckets counts the envelopes of the given source from start until end per
+// bucket of the given duration, e.g. for a sparkline of the logs per minute.
+// The buckets are aligned to the start and returned in ascending order,
+// including the empty ones. The last bucket ends at the end, even if it is
+// shorter. The envelopes are read in pages, so only their counts are kept
+// in memory. The given ReadOptions filter the envelopes (e.g.,
+// WithEnvelopeTypes), but must not set the end time, limit or order.
+//
+// Buckets deliberately does not use a count_over_time range query, even
+// though LogCache supports PromQL: PromQL only sees the samples of a named
+// metric, so it cannot count logs, events or all the envelopes of a source,
+// and it counts a gauge envelope once per metric. For the samples of a
+// single metric, count_over_time(cpu{source_id="x"}[1m]) via PromQLRange
+// avoids reading the envelopes altogether.
+func (c *Client) Buckets(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	end time.Time,
+	bucket time.Duration,
+	opts ...ReadOption,
+) ([]BucketCount, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket must be positive: %s", bucket)
+	}
+
+	if !end.After(start) {
+		return nil, fmt.Errorf("end must be after start: %s, %s", start, end)
+	}
+
+	n := (end.Sub(start) + bucket - 1) / bucket
+	buckets := make([]BucketCount, n)
+	for i := range buckets {
+		buckets[i].BucketStart = start.Add(time.Duration(i) * bucket)
+	}
+
+	err := c.scan(ctx, sourceID, start, end, opts, func(envelopes []*loggregator_v2.Envelope) error {
+		for _, e := range envelopes {
+			buckets[(e.GetTimestamp()-start.UnixNano())/int64(bucket)].Count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// scan reads the envelopes of the given source from start until end in
+// pages, and invokes visit for each page with its envelopes that pass the
+// given options. It stops with the first error visit returns, or with the
+// context's error once the context is done. The client side filters (e.g.,
+// WithNonEmptyPayloads) are applied here rather than by Read, as a page
+// they empty entirely does not mean there are no more envelopes.
+func (c *Client) scan(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	end time.Time,
+	opts []ReadOption,
+	visit func([]*loggregator_v2.Envelope) error,
+) error {
+	u := &url.URL{}
+	q := u.Query()
+	for _, o := range c.readOptions(opts) {
+		o(u, q)
+	}
+
+	params, err := resolveReadParams(start, q)
+	if err != nil {
+		return err
+	}
+
+	// The full slice expression keeps append from writing into the
+	// caller's array.
+	opts = append(opts[:len(opts):len(opts)], withoutClientFilters())
+
+	cursor := start.UnixNano()
+	for cursor < end.UnixNano() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		envelopes, err := c.Read(ctx, sourceID, time.Unix(0, cursor),
+			append(opts, WithEndTime(end), WithLimit(scanPageSize))...,
+		)
+		if errors.Is(err, ErrNoData) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var (
+			advanced bool
+			kept     []*loggregator_v2.Envelope
+		)
+		for _, e := range envelopes {
+			// Skip envelopes outside of the requested window to never
+			// visit the same page twice.
+			if e.GetTimestamp() < cursor || e.GetTimestamp() >= end.UnixNano() {
+				continue
+			}
+
+			cursor = e.GetTimestamp() + 1
+			advanced = true
+
+			if params.keep(e) {
+				kept = append(kept, e)
+			}
+		}
+
+		if err := visit(kept); err != nil {
+			return err
+		}
+
+		if !advanced {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// withoutClientFilters removes the client side filters set by previous
+// options, so that Read returns the envelopes as LogCache does.
+func withoutClientFilters() ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Del(nonEmptyPayloadsParam)
+		q.Del(logStreamParam)
+		q.Del(asOfParam)
+	}
+}
+
+// EstimateRate estimates the number of envelopes per second the given
+// source produces, by counting its envelopes within the sample window that
+// ends now. Sparse sources yield a rate below one per second, and sources
+// without any envelope in the window a rate of 0.
+func (c *Client) EstimateRate(
+	ctx context.Context,
+	sourceID string,
+	sampleWindow time.Duration,
+) (float64, error) {
+	end := time.Now()
+	buckets, err := c.Buckets(ctx, sourceID, end.Add(-sampleWindow), end, sampleWindow)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(buckets[0].Count) / sampleWindow.Seconds(), nil
+}
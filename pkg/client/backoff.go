@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy determines how long to wait before retrying. It is used by
+// WithRetry and Walk via WithBackoff. Unlike Backoff, it does not decide
+// whether to retry.
+type BackoffStrategy interface {
+	// Next returns the duration to wait before the given attempt. The first
+	// retry is attempt 0.
+	Next(attempt int) time.Duration
+
+	// Reset is invoked by Walk after a successful attempt. WithRetry does
+	// not invoke it, as its BackoffStrategy is shared by concurrent calls.
+	Reset()
+}
+
+// ExponentialBackoff doubles the wait for each attempt, starting with
+// Initial and capped at Max. With Jitter, a random duration of up to half
+// the wait is subtracted to spread out retries of concurrent callers.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Jitter  bool
+}
+
+// NewExponentialBackoff returns an ExponentialBackoff with jitter. It is the
+// default of WithRetry.
+func NewExponentialBackoff(initial, max time.Duration) ExponentialBackoff {
+	return ExponentialBackoff{
+		Initial: initial,
+		Max:     max,
+		Jitter:  true,
+	}
+}
+
+// Next implements BackoffStrategy.
+func (b ExponentialBackoff) Next(attempt int) time.Duration {
+	d := b.Initial
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+
+	if b.Jitter && d > 1 {
+		d -= time.Duration(rand.Int63n(int64(d / 2)))
+	}
+
+	return d
+}
+
+// Reset implements BackoffStrategy.
+func (b ExponentialBackoff) Reset() {}
+
+// ConstantBackoff waits the same interval before each attempt.
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+// Next implements BackoffStrategy.
+func (b ConstantBackoff) Next(int) time.Duration {
+	return b.Interval
+}
+
+// Reset implements BackoffStrategy.
+func (b ConstantBackoff) Reset() {}
+
+// BackoffOption configures the BackoffStrategy of WithRetry or Walk.
+type BackoffOption struct {
+	strategy BackoffStrategy
+}
+
+// WithBackoff sets the BackoffStrategy of WithRetry or Walk. For Walk, it
+// replaces WithWalkBackoff and retries every error and empty batch until
+// the context is done.
+func WithBackoff(b BackoffStrategy) BackoffOption {
+	return BackoffOption{strategy: b}
+}
+
+func (o BackoffOption) configure(c *walkConfig) {
+	c.strategy = o.strategy
+}
+
+func (o BackoffOption) configureRetry(c *retryConfig) {
+	c.strategy = o.strategy
+}
+
+// sleep waits for the given duration. It returns false if the context is
+// done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// strategyBackoff adapts a BackoffStrategy to a Backoff that always retries
+// until the context is done.
+type strategyBackoff struct {
+	ctx      context.Context
+	strategy BackoffStrategy
+	attempt  int
+}
+
+// OnErr implements Backoff.
+func (b *strategyBackoff) OnErr(error) bool {
+	return b.wait()
+}
+
+// OnEmpty implements Backoff.
+func (b *strategyBackoff) OnEmpty() bool {
+	return b.wait()
+}
+
+// Reset implements Backoff.
+func (b *strategyBackoff) Reset() {
+	b.attempt = 0
+	b.strategy.Reset()
+}
+
+func (b *strategyBackoff) wait() bool {
+	d := b.strategy.Next(b.attempt)
+	b.attempt++
+
+	return sleep(b.ctx, d)
+}
@@ -0,0 +1,55 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/pkg/client"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := client.ExponentialBackoff{Initial: 100 * time.Millisecond, Max: time.Second}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, d := range expected {
+		if b.Next(attempt) != d {
+			t.Fatalf("expected attempt %d to wait %s: %s", attempt, d, b.Next(attempt))
+		}
+	}
+
+	if b.Next(1000) != time.Second {
+		t.Fatalf("expected a late attempt to wait the max: %s", b.Next(1000))
+	}
+}
+
+func TestExponentialBackoffWithJitter(t *testing.T) {
+	t.Parallel()
+
+	b := client.NewExponentialBackoff(100*time.Millisecond, time.Second)
+
+	for i := 0; i < 100; i++ {
+		d := b.Next(2)
+		if d <= 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatalf("expected wait to be in (200ms, 400ms]: %s", d)
+		}
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := client.ConstantBackoff{Interval: time.Second}
+
+	if b.Next(0) != time.Second || b.Next(5) != time.Second {
+		t.Fatal("expected every attempt to wait the interval")
+	}
+}
@@ -1,48 +1,145 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
-	"code.cloudfoundry.org/log-cache/pkg/marshaler"
+	"code.cloudfoundry.org/log-cache/internal/metrics"
 	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
 	"github.com/blang/semver"
-	"github.com/golang/protobuf/jsonpb"
-	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
-// Client reads from LogCache via the RESTful or gRPC API.
+// Client reads from LogCache via the RESTful or gRPC API. A Client is safe
+// for concurrent use by multiple goroutines.
 type Client struct {
-	addr        string
+	addr string
+
+	// baseApiPath is either configured via WithAPIVersion or detected and
+	// cached on first use.
+	mu          sync.Mutex
 	baseApiPath string
+	infoPath    string
 
 	httpClient       HTTPClient
 	grpcClient       logcache_v1.EgressClient
 	promqlGrpcClient logcache_v1.PromQLQuerierClient
+
+	viaGRPC        bool
+	grpcDialOpts   []grpc.DialOption
+	grpcKeepalive  keepalive.ClientParameters
+	grpcAuthority  string
+	grpcCompressor string
+	grpcConn       *grpc.ClientConn
+
+	// unixSocket is the path of the unix domain socket to connect to
+	// instead of the address, and unixSocketErr the error of its validation.
+	unixSocket    string
+	unixSocketErr error
+
+	getClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// h2c enables cleartext HTTP/2, and h2cErr is the error of its
+	// validation.
+	h2c    bool
+	h2cErr error
+
+	inFlight requestRegistry
+
+	requestIDKey      interface{}
+	maxErrorBodyBytes int64
+	maxResponseBytes  int64
+	onFiltered        func(filtered int)
+	maxLimit          int
+	readGroup         *singleflight.Group
+	emptyResultError  bool
+	extraQueryParams  url.Values
+	fallbackOn404     bool
+
+	defaultReadOpts   []ReadOption
+	defaultPromQLOpts []PromQLOption
+
+	metaCache *metaCache
+
+	log             *log.Logger
+	debugLogger     func(method, url string, status int, dur time.Duration)
+	grpcDebugLogger func(method string, code codes.Code, dur time.Duration)
+	capture         func(req, resp []byte)
+	decoder         ResultDecoder
+
+	metrics         metrics.Initializer
+	metricsHandler  http.Handler
+	incRequests     func(delta uint64)
+	incErrors       func(delta uint64)
+	requestDuration func(value float64)
+
+	retry *retryConfig
 }
 
 // NewIngressClient creates a Client.
 func NewClient(addr string, opts ...ClientOption) *Client {
 	c := &Client{
-		addr: addr,
+		addr:     addr,
+		infoPath: "/api/v1/info",
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
+		maxErrorBodyBytes: 1024,
+		maxResponseBytes:  64 << 20,
+		decoder:           DefaultDecoder{},
+		log:               log.New(ioutil.Discard, "", 0),
 	}
 
 	for _, o := range opts {
 		o.configure(c)
 	}
 
+	c.initMetrics()
+
+	if c.unixSocket != "" {
+		c.configureUnixSocket()
+	}
+
+	if c.getClientCertificate != nil {
+		c.configureClientCertificate()
+	}
+
+	if c.h2c {
+		c.configureH2C()
+	}
+
+	if c.viaGRPC {
+		c.dialGRPC()
+	}
+
 	return c
 }
 
@@ -82,244 +179,2458 @@ func WithViaGRPC(opts ...grpc.DialOption) ClientOption {
 	return clientOptionFunc(func(c interface{}) {
 		switch c := c.(type) {
 		case *Client:
-			conn, err := grpc.Dial(c.addr, opts...)
-			if err != nil {
-				panic(fmt.Sprintf("failed to dial via gRPC: %s", err))
+			c.viaGRPC = true
+			c.grpcDialOpts = opts
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithGRPCKeepalive sets the keepalive parameters of the gRPC connection.
+// Without keepalives, idle connections behind a load balancer are often
+// silently dropped. Keepalive parameters given as dial options to
+// WithViaGRPC take precedence. It defaults to no keepalives. It only has an
+// effect in combination with WithViaGRPC.
+//
+// Note that gRPC servers reject clients that ping more often than their
+// enforcement policy permits (by default every 5 minutes, and only with an
+// active call).
+func WithGRPCKeepalive(params keepalive.ClientParameters) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.grpcKeepalive = params
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithGRPCAuthority sets the :authority of the gRPC calls, which is also the
+// server name used to verify the TLS certificate of LogCache unless the
+// transport credentials set one. It is required when the dial address
+// (e.g., an IP behind a load balancer) doesn't match the certificate. It
+// defaults to the dial address. A grpc.WithAuthority dial option given to
+// WithViaGRPC takes precedence. It only has an effect in combination with
+// WithViaGRPC.
+func WithGRPCAuthority(authority string) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.grpcAuthority = authority
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithGRPCCompression compresses the gRPC calls with the compressor of the
+// given name (e.g., "gzip"). This reduces the bandwidth of large reads, at
+// the cost of CPU on both ends. The compressor has to be registered in both
+// the client and the server process (see google.golang.org/grpc/encoding),
+// otherwise the calls fail. The gzip compressor is registered by this
+// package. It defaults to no compression. It only has an effect in
+// combination with WithViaGRPC.
+func WithGRPCCompression(name string) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.grpcCompressor = name
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+func (c *Client) dialGRPC() {
+	var opts []grpc.DialOption
+	if c.grpcKeepalive != (keepalive.ClientParameters{}) {
+		opts = append(opts, grpc.WithKeepaliveParams(c.grpcKeepalive))
+	}
+	if c.grpcAuthority != "" {
+		opts = append(opts, grpc.WithAuthority(c.grpcAuthority))
+	}
+	if c.getClientCertificate != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			GetClientCertificate: c.getClientCertificate,
+		})))
+	}
+	if c.grpcCompressor != "" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(c.grpcCompressor)))
+	}
+	if c.unixSocket != "" {
+		opts = append(opts, grpc.WithDialer(func(_ string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", c.unixSocket, timeout)
+		}))
+	}
+	if c.grpcDebugLogger != nil || c.metrics != nil || c.retry != nil || c.capture != nil || c.unixSocket != "" {
+		opts = append(opts, grpc.WithUnaryInterceptor(c.interceptor))
+	}
+	opts = append(opts, c.grpcDialOpts...)
+
+	conn, err := grpc.Dial(c.addr, opts...)
+	if err != nil {
+		panic(fmt.Sprintf("failed to dial via gRPC: %s", err))
+	}
+
+	c.grpcConn = conn
+	c.grpcClient = logcache_v1.NewEgressClient(conn)
+	c.promqlGrpcClient = logcache_v1.NewPromQLQuerierClient(conn)
+}
+
+// WithDebugLogger sets a function that is invoked after each HTTP call with
+// the method, the URL (including its query parameters), the status code
+// and the duration of the call. The status code is 0 if the call failed
+// without a response. Neither headers nor bodies are logged, but the URL
+// might still contain sensitive data, so it defaults to not logging.
+func WithDebugLogger(f func(method, url string, status int, dur time.Duration)) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.debugLogger = f
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithLogger sets the logger the Client warns with, e.g., about a limit
+// lowered via WithMaxLimit. It defaults to not logging.
+func WithLogger(l *log.Logger) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.log = l
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithGRPCDebugLogger sets a function that is invoked after each gRPC call
+// with the full method name, the status code and the duration of the call.
+// Requests and responses are not logged. It is installed as unary
+// interceptor, and is therefore replaced by any unary interceptor passed
+// to WithViaGRPC. It defaults to not logging.
+func WithGRPCDebugLogger(f func(method string, code codes.Code, dur time.Duration)) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.grpcDebugLogger = f
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithUnixSocket configures the Client to connect to LogCache via the unix
+// domain socket at the given path instead of TCP, e.g. to a co-located
+// sidecar. The address given to NewClient is still used for the URLs and
+// the gRPC authority (e.g., "http://log-cache"). Via HTTP, it only applies
+// to an *http.Client, including the one given to WithHTTPClient. If the
+// socket doesn't exist when the Client is created, each call returns an
+// error.
+func WithUnixSocket(path string) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.unixSocket = path
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// configureUnixSocket validates the unix socket and configures the HTTP
+// client to dial it.
+func (c *Client) configureUnixSocket() {
+	if _, err := os.Stat(c.unixSocket); err != nil {
+		c.unixSocketErr = fmt.Errorf("invalid unix socket: %s", err)
+		return
+	}
+
+	var d net.Dialer
+	c.configureTransport(func(t *http.Transport) {
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", c.unixSocket)
+		}
+	})
+}
+
+// configureTransport replaces the HTTP client with a copy whose transport
+// is configured by the given function. The transport of the HTTP client is
+// left untouched. It has no effect unless the HTTP client is an
+// *http.Client with an *http.Transport or the default transport.
+func (c *Client) configureTransport(f func(*http.Transport)) {
+	httpClient, ok := c.httpClient.(*http.Client)
+	if !ok {
+		return
+	}
+
+	var transport *http.Transport
+	switch t := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return
+	}
+	f(transport)
+
+	configured := *httpClient
+	configured.Transport = transport
+	c.httpClient = &configured
+}
+
+// WithClientCertificate configures the Client to obtain the certificate it
+// presents to LogCache for mutual TLS from the given function whenever it
+// establishes a connection, e.g. from a SPIFFE X.509 SVID source
+// (x509svid.Source) that rotates short-lived certificates. The function
+// has the signature of tls.Config.GetClientCertificate.
+//
+// Via HTTP, it applies like WithUnixSocket, and the remaining TLS
+// configuration of the transport (e.g., its RootCAs) is kept. Via gRPC, the
+// connection is secured via TLS with the system roots. Transport
+// credentials passed to WithViaGRPC take precedence, so to verify LogCache
+// with other roots, set the function as GetClientCertificate of their TLS
+// configuration instead. It defaults to the static TLS configuration of
+// the HTTP client or gRPC dial options.
+func WithClientCertificate(f func(*tls.CertificateRequestInfo) (*tls.Certificate, error)) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.getClientCertificate = f
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// configureClientCertificate configures the HTTP client to obtain its
+// client certificate from the function given to WithClientCertificate.
+func (c *Client) configureClientCertificate() {
+	c.configureTransport(func(t *http.Transport) {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.GetClientCertificate = c.getClientCertificate
+	})
+}
+
+// WithH2C configures the Client to speak HTTP/2 over cleartext (h2c) with
+// prior knowledge, e.g. to a LogCache behind a sidecar that terminates TLS.
+// It replaces the transport of the HTTP client, so it only applies to an
+// *http.Client, including the one given to WithHTTPClient. It is mutually
+// exclusive with TLS: if the address is https, the transport of the HTTP
+// client has a TLS configuration or WithClientCertificate is given, each
+// call returns an error.
+func WithH2C() ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.h2c = true
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// configureH2C validates that TLS is not configured and replaces the
+// transport of the HTTP client with a cleartext HTTP/2 transport.
+func (c *Client) configureH2C() {
+	httpClient, ok := c.httpClient.(*http.Client)
+	if !ok {
+		return
+	}
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		c.h2cErr = err
+		return
+	}
+
+	t, _ := httpClient.Transport.(*http.Transport)
+	if u.Scheme == "https" || c.getClientCertificate != nil || (t != nil && t.TLSClientConfig != nil) {
+		c.h2cErr = errors.New("h2c can not be combined with TLS")
+		return
+	}
+
+	h2cClient := *httpClient
+	h2cClient.Transport = &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			if c.unixSocket != "" {
+				return net.Dial("unix", c.unixSocket)
+			}
+			return net.Dial(network, addr)
+		},
+	}
+	c.httpClient = &h2cClient
+}
+
+// WithCapture configures the Client to invoke the given function with the
+// raw request and response of each call to LogCache, e.g. to attach a
+// reproduction to a bug report. Via HTTP, these are the request as sent on
+// the wire and the response body. Via gRPC, these are the protobuf encoded
+// request and response messages. The response is nil if the call failed.
+// Each response body is buffered in memory, so don't use it on hot paths.
+// Via gRPC, it is installed as unary interceptor, and is therefore replaced
+// by any unary interceptor passed to WithViaGRPC. It defaults to not
+// capturing.
+func WithCapture(f func(req, resp []byte)) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.capture = f
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithExtraQueryParam configures the Client to add the given query param to
+// each HTTP request, e.g. to use a param of LogCache the Client doesn't
+// support yet. It may be given several times. A request fails if the key
+// is one of the params the Client sets itself (e.g., "limit"). It doesn't
+// apply via gRPC.
+func WithExtraQueryParam(key, value string) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			if c.extraQueryParams == nil {
+				c.extraQueryParams = url.Values{}
 			}
+			c.extraQueryParams.Add(key, value)
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// clientQueryParams are the query params the Client sets itself.
+var clientQueryParams = map[string]bool{
+	"start_time":     true,
+	"end_time":       true,
+	"limit":          true,
+	"envelope_types": true,
+	"descending":     true,
+	"name_filter":    true,
+	"local_only":     true,
+	"query":          true,
+	"time":           true,
+	"start":          true,
+	"end":            true,
+	"step":           true,
+	"timeout":        true,
+}
+
+// addExtraQueryParams adds the params given to WithExtraQueryParam to the
+// given URL.
+func (c *Client) addExtraQueryParams(u string) (string, error) {
+	if len(c.extraQueryParams) == 0 {
+		return u, nil
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
 
-			c.grpcClient = logcache_v1.NewEgressClient(conn)
-			c.promqlGrpcClient = logcache_v1.NewPromQLQuerierClient(conn)
+	q := parsed.Query()
+	for key, values := range c.extraQueryParams {
+		if _, ok := q[key]; ok || clientQueryParams[key] {
+			return "", fmt.Errorf("extra query param %q collides with a param set by the client", key)
+		}
+		q[key] = values
+	}
+	parsed.RawQuery = q.Encode()
+
+	return parsed.String(), nil
+}
+
+// WithMetrics configures the Client to publish metrics about its calls to
+// LogCache to the given Initializer. client_requests counts the calls and
+// client_errors the calls that failed or returned a status code other than
+// 200. client_request_duration_seconds is a histogram of their durations.
+// As the metrics are registered once per Client, an Initializer must not
+// be shared by several Clients. It defaults to no metrics.
+func WithMetrics(m metrics.Initializer) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.metrics = m
 		default:
 			panic("unknown type")
 		}
 	})
 }
 
-// Read queries the LogCache and returns the given envelopes. To override any
-// query defaults (e.g., end time), use the according option.
-func (c *Client) Read(
-	ctx context.Context,
-	sourceID string,
-	start time.Time,
-	opts ...ReadOption,
-) ([]*loggregator_v2.Envelope, error) {
-	if c.grpcClient != nil {
-		return c.grpcRead(ctx, sourceID, start, opts)
+// WithOwnMetrics configures the Client to publish the metrics described in
+// WithMetrics to a registry of its own. The registry is served by the
+// MetricsHandler.
+func WithOwnMetrics() ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			m := metrics.New()
+			c.metrics = m
+			c.metricsHandler = m
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// MetricsHandler returns the handler that serves the metrics of the Client
+// in the prometheus format. It returns nil unless the Client is configured
+// WithOwnMetrics.
+func (c *Client) MetricsHandler() http.Handler {
+	return c.metricsHandler
+}
+
+func (c *Client) initMetrics() {
+	m := c.metrics
+	if m == nil {
+		m = metrics.NullMetrics{}
+	}
+
+	c.incRequests = m.NewCounter("client_requests")
+	c.incErrors = m.NewCounter("client_errors")
+	c.requestDuration = m.NewHistogram("client_request_duration_seconds", "seconds", nil, nil)
+}
+
+func (c *Client) recordRequest(dur time.Duration, failed bool) {
+	c.incRequests(1)
+	if failed {
+		c.incErrors(1)
+	}
+	c.requestDuration(dur.Seconds())
+}
+
+// RetryOption configures WithRetry.
+type RetryOption interface {
+	configureRetry(*retryConfig)
+}
+
+type retryConfig struct {
+	maxAttempts   int
+	strategy      BackoffStrategy
+	maxRetryAfter time.Duration
+}
+
+type retryOptionFunc func(*retryConfig)
+
+func (f retryOptionFunc) configureRetry(c *retryConfig) {
+	f(c)
+}
+
+// WithMaxRetryAfter caps how long WithRetry waits for the Retry-After
+// header of a response. It defaults to 30s.
+func WithMaxRetryAfter(d time.Duration) RetryOption {
+	return retryOptionFunc(func(c *retryConfig) {
+		c.maxRetryAfter = d
+	})
+}
+
+// WithRetry configures the Client to retry calls that failed without a
+// response, returned a 429, 502, 503 or 504 status code, or a gRPC
+// Unavailable status code. A call is attempted up to maxAttempts times in
+// total. The wait between attempts defaults to an ExponentialBackoff with
+// jitter from 100ms up to 5s, and can be set via WithBackoff. As the
+// BackoffStrategy is shared by every call, it must be safe for concurrent
+// use, and its Reset is never invoked. A response with a Retry-After
+// header (in seconds or as an HTTP date) is instead followed by a wait of
+// the given duration, capped via WithMaxRetryAfter. It defaults to not
+// retrying.
+func WithRetry(maxAttempts int, opts ...RetryOption) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.retry = &retryConfig{
+				maxAttempts:   maxAttempts,
+				strategy:      NewExponentialBackoff(100*time.Millisecond, 5*time.Second),
+				maxRetryAfter: 30 * time.Second,
+			}
+			for _, o := range opts {
+				o.configureRetry(c.retry)
+			}
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// retryable reports whether the given attempt is to be followed by another
+// one. If so, it waits for the backoff before it returns. A non-negative
+// retryAfter is waited for instead of the backoff.
+func (c *Client) retryable(ctx context.Context, attempt int, failed bool, retryAfter time.Duration) bool {
+	if c.retry == nil {
+		return false
+	}
+
+	if !failed || attempt+1 >= c.retry.maxAttempts || ctx.Err() != nil {
+		return false
+	}
+
+	if retryAfter >= 0 {
+		if retryAfter > c.retry.maxRetryAfter {
+			retryAfter = c.retry.maxRetryAfter
+		}
+		return sleep(ctx, retryAfter)
+	}
+
+	return sleep(ctx, c.retry.strategy.Next(attempt))
+}
+
+// parseRetryAfter returns the duration of the given Retry-After header. It
+// is either given in seconds or as an HTTP date. It returns -1 for an
+// absent or invalid header.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return -1
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return -1
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return -1
+	}
+
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// do sends the given request, and retries it if configured WithRetry.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.doOnce(req)
+
+		failed := err != nil
+		retryAfter := time.Duration(-1)
+		if resp != nil {
+			switch resp.StatusCode {
+			case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				failed = true
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			}
+		}
+
+		if !c.retryable(req.Context(), attempt, failed, retryAfter) {
+			if resp != nil && c.maxResponseBytes > 0 {
+				resp.Body = newLimitedBody(resp.Body, c.maxResponseBytes)
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// doOnce sends the given request and records it in the metrics and the
+// debug logger.
+func (c *Client) doOnce(req *http.Request) (*http.Response, error) {
+	if c.unixSocketErr != nil {
+		return nil, c.unixSocketErr
+	}
+
+	if c.h2cErr != nil {
+		return nil, c.h2cErr
+	}
+
+	var rawReq []byte
+	if c.capture != nil {
+		var err error
+		if rawReq, err = httputil.DumpRequestOut(req, true); err != nil {
+			return nil, err
+		}
 	}
 
-	u, err := url.Parse(c.addr)
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	dur := time.Since(start)
+
+	if c.capture != nil {
+		if err := c.captureHTTP(rawReq, resp); err != nil {
+			return nil, err
+		}
+	}
+
+	var statusCode int
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	c.recordRequest(dur, statusCode != http.StatusOK)
+
+	if c.debugLogger != nil {
+		c.debugLogger(req.Method, req.URL.String(), statusCode, dur)
+	}
+
+	return resp, err
+}
+
+// captureHTTP buffers the body of the given response to pass it to the
+// capture function along with the given request.
+func (c *Client) captureHTTP(rawReq []byte, resp *http.Response) error {
+	if resp == nil {
+		c.capture(rawReq, nil)
+		return nil
+	}
+
+	// Reading one byte more than the max keeps the limitedBody of do able to
+	// tell that the body is too large.
+	var body io.Reader = resp.Body
+	if c.maxResponseBytes > 0 {
+		body = io.LimitReader(resp.Body, c.maxResponseBytes+1)
+	}
+
+	rawResp, err := ioutil.ReadAll(body)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(rawResp), resp.Body}
+	c.capture(rawReq, rawResp)
+
+	return nil
+}
+
+// captureGRPC passes the protobuf encoded request and response messages to
+// the capture function.
+func (c *Client) captureGRPC(req, reply interface{}, err error) {
+	var rawReq, rawResp []byte
+	if m, ok := req.(proto.Message); ok {
+		rawReq, _ = proto.Marshal(m)
+	}
+	if m, ok := reply.(proto.Message); ok && err == nil {
+		rawResp, _ = proto.Marshal(m)
+	}
+
+	c.capture(rawReq, rawResp)
+}
+
+func (c *Client) interceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if c.unixSocketErr != nil {
+		return c.unixSocketErr
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		dur := time.Since(start)
+		c.recordRequest(dur, err != nil)
+
+		if c.grpcDebugLogger != nil {
+			c.grpcDebugLogger(method, status.Code(err), dur)
+		}
+
+		if c.capture != nil {
+			c.captureGRPC(req, reply, err)
+		}
+
+		if !c.retryable(ctx, attempt, err != nil && status.Code(err) == codes.Unavailable, -1) {
+			return err
+		}
+	}
+}
+
+// ErrShutdown is returned by calls made after Shutdown was invoked.
+var ErrShutdown = errors.New("client is shut down")
+
+// Shutdown cancels every in-flight call and waits for them to return, or
+// for the given context to be done. Any gRPC connection the client dialed is
+// closed. Calls made after Shutdown return ErrShutdown.
+func (c *Client) Shutdown(ctx context.Context) error {
+	drained := c.inFlight.shutdown()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if c.grpcConn != nil {
+		if closeErr := c.grpcConn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// requestRegistry tracks in-flight calls so they can be cancelled at once.
+type requestRegistry struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	nextID   uint64
+	cancels  map[uint64]context.CancelFunc
+	shutDown bool
+}
+
+// track registers a call. The returned context is cancelled on shutdown and
+// the returned func must be invoked once the call returned.
+func (r *requestRegistry) track(ctx context.Context) (context.Context, func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.shutDown {
+		return nil, nil, ErrShutdown
+	}
+
+	if r.cancels == nil {
+		r.cancels = make(map[uint64]context.CancelFunc)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	id := r.nextID
+	r.nextID++
+	r.cancels[id] = cancel
+	r.wg.Add(1)
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.cancels, id)
+		r.mu.Unlock()
+
+		cancel()
+		r.wg.Done()
+	}, nil
+}
+
+// shutdown cancels every tracked call. The returned channel is closed once
+// every call returned.
+func (r *requestRegistry) shutdown() <-chan struct{} {
+	r.mu.Lock()
+	r.shutDown = true
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+	r.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(drained)
+	}()
+
+	return drained
+}
+
+// WithRequestIDFromContext extracts a request ID from the context of each
+// call with the given key. The request ID is sent as the X-Request-ID header
+// on HTTP requests, and is included in the errors returned by Read, Meta and
+// the PromQL methods. The value stored in the context must be a string or a
+// fmt.Stringer. It defaults to not extracting a request ID.
+func WithRequestIDFromContext(key interface{}) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.requestIDKey = key
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithMaxErrorBodyBytes sets how many bytes of the response body are
+// included in a RequestError. It defaults to 1024.
+func WithMaxErrorBodyBytes(n int) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.maxErrorBodyBytes = int64(n)
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithMaxResponseBytes sets the maximum size of a response body. Reading a
+// larger body fails with ErrResponseTooLarge. It defaults to 64 MiB.
+func WithMaxResponseBytes(n int64) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.maxResponseBytes = n
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// ErrResponseTooLarge is returned when a response body exceeds the maximum
+// size (see WithMaxResponseBytes).
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// limitedBody fails with ErrResponseTooLarge once more than max bytes are
+// read.
+type limitedBody struct {
+	io.Reader
+	io.Closer
+
+	max  int64
+	read int64
+}
+
+func newLimitedBody(body io.ReadCloser, max int64) *limitedBody {
+	return &limitedBody{
+		Reader: io.LimitReader(body, max+1),
+		Closer: body,
+		max:    max,
+	}
+}
+
+// Read implements io.Reader.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if b.read+int64(n) > b.max {
+		n = int(b.max - b.read)
+		b.read = b.max
+		return n, ErrResponseTooLarge
+	}
+	b.read += int64(n)
+
+	return n, err
+}
+
+// RequestError is returned when LogCache responds with an unexpected status
+// code. The response body often contains the actual reason.
+type RequestError struct {
+	StatusCode int
+
+	// Body is the response body. It is truncated to the configured maximum
+	// (see WithMaxErrorBodyBytes).
+	Body []byte
+}
+
+// Error implements error.
+func (e *RequestError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Body)
+}
+
+// requestError reads the (truncated) body of the given response into a
+// RequestError. Closing the body is left to the caller.
+func (c *Client) requestError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxErrorBodyBytes))
+
+	return &RequestError{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}
+}
+
+// APIVersion selects the paths that are used to read from LogCache.
+type APIVersion int
+
+const (
+	// APIv1Legacy selects the paths used by LogCache versions before the
+	// API moved (e.g., /v1/read).
+	APIv1Legacy APIVersion = iota + 1
+
+	// APIv1 selects the current paths (e.g., /api/v1/read).
+	APIv1
+)
+
+// WithInfoPath sets the path of LogCache's info endpoint, which is used by
+// LogCacheVersion and LogCacheVMUptime, and to detect the API version. The
+// endpoint has to respond like LogCache's. This is useful behind a proxy
+// that moves the info endpoint, but not the others. It defaults to
+// /api/v1/info.
+func WithInfoPath(path string) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.infoPath = path
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithAPIVersion forces the client to use the given API version instead of
+// probing LogCache's info endpoint to detect it. This is useful to test
+// against a specific version or to talk to a proxy that does not expose the
+// info endpoint. It defaults to detecting the version.
+func WithAPIVersion(v APIVersion) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			switch v {
+			case APIv1Legacy:
+				c.baseApiPath = "/v1"
+			case APIv1:
+				c.baseApiPath = "/api/v1"
+			default:
+				panic(fmt.Sprintf("unknown API version: %d", v))
+			}
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithFallbackOn404 configures the Client to retry a read or meta request
+// against the legacy path (e.g., /v1/read) if the current path (e.g.,
+// /api/v1/read) responds with 404 Not Found. This is useful behind a proxy
+// that exposes the info endpoint, but routes only the legacy paths. Other
+// status codes are not retried. It defaults to not retrying.
+func WithFallbackOn404() ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.fallbackOn404 = true
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithDefaultReadOptions sets ReadOptions that are applied to every read,
+// including the reads of LastN, Walk and the like. They are applied before
+// the options given to the read, so a given option overrides a default
+// that sets the same query parameter (e.g., WithLimit). Options that add to
+// a parameter (e.g., WithEnvelopeTypes) add to the default instead.
+func WithDefaultReadOptions(opts ...ReadOption) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.defaultReadOpts = append([]ReadOption(nil), opts...)
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithDefaultPromQLOptions sets PromQLOptions that are applied to every
+// PromQL query. Like WithDefaultReadOptions, they are applied before the
+// options given to the query, which therefore override them.
+func WithDefaultPromQLOptions(opts ...PromQLOption) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.defaultPromQLOpts = append([]PromQLOption(nil), opts...)
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// readOptions returns the given options preceded by the default ones (see
+// WithDefaultReadOptions).
+func (c *Client) readOptions(opts []ReadOption) []ReadOption {
+	if len(c.defaultReadOpts) == 0 {
+		return opts
+	}
+
+	return append(c.defaultReadOpts[:len(c.defaultReadOpts):len(c.defaultReadOpts)], opts...)
+}
+
+// promQLOptions returns the given options preceded by the default ones
+// (see WithDefaultPromQLOptions).
+func (c *Client) promQLOptions(opts []PromQLOption) []PromQLOption {
+	if len(c.defaultPromQLOpts) == 0 {
+		return opts
+	}
+
+	return append(c.defaultPromQLOpts[:len(c.defaultPromQLOpts):len(c.defaultPromQLOpts)], opts...)
+}
+
+// Read queries the LogCache and returns the given envelopes. To override any
+// query defaults (e.g., end time), use the according option.
+func (c *Client) Read(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	opts ...ReadOption,
+) (_ []*loggregator_v2.Envelope, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	opts = c.readOptions(opts)
+
+	var envelopes []*loggregator_v2.Envelope
+	if c.readGroup != nil {
+		envelopes, err = c.sharedRead(ctx, sourceID, start, opts)
+	} else {
+		envelopes, err = c.read(ctx, sourceID, start, opts)
+	}
+
+	if err == nil && len(envelopes) == 0 && c.emptyResultError {
+		return nil, ErrNoData
+	}
+
+	return envelopes, err
+}
+
+// sharedRead collapses concurrent identical reads into a single read (see
+// WithSingleFlight).
+func (c *Client) sharedRead(ctx context.Context, sourceID string, start time.Time, opts []ReadOption) ([]*loggregator_v2.Envelope, error) {
+	// The key consists of every parameter of the read. Client side
+	// parameters are resolved later, and therefore part of the query.
+	u := &url.URL{}
+	q := u.Query()
+	for _, o := range opts {
+		o(u, q)
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%s", sourceID, start.UnixNano(), q.Encode())
+
+	v, err, _ := c.readGroup.Do(key, func() (interface{}, error) {
+		return c.read(ctx, sourceID, start, opts)
+	})
+
+	// The envelopes are kept along with ErrBudgetExceeded.
+	envelopes, _ := v.([]*loggregator_v2.Envelope)
+	return envelopes, err
+}
+
+func (c *Client) read(ctx context.Context, sourceID string, start time.Time, opts []ReadOption) ([]*loggregator_v2.Envelope, error) {
+	if c.grpcClient != nil {
+		return c.grpcRead(ctx, sourceID, start, opts)
+	}
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	baseApiPath, err := c.getBaseApiPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The source ID is a single path segment, even if it contains a slash.
+	u.Path = fmt.Sprintf("%s/read/%s", baseApiPath, sourceID)
+	u.RawPath = fmt.Sprintf("%s/read/%s", baseApiPath, url.PathEscape(sourceID))
+	q := u.Query()
+	q.Set("start_time", strconv.FormatInt(start.UnixNano(), 10))
+
+	// allow the given options to configure the URL.
+	for _, o := range opts {
+		o(u, q)
+	}
+
+	params, err := resolveReadParams(start, q)
+	if err != nil {
+		return nil, err
+	}
+	c.clampLimit(q)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.requestError(resp)
+	}
+
+	var r logcache_v1.ReadResponse
+	if err := c.decoder.DecodeRead(resp.Body, &r); err != nil {
+		return nil, err
+	}
+
+	return params.budget(params.downsample(c.filterEnvelopes(params, r.GetEnvelopes().GetBatch())))
+}
+
+// ReadBytes reads like Read, but returns the envelopes as a protobuf
+// encoded logcache_v1.ReadResponse, e.g. to store them in a cache and
+// replay them later via UnmarshalReadResponse. The envelopes are encoded
+// after the client side options (e.g., WithNonEmptyPayloads) are applied.
+func (c *Client) ReadBytes(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	opts ...ReadOption,
+) ([]byte, error) {
+	envelopes, err := c.Read(ctx, sourceID, start, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&logcache_v1.ReadResponse{
+		Envelopes: &loggregator_v2.EnvelopeBatch{Batch: envelopes},
+	})
+}
+
+// UnmarshalReadResponse decodes a read response returned by ReadBytes.
+func UnmarshalReadResponse(b []byte) (*logcache_v1.ReadResponse, error) {
+	var resp logcache_v1.ReadResponse
+	if err := proto.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// LastN returns the most recent n envelopes of the given source ID in
+// chronological order. If the source has fewer than n envelopes, all of them
+// are returned. The given options are applied before the descending order
+// and limit LastN relies on, and therefore can't override them. If n
+// exceeds the limit set via WithMaxLimit, the envelopes are read in pages of
+// that limit. A budget set via WithMaxBytes spans all pages, and the most
+// recent envelopes within it are returned along with ErrBudgetExceeded.
+func (c *Client) LastN(
+	ctx context.Context,
+	sourceID string,
+	n int,
+	opts ...ReadOption,
+) ([]*loggregator_v2.Envelope, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be positive: %d", n)
+	}
+
+	// The full slice expression keeps append from writing into the
+	// caller's array.
+	opts = opts[:len(opts):len(opts)]
+
+	// The budget set via WithMaxBytes spans all pages.
+	u := &url.URL{}
+	q := u.Query()
+	for _, o := range c.readOptions(opts) {
+		o(u, q)
+	}
+	maxBytes, _ := strconv.ParseInt(q.Get(maxBytesParam), 10, 64)
+
+	var (
+		envelopes []*loggregator_v2.Envelope
+		budgetErr error
+	)
+	pageOpts := opts
+	for len(envelopes) < n {
+		limit := n - len(envelopes)
+		if c.maxLimit > 0 && limit > c.maxLimit {
+			limit = c.maxLimit
+		}
+
+		readOpts := append(pageOpts, WithDescending(), WithLimit(limit))
+		if maxBytes > 0 {
+			readOpts = append(readOpts, WithMaxBytes(maxBytes))
+		}
+
+		page, err := c.Read(ctx, sourceID, time.Unix(0, 0), readOpts...)
+		if err != nil && !errors.Is(err, ErrBudgetExceeded) {
+			return nil, err
+		}
+
+		if len(page) > limit {
+			page = page[:limit]
+		}
+		envelopes = append(envelopes, page...)
+
+		if err != nil {
+			budgetErr = err
+			break
+		}
+
+		if len(page) < limit {
+			break
+		}
+
+		if maxBytes > 0 {
+			for _, e := range page {
+				maxBytes -= int64(proto.Size(e))
+			}
+			if maxBytes <= 0 {
+				budgetErr = ErrBudgetExceeded
+				break
+			}
+		}
+
+		// The end time is exclusive, so the next page starts right before
+		// the oldest envelope of this one.
+		oldest := page[len(page)-1].GetTimestamp()
+		pageOpts = append(opts, WithEndTime(time.Unix(0, oldest)))
+	}
+
+	for i, j := 0, len(envelopes)-1; i < j; i, j = i+1, j-1 {
+		envelopes[i], envelopes[j] = envelopes[j], envelopes[i]
+	}
+
+	return envelopes, budgetErr
+}
+
+// ReadSince reads the envelopes of the given source ID from the given
+// checkpoint on. It returns the envelopes and the checkpoint to pass to the
+// next ReadSince, which is right after the newest envelope. Without any
+// envelope, the given checkpoint is returned. Persisting the checkpoint
+// allows a reader to resume where it stopped.
+func (c *Client) ReadSince(
+	ctx context.Context,
+	sourceID string,
+	checkpoint time.Time,
+	opts ...ReadOption,
+) ([]*loggregator_v2.Envelope, time.Time, error) {
+	envelopes, err := c.Read(ctx, sourceID, checkpoint, opts...)
+	if err != nil {
+		return nil, checkpoint, err
+	}
+
+	next := checkpoint
+	for _, e := range envelopes {
+		if t := time.Unix(0, e.GetTimestamp()+1); t.After(next) {
+			next = t
+		}
+	}
+
+	return envelopes, next, nil
+}
+
+// readSourcesConcurrency is the maximum number of concurrent reads of
+// ReadSources and ReadGlob.
+const readSourcesConcurrency = 10
+
+// SourceErrors is returned by ReadSources and ReadGlob if some of the
+// sources could not be read. It maps each of these source IDs to its error.
+type SourceErrors map[string]error
+
+// Error implements error.
+func (e SourceErrors) Error() string {
+	sourceIDs := make([]string, 0, len(e))
+	for sourceID := range e {
+		sourceIDs = append(sourceIDs, sourceID)
+	}
+	sort.Strings(sourceIDs)
+
+	msgs := make([]string, 0, len(sourceIDs))
+	for _, sourceID := range sourceIDs {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", sourceID, e[sourceID]))
+	}
+
+	return fmt.Sprintf("failed to read %d source(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ReadGlob reads the envelopes of every source ID that matches the given
+// pattern, and returns them by source ID. The pattern uses the syntax of
+// path.Match (e.g., "app-foo-*"). The source IDs are resolved via Meta, and
+// therefore from the cache configured via WithMetaCache. The matching
+// sources are read like ReadSources does.
+func (c *Client) ReadGlob(
+	ctx context.Context,
+	pattern string,
+	start time.Time,
+	opts ...ReadOption,
+) (map[string][]*loggregator_v2.Envelope, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	meta, err := c.Meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var sourceIDs []string
+	for sourceID := range meta {
+		if ok, _ := path.Match(pattern, sourceID); ok {
+			sourceIDs = append(sourceIDs, sourceID)
+		}
+	}
+
+	return c.ReadSources(ctx, sourceIDs, start, opts...)
+}
+
+// ReadSources reads the envelopes of each of the given source IDs, and
+// returns them by source ID. LogCache reads a single source per request, so
+// up to 10 sources are read concurrently, each with the given start time
+// and options.
+//
+// If some of the sources could not be read, ReadSources returns the
+// envelopes of the other sources together with SourceErrors.
+func (c *Client) ReadSources(
+	ctx context.Context,
+	sourceIDs []string,
+	start time.Time,
+	opts ...ReadOption,
+) (map[string][]*loggregator_v2.Envelope, error) {
+	type result struct {
+		sourceID  string
+		envelopes []*loggregator_v2.Envelope
+		err       error
+	}
+
+	results := make(chan result, len(sourceIDs))
+	sem := make(chan struct{}, readSourcesConcurrency)
+	for _, sourceID := range sourceIDs {
+		go func(sourceID string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			envelopes, err := c.Read(ctx, sourceID, start, opts...)
+			results <- result{sourceID: sourceID, envelopes: envelopes, err: err}
+		}(sourceID)
+	}
+
+	envelopes := make(map[string][]*loggregator_v2.Envelope)
+	sourceErrs := make(SourceErrors)
+	for range sourceIDs {
+		r := <-results
+		if r.err != nil {
+			sourceErrs[r.sourceID] = r.err
+			continue
+		}
+
+		envelopes[r.sourceID] = r.envelopes
+	}
+
+	if len(sourceErrs) > 0 {
+		return envelopes, sourceErrs
+	}
+
+	return envelopes, nil
+}
+
+// WithEmptyResultError configures Read to return ErrNoData instead of an
+// empty result. This tells an empty result apart from a successful read,
+// e.g., to alert on a source that stopped emitting. Note that Walk treats
+// ErrNoData like any other error, while ReadChan keeps polling. It
+// defaults to returning an empty result.
+func WithEmptyResultError() ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.emptyResultError = true
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithSingleFlight configures the Client to collapse concurrent reads of the
+// same source with the same start time and options into a single read. Each
+// caller gets the same result, and therefore must not modify it. As the read
+// is made with the context of the first caller, cancelling it fails the read
+// of every caller. It defaults to reading for each caller.
+func WithSingleFlight() ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.readGroup = &singleflight.Group{}
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// WithMaxLimit sets the maximum limit of a read. A larger limit given via
+// WithLimit is lowered to it, which is logged via WithLogger. LogCache caps
+// the limit at 1000 envelopes, so this makes the cap visible to the client.
+// LastN and ReadChan read in pages of the maximum limit. It defaults to no
+// maximum.
+func WithMaxLimit(n int) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.maxLimit = n
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// clampLimit lowers the limit query parameter to the maximum limit.
+func (c *Client) clampLimit(q url.Values) {
+	if c.maxLimit <= 0 {
+		return
+	}
+
+	v, ok := q["limit"]
+	if !ok {
+		return
+	}
+
+	// resolveReadParams already validated the limit.
+	limit, _ := strconv.Atoi(v[0])
+	if limit <= c.maxLimit {
+		return
+	}
+
+	q.Set("limit", strconv.Itoa(c.maxLimit))
+	c.log.Printf("limit %d lowered to the max limit %d", limit, c.maxLimit)
+}
+
+// ReadOption configures the URL that is used to submit the query. The
+// RawQuery is set to the decoded query parameters after each option is
+// invoked.
+type ReadOption func(u *url.URL, q url.Values)
+
+// WithEndTime sets the 'end_time' query parameter to the given time. It
+// defaults to empty, and therefore the end of the cache.
+func WithEndTime(t time.Time) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set("end_time", strconv.FormatInt(t.UnixNano(), 10))
+	}
+}
+
+// WithLimit sets the 'limit' query parameter to the given value. It
+// defaults to empty, and therefore the server's default (100 envelopes). As
+// LogCache versions disagree on the meaning of a limit of 0, the limit must
+// be positive, otherwise Read returns an error.
+func WithLimit(limit int) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+}
+
+// WithServerDefaultLimit removes the 'limit' query parameter, and therefore
+// explicitly requests the server's default limit. It overrides any previous
+// WithLimit.
+func WithServerDefaultLimit() ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Del("limit")
+	}
+}
+
+// WithEnvelopeTypes sets the 'envelope_types' query parameter to the given
+// value. It defaults to empty, and therefore any envelope type.
+func WithEnvelopeTypes(t ...logcache_v1.EnvelopeType) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		for _, v := range t {
+			q.Add("envelope_types", v.String())
+		}
+	}
+}
+
+// WithDescending set the 'descending' query parameter to true. It defaults to
+// false, yielding ascending order.
+func WithDescending() ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set("descending", "true")
+	}
+}
+
+func WithNameFilter(nameFilter string) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set("name_filter", nameFilter)
+	}
+}
+
+// WithRelativeStart sets the 'start_time' query parameter to the given
+// duration before the time the read is made. The start time passed to Read
+// must be the zero time.Time, otherwise Read returns an error.
+func WithRelativeStart(d time.Duration) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(relativeStartParam, d.String())
+	}
+}
+
+// WithRelativeEnd sets the 'end_time' query parameter to the given duration
+// before the time the read is made. It can not be combined with WithEndTime.
+func WithRelativeEnd(d time.Duration) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(relativeEndParam, d.String())
+	}
+}
+
+// WithNonEmptyPayloads filters out log envelopes with an empty payload
+// (e.g., heartbeats) after they have been read. Other envelope types are
+// left untouched. The number of filtered envelopes is reported to the
+// callback configured via WithFilteredEnvelopesCallback.
+func WithNonEmptyPayloads() ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(nonEmptyPayloadsParam, "true")
+	}
+}
+
+// WithAsOf bounds a read to the envelopes up to and including the given
+// time, e.g. to read several sources consistently as of a single moment.
+// It sets the end time accordingly, unless an earlier end time is set. As
+// LogCache keeps ingesting envelopes, the bound is also enforced after the
+// envelopes have been read, so that paging (e.g., via LastN) never returns
+// envelopes that arrived later.
+func WithAsOf(t time.Time) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(asOfParam, strconv.FormatInt(t.UnixNano(), 10))
+	}
+}
+
+// WithLogStream filters out log envelopes of the other log stream after
+// they have been read, e.g. to only keep the ERR lines. Other envelope
+// types are left untouched, so combine it with WithEnvelopeTypes to only
+// read logs. The number of filtered envelopes is reported to the callback
+// configured via WithFilteredEnvelopesCallback.
+func WithLogStream(stream loggregator_v2.Log_Type) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(logStreamParam, stream.String())
+	}
+}
+
+// WithStep downsamples gauge envelopes to one per step: of the envelopes of
+// a gauge within a step, only the newest is kept and its timestamp is
+// aligned to the start of the step. Steps are aligned to the Unix epoch.
+// Other envelope types are left untouched. LogCache does not downsample, so
+// this is done after the envelopes have been read and the full data is
+// still transferred. Use it to render long windows with fewer points.
+func WithStep(d time.Duration) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(stepParam, d.String())
+	}
+}
+
+// ErrBudgetExceeded is returned along with the envelopes read so far once
+// the budget set via WithMaxBytes is exceeded.
+var ErrBudgetExceeded = errors.New("byte budget exceeded")
+
+// WithMaxBytes bounds the size of the envelopes a read returns to the given
+// number of bytes, e.g. to cap the memory of an interactive tool. Once the
+// envelopes exceed it, the remaining ones are dropped and ErrBudgetExceeded
+// is returned along with the envelopes within the budget. LastN stops
+// paging once the budget of all its pages is exceeded. The size is
+// estimated via the protobuf encoded size of each envelope, and therefore
+// is neither the size on the wire nor in memory.
+func WithMaxBytes(n int64) ReadOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set(maxBytesParam, strconv.FormatInt(n, 10))
+	}
+}
+
+// WithFilteredEnvelopesCallback sets a callback that is invoked with the
+// number of envelopes that were filtered out by client side ReadOptions
+// (e.g., WithNonEmptyPayloads). It is invoked once per read that applied a
+// client side filter. It defaults to not reporting.
+func WithFilteredEnvelopesCallback(f func(filtered int)) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.onFiltered = f
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// Some ReadOptions configure the client instead of LogCache. They are set
+// like any other query parameter, but are resolved and removed before a
+// request is made.
+const (
+	relativeStartParam    = "_relative_start"
+	relativeEndParam      = "_relative_end"
+	nonEmptyPayloadsParam = "_non_empty_payloads"
+	stepParam             = "_step"
+	logStreamParam        = "_log_stream"
+	asOfParam             = "_as_of"
+	maxBytesParam         = "_max_bytes"
+)
+
+// readParams are the resolved client side query parameters.
+type readParams struct {
+	nonEmptyPayloads bool
+	logStream        *loggregator_v2.Log_Type
+	asOf             *int64
+	step             time.Duration
+	maxBytes         int64
+}
+
+// filtering reports whether any client side filter is configured.
+func (p readParams) filtering() bool {
+	return p.nonEmptyPayloads || p.logStream != nil || p.asOf != nil
+}
+
+// keep reports whether the given envelope passes the client side filters.
+func (p readParams) keep(e *loggregator_v2.Envelope) bool {
+	if p.nonEmptyPayloads && e.GetLog() != nil && len(e.GetLog().GetPayload()) == 0 {
+		return false
+	}
+
+	if p.logStream != nil && e.GetLog() != nil && e.GetLog().GetType() != *p.logStream {
+		return false
+	}
+
+	if p.asOf != nil && e.GetTimestamp() > *p.asOf {
+		return false
+	}
+
+	return true
+}
+
+// filterEnvelopes applies the client side filters to the given envelopes.
+func (c *Client) filterEnvelopes(p readParams, envelopes []*loggregator_v2.Envelope) []*loggregator_v2.Envelope {
+	if !p.filtering() {
+		return envelopes
+	}
+
+	filtered := envelopes[:0]
+	for _, e := range envelopes {
+		if p.keep(e) {
+			filtered = append(filtered, e)
+		}
+	}
+
+	if c.onFiltered != nil {
+		c.onFiltered(len(envelopes) - len(filtered))
+	}
+
+	return filtered
+}
+
+// downsample keeps the newest envelope of each gauge per step and aligns
+// its timestamp to the start of the step.
+func (p readParams) downsample(envelopes []*loggregator_v2.Envelope) []*loggregator_v2.Envelope {
+	if p.step <= 0 {
+		return envelopes
+	}
+	step := p.step.Nanoseconds()
+
+	index := make(map[string]int)
+	newest := make(map[string]int64)
+	downsampled := envelopes[:0]
+	for _, e := range envelopes {
+		if e.GetGauge() == nil {
+			downsampled = append(downsampled, e)
+			continue
+		}
+
+		key := gaugeStepKey(e, step)
+		if i, ok := index[key]; ok {
+			if e.GetTimestamp() >= newest[key] {
+				downsampled[i] = e
+				newest[key] = e.GetTimestamp()
+			}
+			continue
+		}
+
+		index[key] = len(downsampled)
+		newest[key] = e.GetTimestamp()
+		downsampled = append(downsampled, e)
+	}
+
+	for _, e := range downsampled {
+		if e.GetGauge() != nil {
+			e.Timestamp = stepStart(e.GetTimestamp(), step)
+		}
+	}
+
+	return downsampled
+}
+
+// gaugeStepKey identifies the gauge of the given envelope within its step.
+func gaugeStepKey(e *loggregator_v2.Envelope, step int64) string {
+	names := make([]string, 0, len(e.GetGauge().GetMetrics()))
+	for name := range e.GetGauge().GetMetrics() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("%d/%s/%s/%s", stepStart(e.GetTimestamp(), step), e.GetSourceId(), e.GetInstanceId(), strings.Join(names, ","))
+}
+
+// stepStart returns the start of the step the given timestamp is in.
+func stepStart(ts, step int64) int64 {
+	start := ts - ts%step
+	if ts < 0 && start != ts {
+		start -= step
+	}
+
+	return start
+}
+
+// resolveReadParams resolves the client side query parameters into the
+// query parameters LogCache understands.
+func resolveReadParams(start time.Time, q url.Values) (readParams, error) {
+	var p readParams
+	now := time.Now()
+
+	if v, ok := q["limit"]; ok {
+		limit, err := strconv.Atoi(v[0])
+		if err != nil || limit <= 0 {
+			return p, fmt.Errorf("limit must be a positive integer: %s", v[0])
+		}
+	}
+
+	if v, ok := q[relativeStartParam]; ok {
+		if !start.IsZero() {
+			return p, errors.New("a relative start can not be combined with a start time")
+		}
+
+		d, err := time.ParseDuration(v[0])
+		if err != nil {
+			return p, err
+		}
+
+		q.Set("start_time", strconv.FormatInt(now.Add(-d).UnixNano(), 10))
+		q.Del(relativeStartParam)
+	}
+
+	if v, ok := q[relativeEndParam]; ok {
+		if _, ok := q["end_time"]; ok {
+			return p, errors.New("a relative end can not be combined with an end time")
+		}
+
+		d, err := time.ParseDuration(v[0])
+		if err != nil {
+			return p, err
+		}
+
+		q.Set("end_time", strconv.FormatInt(now.Add(-d).UnixNano(), 10))
+		q.Del(relativeEndParam)
+	}
+
+	if v, ok := q[asOfParam]; ok {
+		asOf, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil {
+			return p, err
+		}
+		p.asOf = &asOf
+		q.Del(asOfParam)
+
+		// The end time is exclusive.
+		end, err := strconv.ParseInt(q.Get("end_time"), 10, 64)
+		if err != nil || end > asOf+1 {
+			q.Set("end_time", strconv.FormatInt(asOf+1, 10))
+		}
+	}
+
+	if _, ok := q[nonEmptyPayloadsParam]; ok {
+		p.nonEmptyPayloads = true
+		q.Del(nonEmptyPayloadsParam)
+	}
+
+	if v, ok := q[logStreamParam]; ok {
+		t, ok := loggregator_v2.Log_Type_value[v[0]]
+		if !ok {
+			return p, fmt.Errorf("unknown log stream: %s", v[0])
+		}
+
+		stream := loggregator_v2.Log_Type(t)
+		p.logStream = &stream
+		q.Del(logStreamParam)
+	}
+
+	if v, ok := q[stepParam]; ok {
+		d, err := time.ParseDuration(v[0])
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("step must be a positive duration: %s", v[0])
+		}
+
+		p.step = d
+		q.Del(stepParam)
+	}
+
+	if v, ok := q[maxBytesParam]; ok {
+		n, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("max bytes must be a positive integer: %s", v[0])
+		}
+
+		p.maxBytes = n
+		q.Del(maxBytesParam)
+	}
+
+	return p, nil
+}
+
+// budget drops the envelopes beyond the max bytes and returns
+// ErrBudgetExceeded if any were dropped.
+func (p readParams) budget(envelopes []*loggregator_v2.Envelope) ([]*loggregator_v2.Envelope, error) {
+	if p.maxBytes <= 0 {
+		return envelopes, nil
+	}
+
+	var size int64
+	for i, e := range envelopes {
+		size += int64(proto.Size(e))
+		if size > p.maxBytes {
+			return envelopes[:i], ErrBudgetExceeded
+		}
+	}
+
+	return envelopes, nil
+}
+
+func (c *Client) grpcRead(ctx context.Context, sourceID string, start time.Time, opts []ReadOption) ([]*loggregator_v2.Envelope, error) {
+	u := &url.URL{}
+	q := u.Query()
+	q.Set("start_time", strconv.FormatInt(start.UnixNano(), 10))
+
+	// allow the given options to configure the URL.
+	for _, o := range opts {
+		o(u, q)
+	}
+
+	params, err := resolveReadParams(start, q)
+	if err != nil {
+		return nil, err
+	}
+	c.clampLimit(q)
+
+	req := &logcache_v1.ReadRequest{
+		SourceId: sourceID,
+	}
+
+	req.StartTime, _ = strconv.ParseInt(q.Get("start_time"), 10, 64)
+
+	if v, ok := q["limit"]; ok {
+		req.Limit, _ = strconv.ParseInt(v[0], 10, 64)
+	}
+
+	if v, ok := q["end_time"]; ok {
+		req.EndTime, _ = strconv.ParseInt(v[0], 10, 64)
+	}
+
+	for _, et := range q["envelope_types"] {
+		req.EnvelopeTypes = append(req.EnvelopeTypes,
+			logcache_v1.EnvelopeType(logcache_v1.EnvelopeType_value[et]),
+		)
+	}
+
+	if v, ok := q["name_filter"]; ok {
+		req.NameFilter = v[0]
+	}
+
+	if _, ok := q["descending"]; ok {
+		req.Descending = true
+	}
+
+	resp, err := c.grpcClient.Read(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return params.budget(params.downsample(c.filterEnvelopes(params, resp.Envelopes.Batch)))
+}
+
+// WithMetaCache configures the Client to cache the result of Meta for the
+// given TTL. Once the TTL expires, Meta returns the cached result and
+// refreshes it in the background. Use MetaFresh to bypass the cache. It
+// defaults to no caching.
+func WithMetaCache(ttl time.Duration) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.metaCache = &metaCache{ttl: ttl}
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// Meta returns meta information from the entire LogCache. If the Client is
+// configured WithMetaCache, the result may be cached and is shared with
+// other callers, so it must not be modified.
+func (c *Client) Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
+	if c.metaCache == nil {
+		return c.MetaFresh(ctx)
+	}
+
+	return c.metaCache.get(ctx, c.MetaFresh)
+}
+
+// MetaFresh returns meta information from the entire LogCache. It always
+// requests the LogCache and updates the cache configured WithMetaCache.
+func (c *Client) MetaFresh(ctx context.Context) (meta map[string]*logcache_v1.MetaInfo, err error) {
+	defer func() {
+		if err == nil && c.metaCache != nil {
+			c.metaCache.set(meta)
+		}
+	}()
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return c.meta(ctx, false)
+}
+
+// meta requests the meta information. If localOnly is set, the LogCache
+// node only returns the meta information of the sources it stores itself.
+func (c *Client) meta(ctx context.Context, localOnly bool) (map[string]*logcache_v1.MetaInfo, error) {
+	if c.grpcClient != nil {
+		return c.grpcMeta(ctx, localOnly)
+	}
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	baseApiPath, err := c.getBaseApiPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = fmt.Sprintf("%s/meta", baseApiPath)
+	if localOnly {
+		u.RawQuery = url.Values{"local_only": {"true"}}.Encode()
+	}
+
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, c.requestError(resp)
+	}
+
+	var metaResponse logcache_v1.MetaResponse
+	if err := c.decoder.DecodeMeta(resp.Body, &metaResponse); err != nil {
+		return nil, err
+	}
+
+	return metaResponse.Meta, nil
+}
+
+// get requests the given URL of the read or meta API. If the current path
+// responds with 404 Not Found, it retries the legacy path (see
+// WithFallbackOn404).
+func (c *Client) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := c.newRequest(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.fallbackOn404 || resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(u.Path, "/api/v1/") {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	legacy := *u
+	legacy.Path = strings.TrimPrefix(u.Path, "/api")
+	legacy.RawPath = strings.TrimPrefix(u.RawPath, "/api")
+
+	req, err = c.newRequest(ctx, legacy.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// newRequest builds a GET request for the given URL that is bound to the
+// given context. The params given to WithExtraQueryParam are added to it.
+func (c *Client) newRequest(ctx context.Context, u string) (*http.Request, error) {
+	u, err := c.addExtraQueryParams(u)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if requestID, ok := c.requestID(ctx); ok {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+
+	return req, nil
+}
+
+func (c *Client) requestID(ctx context.Context) (string, bool) {
+	if c.requestIDKey == nil {
+		return "", false
+	}
+
+	switch v := ctx.Value(c.requestIDKey).(type) {
+	case string:
+		return v, v != ""
+	case fmt.Stringer:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// withRequestID annotates the given error with the request ID of the given
+// context. The original error is still available via errors.Unwrap.
+func (c *Client) withRequestID(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	requestID, ok := c.requestID(ctx)
+	if !ok {
+		return err
+	}
+
+	return &requestIDError{err: err, requestID: requestID}
+}
+
+type requestIDError struct {
+	err       error
+	requestID string
+}
+
+func (e *requestIDError) Error() string {
+	return fmt.Sprintf("%s (request ID: %s)", e.err, e.requestID)
+}
+
+func (e *requestIDError) Unwrap() error {
+	return e.err
+}
+
+// SourceMeta is the meta information of a single source.
+type SourceMeta struct {
+	SourceID        string
+	Count           int64
+	Expired         int64
+	OldestTimestamp time.Time
+	NewestTimestamp time.Time
+}
+
+// MetaSummary returns the meta information from the entire LogCache, sorted
+// by source ID.
+func (c *Client) MetaSummary(ctx context.Context) ([]SourceMeta, error) {
+	meta, err := c.Meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := make([]SourceMeta, 0, len(meta))
+	for sourceID, m := range meta {
+		summary = append(summary, SourceMeta{
+			SourceID:        sourceID,
+			Count:           m.GetCount(),
+			Expired:         m.GetExpired(),
+			OldestTimestamp: time.Unix(0, m.GetOldestTimestamp()),
+			NewestTimestamp: time.Unix(0, m.GetNewestTimestamp()),
+		})
+	}
+
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].SourceID < summary[j].SourceID
+	})
+
+	return summary, nil
+}
+
+// ErrSourceNotFound is returned by MetaFor if LogCache has no envelopes of
+// the given source.
+var ErrSourceNotFound = errors.New("source not found")
+
+// MetaFor returns the meta information of the given source. LogCache only
+// serves the meta information of every source at once, so it is fetched
+// via Meta (and therefore cached if configured WithMetaCache). It returns
+// ErrSourceNotFound if there is none for the given source.
+func (c *Client) MetaFor(ctx context.Context, sourceID string) (*logcache_v1.MetaInfo, error) {
+	meta, err := c.Meta(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	baseApiPath, err := c.getBaseApiPath(ctx)
+	m, ok := meta[sourceID]
+	if !ok {
+		return nil, ErrSourceNotFound
+	}
+
+	return m, nil
+}
+
+func (c *Client) grpcMeta(ctx context.Context, localOnly bool) (map[string]*logcache_v1.MetaInfo, error) {
+	resp, err := c.grpcClient.Meta(ctx, &logcache_v1.MetaRequest{LocalOnly: localOnly})
 	if err != nil {
 		return nil, err
 	}
 
-	u.Path = fmt.Sprintf("%s/read/%s", baseApiPath, sourceID)
-	q := u.Query()
-	q.Set("start_time", strconv.FormatInt(start.UnixNano(), 10))
+	return resp.Meta, nil
+}
 
-	// allow the given options to configure the URL.
-	for _, o := range opts {
-		o(u, q)
+// NodeErrors is returned by MetaAll if some of the nodes could not be
+// queried. It maps the address of each of these nodes to its error.
+type NodeErrors map[string]error
+
+// Error implements error.
+func (e NodeErrors) Error() string {
+	addrs := make([]string, 0, len(e))
+	for addr := range e {
+		addrs = append(addrs, addr)
 	}
-	u.RawQuery = q.Encode()
+	sort.Strings(addrs)
 
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
+	msgs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", addr, e[addr]))
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	return fmt.Sprintf("failed to query %d node(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
+// MetaAll queries the meta information of each of the given LogCache nodes
+// concurrently and merges it. Each node only reports the sources it stores
+// itself. For a source stored on several nodes, the counts are summed up
+// and the timestamps span all of the nodes. The nodes are queried with the
+// configuration of the Client (e.g., via gRPC).
+//
+// If some of the nodes could not be queried, MetaAll returns the merged
+// meta information of the other nodes together with NodeErrors.
+func (c *Client) MetaAll(ctx context.Context, nodeAddrs []string) (_ map[string]*logcache_v1.MetaInfo, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer done()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	type result struct {
+		addr string
+		meta map[string]*logcache_v1.MetaInfo
+		err  error
 	}
 
-	var r logcache_v1.ReadResponse
-	if err := jsonpb.Unmarshal(resp.Body, &r); err != nil {
-		return nil, err
-	}
+	results := make(chan result, len(nodeAddrs))
+	for _, addr := range nodeAddrs {
+		go func(addr string) {
+			node := c.nodeClient(addr)
+			if node.grpcConn != nil {
+				defer node.grpcConn.Close()
+			}
 
-	return r.GetEnvelopes().GetBatch(), nil
-}
+			meta, err := node.meta(ctx, true)
+			results <- result{addr: addr, meta: meta, err: err}
+		}(addr)
+	}
 
-// ReadOption configures the URL that is used to submit the query. The
-// RawQuery is set to the decoded query parameters after each option is
-// invoked.
-type ReadOption func(u *url.URL, q url.Values)
+	merged := make(map[string]*logcache_v1.MetaInfo)
+	nodeErrs := make(NodeErrors)
+	for range nodeAddrs {
+		r := <-results
+		if r.err != nil {
+			nodeErrs[r.addr] = r.err
+			continue
+		}
 
-// WithEndTime sets the 'end_time' query parameter to the given time. It
-// defaults to empty, and therefore the end of the cache.
-func WithEndTime(t time.Time) ReadOption {
-	return func(u *url.URL, q url.Values) {
-		q.Set("end_time", strconv.FormatInt(t.UnixNano(), 10))
+		for sourceID, info := range r.meta {
+			mergeMetaInfo(merged, sourceID, info)
+		}
 	}
-}
 
-// WithLimit sets the 'limit' query parameter to the given value. It
-// defaults to empty, and therefore 100 envelopes.
-func WithLimit(limit int) ReadOption {
-	return func(u *url.URL, q url.Values) {
-		q.Set("limit", strconv.Itoa(limit))
+	if len(nodeErrs) > 0 {
+		return merged, nodeErrs
 	}
+
+	return merged, nil
 }
 
-// WithEnvelopeTypes sets the 'envelope_types' query parameter to the given
-// value. It defaults to empty, and therefore any envelope type.
-func WithEnvelopeTypes(t ...logcache_v1.EnvelopeType) ReadOption {
-	return func(u *url.URL, q url.Values) {
-		for _, v := range t {
-			q.Add("envelope_types", v.String())
+func mergeMetaInfo(merged map[string]*logcache_v1.MetaInfo, sourceID string, info *logcache_v1.MetaInfo) {
+	m, ok := merged[sourceID]
+	if !ok {
+		merged[sourceID] = &logcache_v1.MetaInfo{
+			Count:           info.GetCount(),
+			Expired:         info.GetExpired(),
+			OldestTimestamp: info.GetOldestTimestamp(),
+			NewestTimestamp: info.GetNewestTimestamp(),
 		}
+		return
 	}
-}
 
-// WithDescending set the 'descending' query parameter to true. It defaults to
-// false, yielding ascending order.
-func WithDescending() ReadOption {
-	return func(u *url.URL, q url.Values) {
-		q.Set("descending", "true")
+	m.Count += info.GetCount()
+	m.Expired += info.GetExpired()
+	if info.GetOldestTimestamp() < m.OldestTimestamp {
+		m.OldestTimestamp = info.GetOldestTimestamp()
+	}
+	if info.GetNewestTimestamp() > m.NewestTimestamp {
+		m.NewestTimestamp = info.GetNewestTimestamp()
 	}
 }
 
-func WithNameFilter(nameFilter string) ReadOption {
-	return func(u *url.URL, q url.Values) {
-		q.Set("name_filter", nameFilter)
+// readQuorumConcurrency is the maximum number of nodes ReadQuorum reads
+// from concurrently.
+const readQuorumConcurrency = 10
+
+// ReadQuorum reads the envelopes of the given source ID from each of the
+// given LogCache nodes and returns their union, e.g. to read a source
+// completely while its replicas are rebalanced. Envelopes that several
+// nodes return are deduplicated. The nodes are read with the configuration
+// of the Client and up to 10 of them concurrently. The union is ordered
+// and limited like a single Read with the given options, including the
+// default ones and the maximum limit.
+//
+// Reading fails for a minority of the nodes without an error. Otherwise,
+// ReadQuorum returns the union of the other nodes together with NodeErrors.
+// A node without any envelope (see WithEmptyResultError) has been read.
+func (c *Client) ReadQuorum(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	nodeAddrs []string,
+	opts ...ReadOption,
+) (_ []*loggregator_v2.Envelope, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	if len(nodeAddrs) == 0 {
+		return nil, errors.New("no nodes to read from")
 	}
-}
 
-func (c *Client) grpcRead(ctx context.Context, sourceID string, start time.Time, opts []ReadOption) ([]*loggregator_v2.Envelope, error) {
-	u := &url.URL{}
-	q := u.Query()
-	// allow the given options to configure the URL.
-	for _, o := range opts {
-		o(u, q)
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
-	req := &logcache_v1.ReadRequest{
-		SourceId:  sourceID,
-		StartTime: start.UnixNano(),
+	type result struct {
+		addr      string
+		envelopes []*loggregator_v2.Envelope
+		err       error
 	}
 
-	if v, ok := q["limit"]; ok {
-		req.Limit, _ = strconv.ParseInt(v[0], 10, 64)
+	results := make(chan result, len(nodeAddrs))
+	sem := make(chan struct{}, readQuorumConcurrency)
+	for _, addr := range nodeAddrs {
+		go func(addr string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			node := c.nodeClient(addr)
+			if node.grpcConn != nil {
+				defer node.grpcConn.Close()
+			}
+
+			envelopes, err := node.Read(ctx, sourceID, start, opts...)
+			results <- result{addr: addr, envelopes: envelopes, err: err}
+		}(addr)
 	}
 
-	if v, ok := q["end_time"]; ok {
-		req.EndTime, _ = strconv.ParseInt(v[0], 10, 64)
+	var union []*loggregator_v2.Envelope
+	seen := make(map[int64][]*loggregator_v2.Envelope)
+	nodeErrs := make(NodeErrors)
+	for range nodeAddrs {
+		r := <-results
+		if r.err != nil && !errors.Is(r.err, ErrNoData) {
+			nodeErrs[r.addr] = r.err
+			continue
+		}
+
+		for _, e := range r.envelopes {
+			if containsEnvelope(seen[e.GetTimestamp()], e) {
+				continue
+			}
+
+			seen[e.GetTimestamp()] = append(seen[e.GetTimestamp()], e)
+			union = append(union, e)
+		}
 	}
 
-	for _, et := range q["envelope_types"] {
-		req.EnvelopeTypes = append(req.EnvelopeTypes,
-			logcache_v1.EnvelopeType(logcache_v1.EnvelopeType_value[et]),
-		)
+	q := url.Values{}
+	for _, o := range c.readOptions(opts) {
+		o(&url.URL{}, q)
 	}
+	c.clampLimit(q)
 
-	if v, ok := q["name_filter"]; ok {
-		req.NameFilter = v[0]
+	descending := q.Get("descending") == "true"
+	sort.SliceStable(union, func(i, j int) bool {
+		if descending {
+			return union[i].GetTimestamp() > union[j].GetTimestamp()
+		}
+		return union[i].GetTimestamp() < union[j].GetTimestamp()
+	})
+
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit > 0 && len(union) > limit {
+		union = union[:limit]
 	}
 
-	if _, ok := q["descending"]; ok {
-		req.Descending = true
+	if 2*len(nodeErrs) >= len(nodeAddrs) {
+		return union, nodeErrs
 	}
 
-	resp, err := c.grpcClient.Read(ctx, req)
-	if err != nil {
-		return nil, err
+	if len(union) == 0 && c.emptyResultError {
+		return nil, ErrNoData
 	}
-	return resp.Envelopes.Batch, nil
+
+	return union, nil
 }
 
-// Meta returns meta information from the entire LogCache.
-func (c *Client) Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
-	if c.grpcClient != nil {
-		return c.grpcMeta(ctx)
+// containsEnvelope reports whether the given envelopes contain one that is
+// equal to e.
+func containsEnvelope(envelopes []*loggregator_v2.Envelope, e *loggregator_v2.Envelope) bool {
+	for _, other := range envelopes {
+		if proto.Equal(other, e) {
+			return true
+		}
 	}
 
-	u, err := url.Parse(c.addr)
-	if err != nil {
-		return nil, err
-	}
+	return false
+}
 
-	baseApiPath, err := c.getBaseApiPath(ctx)
-	if err != nil {
-		return nil, err
-	}
+// nodeClient returns a Client for the given address that is configured
+// like c. If c reads via gRPC, the returned Client has dialed its own
+// connection, which the caller has to close.
+func (c *Client) nodeClient(addr string) *Client {
+	c.mu.Lock()
+	baseApiPath := c.baseApiPath
+	c.mu.Unlock()
+
+	node := &Client{
+		addr:                 addr,
+		baseApiPath:          baseApiPath,
+		infoPath:             c.infoPath,
+		httpClient:           c.httpClient,
+		viaGRPC:              c.viaGRPC,
+		grpcDialOpts:         c.grpcDialOpts,
+		grpcKeepalive:        c.grpcKeepalive,
+		grpcAuthority:        c.grpcAuthority,
+		grpcCompressor:       c.grpcCompressor,
+		getClientCertificate: c.getClientCertificate,
+		requestIDKey:         c.requestIDKey,
+		maxErrorBodyBytes:    c.maxErrorBodyBytes,
+		maxResponseBytes:     c.maxResponseBytes,
+		onFiltered:           c.onFiltered,
+		maxLimit:             c.maxLimit,
+		extraQueryParams:     c.extraQueryParams,
+		fallbackOn404:        c.fallbackOn404,
+		defaultReadOpts:      c.defaultReadOpts,
+		defaultPromQLOpts:    c.defaultPromQLOpts,
+		log:                  c.log,
+		debugLogger:          c.debugLogger,
+		grpcDebugLogger:      c.grpcDebugLogger,
+		capture:              c.capture,
+		decoder:              c.decoder,
+		metrics:              c.metrics,
+		incRequests:          c.incRequests,
+		incErrors:            c.incErrors,
+		requestDuration:      c.requestDuration,
+		retry:                c.retry,
+	}
+
+	if node.viaGRPC {
+		node.dialGRPC()
+	}
+
+	return node
+}
 
-	u.Path = fmt.Sprintf("%s/meta", baseApiPath)
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	req = req.WithContext(ctx)
+// metaCache holds the last result of Meta. It is safe for concurrent use.
+type metaCache struct {
+	ttl time.Duration
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+	mu         sync.Mutex
+	meta       map[string]*logcache_v1.MetaInfo
+	expiresAt  time.Time
+	refreshing bool
+}
+
+// get returns the cached result. It fetches synchronously if nothing is
+// cached yet and in the background if the cached result has expired.
+func (m *metaCache) get(
+	ctx context.Context,
+	fetch func(context.Context) (map[string]*logcache_v1.MetaInfo, error),
+) (map[string]*logcache_v1.MetaInfo, error) {
+	m.mu.Lock()
+	meta := m.meta
+	expired := time.Now().After(m.expiresAt)
+	refresh := meta != nil && expired && !m.refreshing
+	if refresh {
+		m.refreshing = true
 	}
-	defer resp.Body.Close()
+	m.mu.Unlock()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	if meta == nil {
+		return fetch(ctx)
 	}
 
-	var metaResponse logcache_v1.MetaResponse
-	if err := jsonpb.Unmarshal(resp.Body, &metaResponse); err != nil {
-		return nil, err
+	if refresh {
+		go func() {
+			// On failure the stale result is served until the next refresh.
+			fetch(context.Background())
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.refreshing = false
+		}()
 	}
 
-	return metaResponse.Meta, nil
+	return meta, nil
 }
 
-func (c *Client) grpcMeta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
-	resp, err := c.grpcClient.Meta(ctx, &logcache_v1.MetaRequest{})
-	if err != nil {
-		return nil, err
-	}
+func (m *metaCache) set(meta map[string]*logcache_v1.MetaInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return resp.Meta, nil
+	m.meta = meta
+	m.expiresAt = time.Now().Add(m.ttl)
 }
 
 func (c *Client) getBaseApiPath(ctx context.Context) (string, error) {
-	if c.baseApiPath != "" {
-		return c.baseApiPath, nil
+	c.mu.Lock()
+	baseApiPath := c.baseApiPath
+	c.mu.Unlock()
+
+	if baseApiPath != "" {
+		return baseApiPath, nil
 	}
 
+	// The lock is not held while probing to not block other calls on a slow
+	// LogCache. Concurrent calls might probe more than once, but they all
+	// detect the same path.
 	logCacheVersion, err := c.LogCacheVersion(ctx)
 	if err != nil {
 		return "", err
 	}
 
+	baseApiPath = "/v1"
 	if logCacheVersion.GTE(FIRST_LOG_CACHE_VERSION_AFTER_API_MOVE) {
-		return "/api/v1", nil
+		baseApiPath = "/api/v1"
 	}
 
-	return "/v1", nil
+	c.mu.Lock()
+	c.baseApiPath = baseApiPath
+	c.mu.Unlock()
+
+	return baseApiPath, nil
 }
 
 func (c *Client) LogCacheVersion(ctx context.Context) (semver.Version, error) {
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return semver.Version{}, err
+	}
+	defer done()
+
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		return semver.Version{}, err
 	}
 
-	u.Path = "/api/v1/info"
+	u.Path = c.infoPath
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return semver.Version{}, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return semver.Version{}, err
 	}
@@ -330,7 +2641,7 @@ func (c *Client) LogCacheVersion(ctx context.Context) (semver.Version, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return semver.Version{}, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return semver.Version{}, c.requestError(resp)
 	}
 
 	var info struct {
@@ -346,27 +2657,32 @@ func (c *Client) LogCacheVersion(ctx context.Context) (semver.Version, error) {
 }
 
 func (c *Client) LogCacheVMUptime(ctx context.Context) (int64, error) {
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer done()
+
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		return -1, err
 	}
 
-	u.Path = "/api/v1/info"
+	u.Path = c.infoPath
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return -1, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return -1, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return -1, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return -1, c.requestError(resp)
 	}
 
 	var info struct {
@@ -425,12 +2741,69 @@ func WithPromQLStep(step string) PromQLOption {
 	}
 }
 
+// WithPromQLTimeout returns a PromQLOption that configures the 'timeout'
+// query parameter for a PromQL query. It limits how long LogCache evaluates
+// the query and is independent of the timeout of the HTTP client. The
+// timeout is sent with millisecond precision and must be positive,
+// otherwise the query returns an error.
+func WithPromQLTimeout(d time.Duration) PromQLOption {
+	return func(u *url.URL, q url.Values) {
+		q.Set("timeout", formatPromQLDuration(d))
+	}
+}
+
+// formatPromQLDuration formats the given duration in the largest unit of
+// the Prometheus duration syntax that represents it exactly.
+func formatPromQLDuration(d time.Duration) string {
+	d = d.Truncate(time.Millisecond)
+	if d <= 0 {
+		return d.String()
+	}
+
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	} {
+		if d%unit.d == 0 {
+			return fmt.Sprintf("%d%s", d/unit.d, unit.suffix)
+		}
+	}
+
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+var promQLDurationRegexp = regexp.MustCompile(`^[0-9]*[1-9][0-9]*(ms|s|m|h)$`)
+
+// validatePromQLParams returns an error for query parameters of a PromQL
+// query that LogCache would reject.
+func validatePromQLParams(q url.Values) error {
+	if v, ok := q["timeout"]; ok && !promQLDurationRegexp.MatchString(v[0]) {
+		return fmt.Errorf("timeout must be a positive duration: %s", v[0])
+	}
+
+	return nil
+}
+
 // PromQL issues a PromQL range query against Log Cache data.
 func (c *Client) PromQLRange(
 	ctx context.Context,
 	query string,
 	opts ...PromQLOption,
-) (*logcache_v1.PromQL_RangeQueryResult, error) {
+) (_ *logcache_v1.PromQL_RangeQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	opts = c.promQLOptions(opts)
+
 	if c.promqlGrpcClient != nil {
 		return c.grpcPromQLRange(ctx, query, opts)
 	}
@@ -447,33 +2820,63 @@ func (c *Client) PromQLRange(
 	for _, o := range opts {
 		o(u, q)
 	}
+
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return nil, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return nil, c.requestError(resp)
 	}
 
 	var promQLResponse logcache_v1.PromQL_RangeQueryResult
-	marshaler := marshaler.NewPromqlMarshaler(&runtime.JSONPb{})
-	if err := marshaler.NewDecoder(resp.Body).Decode(&promQLResponse); err != nil {
+	if err := c.decoder.DecodeRangeQuery(resp.Body, &promQLResponse); err != nil {
 		return nil, err
 	}
 
 	return &promQLResponse, nil
 }
 
+// SeriesVisitor is invoked for each series of a range query result. If it
+// returns false, no more series are visited.
+type SeriesVisitor func(*logcache_v1.PromQL_Series) bool
+
+// PromQLRangeStream issues a PromQL range query against Log Cache data and
+// invokes the visitor for each series of the resulting matrix. LogCache
+// returns the whole matrix in a single response, which is decoded before
+// the series are visited.
+func (c *Client) PromQLRangeStream(
+	ctx context.Context,
+	query string,
+	opts []PromQLOption,
+	visitor SeriesVisitor,
+) error {
+	result, err := c.PromQLRange(ctx, query, opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, series := range result.GetMatrix().GetSeries() {
+		if !visitor(series) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) grpcPromQLRange(ctx context.Context, query string, opts []PromQLOption) (*logcache_v1.PromQL_RangeQueryResult, error) {
 	u := &url.URL{}
 	q := u.Query()
@@ -482,6 +2885,10 @@ func (c *Client) grpcPromQLRange(ctx context.Context, query string, opts []PromQ
 		o(u, q)
 	}
 
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
+
 	req := &logcache_v1.PromQL_RangeQueryRequest{
 		Query: query,
 	}
@@ -498,6 +2905,10 @@ func (c *Client) grpcPromQLRange(ctx context.Context, query string, opts []PromQ
 		req.Step = v[0]
 	}
 
+	if v, ok := q["timeout"]; ok {
+		req.Timeout = v[0]
+	}
+
 	resp, err := c.promqlGrpcClient.RangeQuery(ctx, req)
 	if err != nil {
 		return nil, err
@@ -509,7 +2920,17 @@ func (c *Client) PromQLRangeRaw(
 	ctx context.Context,
 	query string,
 	opts ...PromQLOption,
-) (*PromQLQueryResult, error) {
+) (_ *PromQLQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	opts = c.promQLOptions(opts)
+
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		return nil, err
@@ -522,15 +2943,18 @@ func (c *Client) PromQLRangeRaw(
 	for _, o := range opts {
 		o(u, q)
 	}
+
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return nil, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -550,7 +2974,7 @@ func (c *Client) PromQLRangeRaw(
 	if resp.StatusCode != http.StatusOK &&
 		resp.StatusCode != http.StatusBadRequest &&
 		resp.StatusCode != http.StatusInternalServerError {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return nil, c.requestError(resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -570,7 +2994,17 @@ func (c *Client) PromQL(
 	ctx context.Context,
 	query string,
 	opts ...PromQLOption,
-) (*logcache_v1.PromQL_InstantQueryResult, error) {
+) (_ *logcache_v1.PromQL_InstantQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	opts = c.promQLOptions(opts)
+
 	if c.promqlGrpcClient != nil {
 		return c.grpcPromQL(ctx, query, opts)
 	}
@@ -587,15 +3021,18 @@ func (c *Client) PromQL(
 	for _, o := range opts {
 		o(u, q)
 	}
+
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return nil, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -603,12 +3040,11 @@ func (c *Client) PromQL(
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return nil, c.requestError(resp)
 	}
 
 	var promQLResponse logcache_v1.PromQL_InstantQueryResult
-	marshaler := marshaler.NewPromqlMarshaler(&runtime.JSONPb{})
-	if err := marshaler.NewDecoder(resp.Body).Decode(&promQLResponse); err != nil {
+	if err := c.decoder.DecodeInstantQuery(resp.Body, &promQLResponse); err != nil {
 		return nil, err
 	}
 
@@ -623,6 +3059,10 @@ func (c *Client) grpcPromQL(ctx context.Context, query string, opts []PromQLOpti
 		o(u, q)
 	}
 
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
+
 	req := &logcache_v1.PromQL_InstantQueryRequest{
 		Query: query,
 	}
@@ -631,6 +3071,10 @@ func (c *Client) grpcPromQL(ctx context.Context, query string, opts []PromQLOpti
 		req.Time = v[0]
 	}
 
+	if v, ok := q["timeout"]; ok {
+		req.Timeout = v[0]
+	}
+
 	resp, err := c.promqlGrpcClient.InstantQuery(ctx, req)
 	if err != nil {
 		return nil, err
@@ -638,11 +3082,69 @@ func (c *Client) grpcPromQL(ctx context.Context, query string, opts []PromQLOpti
 	return resp, nil
 }
 
+// ErrNotViaGRPC is returned by the methods that are only supported by a
+// Client configured WithViaGRPC.
+var ErrNotViaGRPC = errors.New("only supported via gRPC")
+
+// InstantQueryRaw issues the given PromQL instant query request as is. It
+// allows to set fields of the request that PromQL doesn't expose yet. It
+// is only supported via gRPC and returns ErrNotViaGRPC otherwise.
+func (c *Client) InstantQueryRaw(
+	ctx context.Context,
+	req *logcache_v1.PromQL_InstantQueryRequest,
+) (_ *logcache_v1.PromQL_InstantQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	if c.promqlGrpcClient == nil {
+		return nil, ErrNotViaGRPC
+	}
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return c.promqlGrpcClient.InstantQuery(ctx, req)
+}
+
+// RangeQueryRaw issues the given PromQL range query request as is. It
+// allows to set fields of the request that PromQLRange doesn't expose yet.
+// It is only supported via gRPC and returns ErrNotViaGRPC otherwise.
+func (c *Client) RangeQueryRaw(
+	ctx context.Context,
+	req *logcache_v1.PromQL_RangeQueryRequest,
+) (_ *logcache_v1.PromQL_RangeQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	if c.promqlGrpcClient == nil {
+		return nil, ErrNotViaGRPC
+	}
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	return c.promqlGrpcClient.RangeQuery(ctx, req)
+}
+
 func (c *Client) PromQLRaw(
 	ctx context.Context,
 	query string,
 	opts ...PromQLOption,
-) (*PromQLQueryResult, error) {
+) (_ *PromQLQueryResult, err error) {
+	defer func() { err = c.withRequestID(ctx, err) }()
+
+	ctx, done, err := c.inFlight.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	opts = c.promQLOptions(opts)
+
 	u, err := url.Parse(c.addr)
 	if err != nil {
 		return nil, err
@@ -655,15 +3157,18 @@ func (c *Client) PromQLRaw(
 	for _, o := range opts {
 		o(u, q)
 	}
+
+	if err := validatePromQLParams(q); err != nil {
+		return nil, err
+	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := c.newRequest(ctx, u.String())
 	if err != nil {
 		return nil, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -683,7 +3188,7 @@ func (c *Client) PromQLRaw(
 	if resp.StatusCode != http.StatusOK &&
 		resp.StatusCode != http.StatusBadRequest &&
 		resp.StatusCode != http.StatusInternalServerError {
-		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		return nil, c.requestError(resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
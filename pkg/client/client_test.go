@@ -3,20 +3,34 @@ package client_test
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"code.cloudfoundry.org/log-cache/pkg/client"
 	rpc "code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -41,6 +55,20 @@ var _ = Describe("Log Cache Client", func() {
 				Expect(logCache.reqs).To(HaveLen(1))
 				Expect(logCache.reqs[0].URL.Path).To(Equal("/api/v1/info"))
 			})
+
+			It("uses the configured info path", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/proxy/info"] = logCache.result["GET/api/v1/info"]
+				logcache_client := client.NewClient(logCache.addr(), client.WithInfoPath("/proxy/info"))
+
+				version, err := logcache_client.LogCacheVersion(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(version.String()).To(Equal("2.0.0"))
+
+				Expect(logCache.reqs).To(HaveLen(1))
+				Expect(logCache.reqs[0].URL.Path).To(Equal("/proxy/info"))
+			})
 		})
 
 		Describe("LogCacheVMUptime", func() {
@@ -111,6 +139,101 @@ var _ = Describe("Log Cache Client", func() {
 				Expect(logCache.reqs[1].URL.Query()).To(HaveLen(1))
 			})
 
+			It("uses the legacy endpoint without probing when forced", func() {
+				logCache := newStubOldLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1Legacy))
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				Expect(logCache.reqs).To(HaveLen(1))
+				Expect(logCache.reqs[0].URL.Path).To(Equal("/v1/read/some-id"))
+			})
+
+			It("uses the current endpoint without probing when forced", func() {
+				logCache := newStubLogCache()
+				delete(logCache.result, "GET/api/v1/info")
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				Expect(logCache.reqs).To(HaveLen(1))
+				Expect(logCache.reqs[0].URL.Path).To(Equal("/api/v1/read/some-id"))
+			})
+
+			It("applies the default options before the given ones", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithDefaultReadOptions(
+						client.WithLimit(10),
+						client.WithEnvelopeTypes(rpc.EnvelopeType_LOG),
+					),
+				)
+
+				_, err := logcache_client.Read(
+					context.Background(),
+					"some-id",
+					time.Unix(0, 99),
+					client.WithLimit(20),
+					client.WithEnvelopeTypes(rpc.EnvelopeType_GAUGE),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(1))
+				assertQueryParam(logCache.reqs[0].URL, "limit", "20")
+				assertQueryParam(logCache.reqs[0].URL, "envelope_types", "LOG", "GAUGE")
+			})
+
+			It("retries the legacy endpoint on 404 when configured", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/v1/read/some-id"] = logCache.result["GET/api/v1/read/some-id"]
+				delete(logCache.result, "GET/api/v1/read/some-id")
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithFallbackOn404(),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				Expect(logCache.reqs).To(HaveLen(2))
+				Expect(logCache.reqs[0].URL.Path).To(Equal("/api/v1/read/some-id"))
+				Expect(logCache.reqs[1].URL.Path).To(Equal("/v1/read/some-id"))
+				assertQueryParam(logCache.reqs[1].URL, "start_time", "99")
+			})
+
+			It("does not retry the legacy endpoint on other errors", func() {
+				logCache := newStubLogCache()
+				logCache.statusCode = http.StatusInternalServerError
+				logCache.result["GET/v1/read/some-id"] = logCache.result["GET/api/v1/read/some-id"]
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithFallbackOn404(),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(1))
+			})
+
+			It("does not retry the legacy endpoint by default", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/v1/read/some-id"] = logCache.result["GET/api/v1/read/some-id"]
+				delete(logCache.result, "GET/api/v1/read/some-id")
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(1))
+			})
+
 			It("respects options", func() {
 				logCache := newStubLogCache()
 				logcache_client := client.NewClient(logCache.addr())
@@ -128,90 +251,1785 @@ var _ = Describe("Log Cache Client", func() {
 
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(logCache.reqs).To(HaveLen(2))
-				Expect(logCache.reqs[1].URL.Path).To(Equal("/api/v1/read/some-id"))
+				Expect(logCache.reqs).To(HaveLen(2))
+				Expect(logCache.reqs[1].URL.Path).To(Equal("/api/v1/read/some-id"))
+
+				assertQueryParam(logCache.reqs[1].URL, "start_time", "99")
+				assertQueryParam(logCache.reqs[1].URL, "end_time", "101")
+				assertQueryParam(logCache.reqs[1].URL, "limit", "103")
+				assertQueryParam(logCache.reqs[1].URL, "envelope_types", "LOG", "GAUGE")
+				assertQueryParam(logCache.reqs[1].URL, "name_filter", "name.*")
+				assertQueryParam(logCache.reqs[1].URL, "descending", "true")
+
+				Expect(logCache.reqs[1].URL.Query()).To(HaveLen(6))
+			})
+
+			It("escapes the source ID", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/foo/bar baz"] = logCache.result["GET/api/v1/read/some-id"]
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.Read(context.Background(), "foo/bar baz", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				Expect(logCache.reqs).To(HaveLen(1))
+				Expect(logCache.reqs[0].URL.EscapedPath()).To(Equal("/api/v1/read/foo%2Fbar%20baz"))
+			})
+
+			It("captures the raw request and response", func() {
+				logCache := newStubLogCache()
+				var rawReqs, rawResps [][]byte
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithCapture(func(req, resp []byte) {
+						rawReqs = append(rawReqs, req)
+						rawResps = append(rawResps, resp)
+					}),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				Expect(rawReqs).To(HaveLen(1))
+				Expect(string(rawReqs[0])).To(HavePrefix("GET /api/v1/read/some-id?start_time=99 HTTP/1.1"))
+				Expect(rawResps).To(Equal([][]byte{logCache.result["GET/api/v1/read/some-id"]}))
+			})
+
+			It("connects via a unix socket", func() {
+				dir, err := ioutil.TempDir("", "log-cache-client")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.RemoveAll(dir)
+				socket := filepath.Join(dir, "log-cache.sock")
+
+				lis, err := net.Listen("unix", socket)
+				Expect(err).ToNot(HaveOccurred())
+				logCache := newStubLogCache()
+				server := &http.Server{Handler: logCache}
+				go server.Serve(lis)
+				defer server.Close()
+
+				logcache_client := client.NewClient("http://log-cache",
+					client.WithAPIVersion(client.APIv1),
+					client.WithUnixSocket(socket),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+			})
+
+			It("returns an error for a missing unix socket", func() {
+				logcache_client := client.NewClient("http://log-cache",
+					client.WithAPIVersion(client.APIv1),
+					client.WithUnixSocket("/does/not/exist.sock"),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError(ContainSubstring("invalid unix socket")))
+			})
+
+			It("speaks cleartext HTTP/2", func() {
+				logCache := newStubLogCache()
+				var protos []int
+				var mu sync.Mutex
+				server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					protos = append(protos, r.ProtoMajor)
+					mu.Unlock()
+					logCache.ServeHTTP(w, r)
+				}), &http2.Server{}))
+				defer server.Close()
+
+				logcache_client := client.NewClient(server.URL,
+					client.WithAPIVersion(client.APIv1),
+					client.WithH2C(),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				mu.Lock()
+				defer mu.Unlock()
+				Expect(protos).To(Equal([]int{2}))
+			})
+
+			It("returns an error for h2c combined with TLS", func() {
+				logcache_client := client.NewClient("https://log-cache",
+					client.WithAPIVersion(client.APIv1),
+					client.WithH2C(),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError(ContainSubstring("h2c")))
+			})
+
+			It("presents the client certificate obtained per connection", func() {
+				logCache := newStubLogCache()
+				server := httptest.NewUnstartedServer(logCache)
+				server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+				server.StartTLS()
+				defer server.Close()
+
+				var calls int32
+				cert := server.TLS.Certificates[0]
+				logcache_client := client.NewClient(server.URL,
+					client.WithAPIVersion(client.APIv1),
+					client.WithHTTPClient(server.Client()),
+					client.WithClientCertificate(func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+						atomic.AddInt32(&calls, 1)
+						return &cert, nil
+					}),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+				Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+			})
+
+			It("keeps the precision of large timestamps", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 9223372036854775806, "source_id": "some-id"},
+				{"timestamp": "9223372036854775807", "source_id": "some-id"}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[0].Timestamp).To(Equal(int64(math.MaxInt64 - 1)))
+				Expect(envelopes[1].Timestamp).To(Equal(int64(math.MaxInt64)))
+			})
+
+			It("filters out log envelopes with empty payloads", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 99, "source_id": "some-id", "log": {"payload": "c29tZS1sb2c="}},
+				{"timestamp": 100, "source_id": "some-id", "log": {}},
+				{"timestamp": 101, "source_id": "some-id", "gauge": {}}
+			]
+		}
+	}`)
+				var filtered []int
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithFilteredEnvelopesCallback(func(n int) {
+						filtered = append(filtered, n)
+					}),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithNonEmptyPayloads(),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(99))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(101))
+				Expect(filtered).To(Equal([]int{1}))
+
+				Expect(logCache.reqs[1].URL.Query()).To(HaveLen(1))
+			})
+
+			It("decodes the response with the given decoder", func() {
+				logCache := newStubLogCache()
+				decoder := &spyDecoder{}
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithDecoder(decoder),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(1))
+				Expect(envelopes[0].Timestamp).To(Equal(int64(1)))
+				Expect(decoder.body).To(ContainSubstring(`"timestamp": 99`))
+			})
+
+			It("reads the envelopes as protobuf encoded read response", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				b, err := logcache_client.ReadBytes(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+
+				resp, err := client.UnmarshalReadResponse(b)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.GetEnvelopes().GetBatch()).To(HaveLen(2))
+				Expect(resp.GetEnvelopes().GetBatch()[0].Timestamp).To(Equal(int64(99)))
+				Expect(resp.GetEnvelopes().GetBatch()[1].Timestamp).To(Equal(int64(100)))
+
+				_, err = client.UnmarshalReadResponse([]byte("invalid"))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("adds the extra query params", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithExtraQueryParam("some-param", "a"),
+					client.WithExtraQueryParam("some-param", "b"),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs[0].URL.Query()["some-param"]).To(Equal([]string{"a", "b"}))
+				assertQueryParam(logCache.reqs[0].URL, "start_time", "99")
+			})
+
+			It("returns an error for an extra query param set by the client", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithExtraQueryParam("limit", "5"),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError(ContainSubstring(`"limit"`)))
+				Expect(logCache.reqs).To(BeEmpty())
+			})
+
+			It("drops the envelopes beyond the byte budget", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				// Each envelope has an encoded size of 11 bytes.
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithMaxBytes(15),
+				)
+				Expect(err).To(Equal(client.ErrBudgetExceeded))
+				Expect(envelopes).To(HaveLen(1))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(99))
+
+				Expect(logCache.reqs[0].URL.Query()).ToNot(HaveKey("_max_bytes"))
+			})
+
+			It("reads as of the given time", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 99, "source_id": "some-id"},
+				{"timestamp": 100, "source_id": "some-id"},
+				{"timestamp": 101, "source_id": "some-id"}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithAsOf(time.Unix(0, 100)),
+				)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(100))
+
+				assertQueryParam(logCache.reqs[0].URL, "end_time", "101")
+				Expect(logCache.reqs[0].URL.Query()).To(HaveLen(2))
+			})
+
+			It("keeps an earlier end time than the as of time", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithEndTime(time.Unix(0, 50)),
+					client.WithAsOf(time.Unix(0, 100)),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				assertQueryParam(logCache.reqs[0].URL, "end_time", "50")
+			})
+
+			It("filters out log envelopes of the other log stream", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 99, "source_id": "some-id", "log": {"type": "OUT"}},
+				{"timestamp": 100, "source_id": "some-id", "log": {"type": "ERR"}},
+				{"timestamp": 101, "source_id": "some-id", "gauge": {}}
+			]
+		}
+	}`)
+				var filtered []int
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithFilteredEnvelopesCallback(func(n int) {
+						filtered = append(filtered, n)
+					}),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithLogStream(loggregator_v2.Log_ERR),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(100))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(101))
+				Expect(filtered).To(Equal([]int{1}))
+
+				Expect(logCache.reqs[0].URL.Query()).To(HaveLen(1))
+			})
+
+			It("downsamples gauges to the newest value per step", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 100, "source_id": "some-id", "gauge": {"metrics": {"cpu": {"value": 1}}}},
+				{"timestamp": 150, "source_id": "some-id", "gauge": {"metrics": {"cpu": {"value": 2}}}},
+				{"timestamp": 160, "source_id": "some-id", "log": {}},
+				{"timestamp": 210, "source_id": "some-id", "gauge": {"metrics": {"cpu": {"value": 3}}}}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99),
+					client.WithStep(100),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(3))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(100))
+				Expect(envelopes[0].GetGauge().GetMetrics()["cpu"].GetValue()).To(Equal(2.0))
+				Expect(envelopes[1].GetLog()).ToNot(BeNil())
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(160))
+				Expect(envelopes[2].Timestamp).To(BeEquivalentTo(200))
+				Expect(envelopes[2].GetGauge().GetMetrics()["cpu"].GetValue()).To(Equal(3.0))
+
+				Expect(logCache.reqs[0].URL.Query()).To(HaveLen(1))
+			})
+
+			It("returns an error for a non-positive step", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithStep(0))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("returns an error for a non-positive limit", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithLimit(0))
+				Expect(err).To(HaveOccurred())
+
+				_, err = logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithLimit(-1))
+				Expect(err).To(HaveOccurred())
+
+				for _, req := range logCache.reqs {
+					Expect(req.URL.Path).ToNot(HavePrefix("/api/v1/read"))
+				}
+			})
+
+			It("clamps the limit to the max limit", func() {
+				logCache := newStubLogCache()
+				var buf bytes.Buffer
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMaxLimit(1000),
+					client.WithLogger(log.New(&buf, "", 0)),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithLimit(10000))
+				Expect(err).ToNot(HaveOccurred())
+
+				assertQueryParam(logCache.requests()[0].URL, "limit", "1000")
+				Expect(buf.String()).To(Equal("limit 10000 lowered to the max limit 1000\n"))
+			})
+
+			It("omits the limit to request the server's default", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(
+					context.Background(),
+					"some-id",
+					time.Unix(0, 99),
+					client.WithLimit(10),
+					client.WithServerDefaultLimit(),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(2))
+				Expect(logCache.reqs[1].URL.Query()).ToNot(HaveKey("limit"))
+			})
+
+			It("resolves relative start and end times", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(
+					context.Background(),
+					"some-id",
+					time.Time{},
+					client.WithRelativeStart(15*time.Minute),
+					client.WithRelativeEnd(time.Minute),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(2))
+				query := logCache.reqs[1].URL.Query()
+				Expect(query).To(HaveLen(2))
+
+				start, err := strconv.ParseInt(query.Get("start_time"), 10, 64)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(time.Unix(0, start)).To(BeTemporally("~", time.Now().Add(-15*time.Minute), time.Second))
+
+				end, err := strconv.ParseInt(query.Get("end_time"), 10, 64)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(time.Unix(0, end)).To(BeTemporally("~", time.Now().Add(-time.Minute), time.Second))
+			})
+
+			It("returns an error when a relative start is combined with a start time", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(
+					context.Background(),
+					"some-id",
+					time.Unix(0, 99),
+					client.WithRelativeStart(15*time.Minute),
+				)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("returns an error when a relative end is combined with an end time", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(
+					context.Background(),
+					"some-id",
+					time.Time{},
+					client.WithRelativeStart(15*time.Minute),
+					client.WithEndTime(time.Now()),
+					client.WithRelativeEnd(time.Minute),
+				)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("closes the body", func() {
+				spyHTTPClient := newSpyHTTPClient()
+				logcache_client := client.NewClient("", client.WithHTTPClient(spyHTTPClient))
+				logcache_client.Read(context.Background(), "some-name", time.Now())
+
+				Expect(spyHTTPClient.body.closed).To(BeTrue())
+			})
+
+			It("returns an error on a non-200 status", func() {
+				logCache := newStubLogCache()
+				logCache.statusCode = 500
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("includes the response body in the error", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+				logCache.statusCode = 500
+				logCache.result["GET/api/v1/read/some-id"] = []byte("some-reason")
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError("unexpected status code 500: some-reason"))
+
+				requestErr, ok := err.(*client.RequestError)
+				Expect(ok).To(BeTrue())
+				Expect(requestErr.StatusCode).To(Equal(500))
+				Expect(requestErr.Body).To(Equal([]byte("some-reason")))
+			})
+
+			It("truncates the response body in the error", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMaxErrorBodyBytes(4),
+				)
+				logCache.statusCode = 500
+				logCache.result["GET/api/v1/read/some-id"] = []byte("some-reason")
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError("unexpected status code 500: some"))
+			})
+
+			It("returns an error when the response exceeds the max size", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMaxResponseBytes(10),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(MatchError(ContainSubstring(client.ErrResponseTooLarge.Error())))
+			})
+
+			It("returns an error on invalid JSON", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte("invalid")
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("returns ErrNoData for an empty result if configured", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{}`)
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(Equal(client.ErrNoData))
+			})
+
+			It("returns an error on empty JSON", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte("{}")
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error on an invalid URL", func() {
+				logcache_client := client.NewClient("http://invalid.url")
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+
+				logcache_client = client.NewClient("-:-invalid")
+
+				_, err = logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("returns an error when the read is cancelled", func() {
+				logCache := newStubLogCache()
+				logCache.block = true
+				logcache_client := client.NewClient(logCache.addr())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := logcache_client.Read(ctx, "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("concurrent use", func() {
+			It("is safe to share a client across goroutines", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				var wg sync.WaitGroup
+				errs := make(chan error, 300)
+				for i := 0; i < 100; i++ {
+					wg.Add(3)
+					go func() {
+						defer wg.Done()
+						_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+						errs <- err
+					}()
+					go func() {
+						defer wg.Done()
+						_, err := logcache_client.Meta(context.Background())
+						errs <- err
+					}()
+					go func() {
+						defer wg.Done()
+						_, err := logcache_client.PromQL(context.Background(), "some-query")
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+
+				for err := range errs {
+					Expect(err).ToNot(HaveOccurred())
+				}
+			})
+
+			It("collapses identical concurrent reads with single flight", func() {
+				logCache := newStubLogCache()
+				logCache.delay = 200 * time.Millisecond
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithSingleFlight(),
+				)
+
+				var wg sync.WaitGroup
+				for i := 0; i < 5; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithLimit(10))
+						Expect(err).ToNot(HaveOccurred())
+						Expect(envelopes).To(HaveLen(2))
+					}()
+				}
+				wg.Wait()
+
+				Expect(logCache.requests()).To(HaveLen(1))
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99), client.WithLimit(20))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("only probes the API version until it is detected", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				for i := 0; i < 3; i++ {
+					_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				var probes int
+				for _, req := range logCache.requests() {
+					if req.URL.Path == "/api/v1/info" {
+						probes++
+					}
+				}
+				Expect(probes).To(Equal(1))
+			})
+		})
+
+		Describe("Shutdown", func() {
+			It("cancels in-flight calls and rejects new ones", func() {
+				logCache := newStubLogCache()
+				logCache.block = true
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				errs := make(chan error, 1)
+				go func() {
+					_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+					errs <- err
+				}()
+
+				// Give the read time to block on the LogCache.
+				time.Sleep(100 * time.Millisecond)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				Expect(logcache_client.Shutdown(ctx)).To(Succeed())
+
+				Eventually(errs).Should(Receive(HaveOccurred()))
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).To(Equal(client.ErrShutdown))
+			})
+		})
+
+		Describe("Aggregate", func() {
+			It("aggregates a metric of a source over the window", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				value, err := logcache_client.Aggregate(context.Background(), "cpu", "some-id", client.AggAvg, time.Hour)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal(99.0))
+
+				assertQueryParam(logCache.reqs[0].URL, "query", `avg(avg_over_time(cpu{source_id="some-id"}[1h]))`)
+			})
+
+			It("sums up counts", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Aggregate(context.Background(), "cpu", "some-id", client.AggCount, 5*time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+
+				assertQueryParam(logCache.reqs[0].URL, "query", `sum(count_over_time(cpu{source_id="some-id"}[5m]))`)
+			})
+
+			It("returns an error for an empty result", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/query"] = []byte(`{"status": "success", "data": {"resultType": "vector", "result": []}}`)
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Aggregate(context.Background(), "cpu", "some-id", client.AggMax, time.Hour)
+				Expect(err).To(Equal(client.ErrNoData))
+			})
+
+			It("returns an error for an unknown function", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Aggregate(context.Background(), "cpu", "some-id", client.AggFunc(99), time.Hour)
+				Expect(err).To(HaveOccurred())
+				Expect(logCache.reqs).To(BeEmpty())
+			})
+		})
+
+		Describe("LatestValue", func() {
+			It("returns the newest value of the metric", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 99, "source_id": "some-id", "gauge": {"metrics": {"cpu.percent": {"value": 42}}}}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				value, timestamp, err := logcache_client.LatestValue(context.Background(), "cpu.percent", "some-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal(42.0))
+				Expect(timestamp).To(Equal(time.Unix(0, 99)))
+
+				assertQueryParam(logCache.reqs[0].URL, "name_filter", `^cpu\.percent$`)
+				assertQueryParam(logCache.reqs[0].URL, "descending", "true")
+				assertQueryParam(logCache.reqs[0].URL, "limit", "1")
+			})
+
+			It("returns an error without the metric", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				_, _, err := logcache_client.LatestValue(context.Background(), "cpu", "some-id")
+				Expect(err).To(Equal(client.ErrNoData))
+			})
+		})
+
+		Describe("WatchMetric", func() {
+			It("invokes the callback when the predicate becomes true", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 99, "source_id": "some-id", "gauge": {"metrics": {"cpu": {"value": 42}}}}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				var (
+					mu      sync.Mutex
+					polls   int
+					matches = []bool{false, true, true, false, true}
+					values  []float64
+				)
+				predicate := func(float64) bool {
+					mu.Lock()
+					defer mu.Unlock()
+
+					polls++
+					return polls <= len(matches) && matches[polls-1]
+				}
+				cb := func(v float64, _ time.Time) {
+					mu.Lock()
+					defer mu.Unlock()
+					values = append(values, v)
+				}
+				getValues := func() []float64 {
+					mu.Lock()
+					defer mu.Unlock()
+					return append([]float64(nil), values...)
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					logcache_client.WatchMetric(ctx, "cpu", "some-id", time.Millisecond, predicate, cb)
+				}()
+
+				Eventually(getValues).Should(Equal([]float64{42, 42}))
+				Consistently(getValues).Should(HaveLen(2))
+
+				cancel()
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		Describe("Histogram", func() {
+			It("counts the samples per bucket", func() {
+				logCache := newStubLogCache()
+				now := time.Now().UnixNano()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(fmt.Sprintf(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": %d, "source_id": "some-id", "gauge": {"metrics": {"latency": {"value": 0.05}}}},
+				{"timestamp": %d, "source_id": "some-id", "gauge": {"metrics": {"latency": {"value": 0.3}}}},
+				{"timestamp": %d, "source_id": "some-id", "gauge": {"metrics": {"latency": {"value": 0.3}}}},
+				{"timestamp": %d, "source_id": "some-id", "gauge": {"metrics": {"latency": {"value": 0.7}}}}
+			]
+		}
+	}`, now-4e9, now-3e9, now-2e9, now-1e9))
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				counts, err := logcache_client.Histogram(context.Background(), "latency", "some-id", []float64{0.1, 0.5, 1}, time.Hour)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(counts).To(Equal(map[float64]float64{0.1: 1, 0.5: 3, 1: 4}))
+
+				assertQueryParam(logCache.reqs[0].URL, "envelope_types", "GAUGE", "COUNTER")
+				assertQueryParam(logCache.reqs[0].URL, "name_filter", "^latency$")
+			})
+
+			It("counts zero for an empty bucket", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				counts, err := logcache_client.Histogram(context.Background(), "latency", "some-id", []float64{0.1}, time.Hour)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(counts).To(Equal(map[float64]float64{0.1: 0}))
+			})
+
+			It("returns an error for unsorted buckets", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.Histogram(context.Background(), "latency", "some-id", []float64{0.5, 0.1}, time.Hour)
+				Expect(err).To(HaveOccurred())
+				Expect(logCache.reqs).To(BeEmpty())
+			})
+		})
+
+		Describe("Buckets", func() {
+			It("counts the envelopes per bucket", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				buckets, err := logcache_client.Buckets(context.Background(), "some-id",
+					time.Unix(0, 90), time.Unix(0, 125), 10,
+					client.WithEnvelopeTypes(rpc.EnvelopeType_LOG),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(buckets).To(Equal([]client.BucketCount{
+					{BucketStart: time.Unix(0, 90), Count: 1},
+					{BucketStart: time.Unix(0, 100), Count: 1},
+					{BucketStart: time.Unix(0, 110), Count: 0},
+					{BucketStart: time.Unix(0, 120), Count: 0},
+				}))
+
+				Expect(logCache.requests()).To(HaveLen(2))
+				assertQueryParam(logCache.requests()[0].URL, "envelope_types", "LOG")
+				assertQueryParam(logCache.requests()[1].URL, "start_time", "101")
+				assertQueryParam(logCache.requests()[1].URL, "end_time", "125")
+			})
+
+			It("keeps counting past a page emptied by a client side filter", func() {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Query().Get("start_time") {
+					case "0":
+						w.Write([]byte(`{"envelopes": {"batch": [
+							{"timestamp": 1, "source_id": "some-id", "log": {}},
+							{"timestamp": 2, "source_id": "some-id", "log": {}}
+						]}}`))
+					case "3":
+						w.Write([]byte(`{"envelopes": {"batch": [
+							{"timestamp": 5, "source_id": "some-id", "log": {"payload": "c29tZS1sb2c="}}
+						]}}`))
+					default:
+						w.Write([]byte(`{"envelopes": {"batch": []}}`))
+					}
+				}))
+				defer server.Close()
+				logcache_client := client.NewClient(server.URL,
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+				)
+
+				buckets, err := logcache_client.Buckets(context.Background(), "some-id",
+					time.Unix(0, 0), time.Unix(0, 10), 10,
+					client.WithNonEmptyPayloads(),
+				)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buckets).To(Equal([]client.BucketCount{
+					{BucketStart: time.Unix(0, 0), Count: 1},
+				}))
+			})
+
+			It("ends at an empty page with WithEmptyResultError and a request ID", func() {
+				type requestIDKey struct{}
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+					client.WithRequestIDFromContext(requestIDKey{}),
+				)
+
+				ctx := context.WithValue(context.Background(), requestIDKey{}, "some-request-id")
+				buckets, err := logcache_client.Buckets(ctx, "some-id",
+					time.Unix(0, 0), time.Unix(0, 10), 10,
+				)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buckets).To(Equal([]client.BucketCount{
+					{BucketStart: time.Unix(0, 0), Count: 0},
+				}))
+			})
+
+			It("returns an error for an invalid bucket", func() {
+				logcache_client := client.NewClient("")
+
+				_, err := logcache_client.Buckets(context.Background(), "some-id",
+					time.Unix(0, 90), time.Unix(0, 125), 0,
+				)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("EstimateRate", func() {
+			It("returns the observed rate of a sparse source", func() {
+				logCache := newStubLogCache()
+				now := time.Now().UnixNano()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(fmt.Sprintf(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": %d, "source_id": "some-id"},
+				{"timestamp": %d, "source_id": "some-id"}
+			]
+		}
+	}`, now-int64(2*time.Second), now-int64(time.Second)))
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				rate, err := logcache_client.EstimateRate(context.Background(), "some-id", 10*time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(rate).To(BeNumerically("~", 0.2, 0.001))
+			})
+
+			It("returns an error for an invalid sample window", func() {
+				logcache_client := client.NewClient("")
+
+				_, err := logcache_client.EstimateRate(context.Background(), "some-id", 0)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("ReadChan", func() {
+			It("sends the envelopes and closes both channels on cancel", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				envelopes, errs := logcache_client.ReadChan(ctx, "some-id", time.Unix(0, 99))
+
+				var e *loggregator_v2.Envelope
+				Eventually(envelopes).Should(Receive(&e))
+				Expect(e.Timestamp).To(BeEquivalentTo(99))
+				Eventually(envelopes).Should(Receive(&e))
+				Expect(e.Timestamp).To(BeEquivalentTo(100))
+
+				cancel()
+
+				Eventually(envelopes).Should(BeClosed())
+				Eventually(errs).Should(BeClosed())
+			})
+
+			It("keeps polling an empty source with WithEmptyResultError", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+				)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				_, errs := logcache_client.ReadChan(ctx, "some-id", time.Unix(0, 99))
+
+				Eventually(func() int { return len(logCache.requests()) }, 3).Should(BeNumerically(">=", 2))
+				Consistently(errs).ShouldNot(Receive())
+			})
+
+			It("keeps polling an empty source with WithEmptyResultError and a request ID", func() {
+				type requestIDKey struct{}
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+					client.WithRequestIDFromContext(requestIDKey{}),
+				)
+
+				ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestIDKey{}, "some-request-id"))
+				defer cancel()
+				_, errs := logcache_client.ReadChan(ctx, "some-id", time.Unix(0, 99))
+
+				Eventually(func() int { return len(logCache.requests()) }, 3).Should(BeNumerically(">=", 2))
+				Consistently(errs).ShouldNot(Receive())
+			})
+
+			It("doesn't modify the given options", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithMaxLimit(10))
+
+				opts := make([]client.ReadOption, 1, 2)
+				opts[0] = client.WithDescending()
+				spare := opts[:2]
+				spare[1] = client.WithEnvelopeTypes(rpc.EnvelopeType_LOG)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				envelopes, _ := logcache_client.ReadChan(ctx, "some-id", time.Unix(0, 99), opts...)
+				Eventually(envelopes).Should(Receive())
+
+				Expect(spare[1]).ToNot(BeNil())
+				u := &url.URL{}
+				q := u.Query()
+				spare[1](u, q)
+				Expect(q.Get("envelope_types")).To(Equal("LOG"))
+			})
+
+			It("sends a failed read and closes both channels", func() {
+				logCache := newStubLogCache()
+				logCache.statusCode = 500
+				logcache_client := client.NewClient(logCache.addr())
+
+				envelopes, errs := logcache_client.ReadChan(context.Background(), "some-id", time.Unix(0, 99))
+
+				Eventually(errs).Should(Receive(HaveOccurred()))
+				Eventually(envelopes).Should(BeClosed())
+				Eventually(errs).Should(BeClosed())
+			})
+		})
+
+		Describe("Exporter", func() {
+			It("exports every envelope of the window as NDJSON", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				var buf bytes.Buffer
+				err := client.NewExporter(logcache_client).Export(context.Background(), "some-id",
+					time.Unix(0, 99), time.Unix(0, 200), &buf, client.FormatNDJSON)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(buf.String()).To(Equal(
+					`{"timestamp":"99","sourceId":"some-id"}` + "\n" +
+						`{"timestamp":"100","sourceId":"some-id"}` + "\n",
+				))
+				Expect(logCache.requests()).To(HaveLen(2))
+				assertQueryParam(logCache.requests()[1].URL, "start_time", "101")
+				assertQueryParam(logCache.requests()[1].URL, "end_time", "200")
+			})
+
+			It("exports every envelope of the window as CSV", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				var buf bytes.Buffer
+				err := client.NewExporter(logcache_client).Export(context.Background(), "some-id",
+					time.Unix(0, 99), time.Unix(0, 200), &buf, client.FormatCSV)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(buf.String()).To(Equal(
+					"timestamp,source_id,instance_id,type,name,value\n" +
+						"99,some-id,,,,\n" +
+						"100,some-id,,,,\n",
+				))
+			})
+
+			It("keeps exporting past a page emptied by a client side filter", func() {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Query().Get("start_time") {
+					case "0":
+						w.Write([]byte(`{"envelopes": {"batch": [
+							{"timestamp": 1, "source_id": "some-id", "log": {}},
+							{"timestamp": 2, "source_id": "some-id", "log": {}}
+						]}}`))
+					case "3":
+						w.Write([]byte(`{"envelopes": {"batch": [
+							{"timestamp": 5, "source_id": "some-id", "log": {"payload": "c29tZS1sb2c="}}
+						]}}`))
+					default:
+						w.Write([]byte(`{"envelopes": {"batch": []}}`))
+					}
+				}))
+				defer server.Close()
+				logcache_client := client.NewClient(server.URL,
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+					client.WithDefaultReadOptions(client.WithNonEmptyPayloads()),
+				)
+
+				var buf bytes.Buffer
+				err := client.NewExporter(logcache_client).Export(context.Background(), "some-id",
+					time.Unix(0, 0), time.Unix(0, 10), &buf, client.FormatCSV)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(buf.String()).To(Equal(
+					"timestamp,source_id,instance_id,type,name,value\n" +
+						"5,some-id,,log,,some-log\n",
+				))
+			})
+
+			It("stops once the context is done", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				var buf bytes.Buffer
+				err := client.NewExporter(logcache_client).Export(ctx, "some-id",
+					time.Unix(0, 99), time.Unix(0, 200), &buf, client.FormatNDJSON)
+				Expect(err).To(Equal(context.Canceled))
+				Expect(buf.String()).To(BeEmpty())
+			})
+		})
+
+		Describe("ReadSources", func() {
+			It("reads each of the sources", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/other-id"] = logCache.result["GET/api/v1/read/some-id"]
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.ReadSources(context.Background(), []string{"some-id", "other-id"}, time.Unix(0, 99),
+					client.WithLimit(10),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes["some-id"]).To(HaveLen(2))
+				Expect(envelopes["other-id"]).To(HaveLen(2))
+				for _, req := range logCache.requests() {
+					assertQueryParam(req.URL, "limit", "10")
+				}
+			})
+
+			It("returns the envelopes of the other sources with the errors", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.ReadSources(context.Background(), []string{"some-id", "missing-id"}, time.Unix(0, 99))
+				Expect(err).To(BeAssignableToTypeOf(client.SourceErrors{}))
+				Expect(err.(client.SourceErrors)).To(HaveKey("missing-id"))
+				Expect(envelopes).To(HaveKey("some-id"))
+			})
+		})
+
+		Describe("ReadGlob", func() {
+			It("reads every source that matches the pattern", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/meta"] = []byte(`{
+		"meta": {
+			"app-foo-1": {},
+			"app-foo-2": {},
+			"app-bar-1": {}
+		}
+	}`)
+				logCache.result["GET/api/v1/read/app-foo-1"] = logCache.result["GET/api/v1/read/some-id"]
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.ReadGlob(context.Background(), "app-foo-*", time.Unix(0, 99))
+				Expect(err).To(BeAssignableToTypeOf(client.SourceErrors{}))
+				Expect(err.(client.SourceErrors)).To(HaveKey("app-foo-2"))
+
+				Expect(envelopes).To(HaveLen(1))
+				Expect(envelopes["app-foo-1"]).To(HaveLen(2))
+				Expect(logCache.requests()).To(HaveLen(3))
+			})
+
+			It("returns an error for an invalid pattern", func() {
+				logcache_client := client.NewClient("")
+
+				_, err := logcache_client.ReadGlob(context.Background(), "[", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("ReadSince", func() {
+			It("returns the envelopes and the next checkpoint", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, checkpoint, err := logcache_client.ReadSince(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+				Expect(checkpoint).To(Equal(time.Unix(0, 101)))
+				assertQueryParam(logCache.requests()[0].URL, "start_time", "99")
+			})
+
+			It("returns the given checkpoint without envelopes", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
+				logcache_client := client.NewClient(logCache.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, checkpoint, err := logcache_client.ReadSince(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(BeEmpty())
+				Expect(checkpoint).To(Equal(time.Unix(0, 99)))
+			})
+		})
+
+		Describe("NewClientFromEnv", func() {
+			BeforeEach(func() {
+				os.Unsetenv("LOG_CACHE_ADDR")
+				os.Unsetenv("LOG_CACHE_TOKEN")
+				os.Unsetenv("LOG_CACHE_SKIP_TLS_VERIFY")
+				os.Unsetenv("LOG_CACHE_VIA_GRPC")
+			})
+
+			It("configures the client from the environment", func() {
+				logCache := newStubLogCache()
+				os.Setenv("LOG_CACHE_ADDR", logCache.addr())
+				os.Setenv("LOG_CACHE_TOKEN", "bearer some-token")
+
+				logcache_client, err := client.NewClientFromEnv(client.WithAPIVersion(client.APIv1))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.requests()[0].Header.Get("Authorization")).To(Equal("bearer some-token"))
+			})
+
+			It("returns an error without an address", func() {
+				_, err := client.NewClientFromEnv()
+				Expect(err).To(MatchError(ContainSubstring("LOG_CACHE_ADDR")))
+			})
+
+			It("returns an error for an invalid bool", func() {
+				os.Setenv("LOG_CACHE_ADDR", "https://log-cache.example.com")
+				os.Setenv("LOG_CACHE_VIA_GRPC", "maybe")
+
+				_, err := client.NewClientFromEnv()
+				Expect(err).To(MatchError(ContainSubstring("LOG_CACHE_VIA_GRPC")))
+			})
+		})
+
+		Describe("LastN", func() {
+			It("returns the most recent envelopes in chronological order", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 102, "source_id": "some-id"},
+				{"timestamp": 101, "source_id": "some-id"},
+				{"timestamp": 100, "source_id": "some-id"}
+			]
+		}
+	}`)
+				logcache_client := client.NewClient(logCache.addr())
+
+				envelopes, err := logcache_client.LastN(context.Background(), "some-id", 3,
+					client.WithEnvelopeTypes(rpc.EnvelopeType_LOG),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(3))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(100))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(101))
+				Expect(envelopes[2].Timestamp).To(BeEquivalentTo(102))
+
+				Expect(logCache.reqs).To(HaveLen(2))
+				assertQueryParam(logCache.reqs[1].URL, "descending", "true")
+				assertQueryParam(logCache.reqs[1].URL, "limit", "3")
+				assertQueryParam(logCache.reqs[1].URL, "envelope_types", "LOG")
+			})
+
+			It("returns fewer envelopes when the source has fewer than n", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				envelopes, err := logcache_client.LastN(context.Background(), "some-id", 100)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+			})
+
+			It("reads in pages of the max limit", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMaxLimit(2),
+				)
+
+				envelopes, err := logcache_client.LastN(context.Background(), "some-id", 3)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(3))
+
+				Expect(logCache.requests()).To(HaveLen(2))
+				assertQueryParam(logCache.requests()[0].URL, "limit", "2")
+				assertQueryParam(logCache.requests()[1].URL, "limit", "1")
+				assertQueryParam(logCache.requests()[1].URL, "end_time", "100")
+			})
+
+			It("stops paging once the byte budget is exceeded", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMaxLimit(2),
+				)
+
+				// Each envelope has an encoded size of 11 bytes.
+				envelopes, err := logcache_client.LastN(context.Background(), "some-id", 10,
+					client.WithMaxBytes(30),
+				)
+				Expect(err).To(Equal(client.ErrBudgetExceeded))
+				Expect(envelopes).To(HaveLen(2))
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("returns an error for a non-positive n", func() {
+				logcache_client := client.NewClient("")
+
+				_, err := logcache_client.LastN(context.Background(), "some-id", 0)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("WithRequestIDFromContext", func() {
+			type requestIDKey struct{}
+
+			It("sends the request ID as a header", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithRequestIDFromContext(requestIDKey{}))
+
+				ctx := context.WithValue(context.Background(), requestIDKey{}, "some-request-id")
+				_, err := logcache_client.Read(ctx, "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs).To(HaveLen(2))
+				for _, req := range logCache.reqs {
+					Expect(req.Header.Get("X-Request-ID")).To(Equal("some-request-id"))
+				}
+			})
+
+			It("includes the request ID in errors", func() {
+				logCache := newStubLogCache()
+				logCache.statusCode = 500
+				logcache_client := client.NewClient(logCache.addr(), client.WithRequestIDFromContext(requestIDKey{}))
+
+				ctx := context.WithValue(context.Background(), requestIDKey{}, "some-request-id")
+				_, err := logcache_client.PromQL(ctx, "some-query")
+				Expect(err).To(MatchError(ContainSubstring("some-request-id")))
+			})
+
+			It("does not send a header without a request ID", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithRequestIDFromContext(requestIDKey{}))
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logCache.reqs[1].Header).ToNot(HaveKey("X-Request-Id"))
+			})
+		})
+
+		Describe("Meta", func() {
+			It("retrieves meta information", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				meta, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(meta).To(HaveLen(2))
+				Expect(meta).To(HaveKey("source-0"))
+				Expect(meta).To(HaveKey("source-1"))
+			})
+
+			It("adds the extra query params", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithExtraQueryParam("some-param", "some-value"),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				assertQueryParam(logCache.reqs[0].URL, "some-param", "some-value")
+			})
+
+			It("retrieves the meta information of a single source", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				meta, err := logcache_client.MetaFor(context.Background(), "source-1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).ToNot(BeNil())
+
+				_, err = logcache_client.MetaFor(context.Background(), "source-2")
+				Expect(err).To(Equal(client.ErrSourceNotFound))
+			})
+
+			It("reports the call to the debug logger", func() {
+				logCache := newStubLogCache()
+				var calls []string
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithDebugLogger(func(method, url string, status int, dur time.Duration) {
+						calls = append(calls, fmt.Sprintf("%s %s %d", method, url, status))
+					}),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(calls).To(Equal([]string{
+					fmt.Sprintf("GET %s/api/v1/meta 200", logCache.addr()),
+				}))
+			})
+
+			It("publishes metrics about the calls", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithOwnMetrics(),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				logCache.statusCode = 500
+				_, err = logcache_client.Meta(context.Background())
+				Expect(err).To(HaveOccurred())
+
+				recorder := httptest.NewRecorder()
+				logcache_client.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				Expect(recorder.Body.String()).To(ContainSubstring("client_requests 2"))
+				Expect(recorder.Body.String()).To(ContainSubstring("client_errors 1"))
+				Expect(recorder.Body.String()).To(ContainSubstring(`client_request_duration_seconds_count{unit="seconds"} 2`))
+			})
+
+			It("has no metrics handler by default", func() {
+				Expect(client.NewClient("").MetricsHandler()).To(BeNil())
+			})
+
+			It("retries a call to an unavailable LogCache", func() {
+				logCache := newStubLogCache()
+				logCache.unavailable = 2
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithRetry(3, client.WithBackoff(client.ConstantBackoff{Interval: time.Millisecond})),
+				)
+
+				meta, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).To(HaveLen(2))
+				Expect(logCache.requests()).To(HaveLen(3))
+			})
+
+			It("gives up after the max attempts", func() {
+				logCache := newStubLogCache()
+				logCache.unavailable = 3
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithRetry(2, client.WithBackoff(client.ConstantBackoff{Interval: time.Millisecond})),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).To(MatchError(ContainSubstring("503")))
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("waits for the Retry-After of a rate limited call", func() {
+				logCache := newStubLogCache()
+				logCache.tooManyRequests = 1
+				logCache.retryAfter = "0"
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithRetry(3, client.WithBackoff(client.ConstantBackoff{Interval: time.Hour})),
+				)
+
+				meta, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).To(HaveLen(2))
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("accepts the Retry-After as an HTTP date", func() {
+				logCache := newStubLogCache()
+				logCache.tooManyRequests = 1
+				logCache.retryAfter = time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithRetry(3, client.WithBackoff(client.ConstantBackoff{Interval: time.Hour})),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("caps the Retry-After", func() {
+				logCache := newStubLogCache()
+				logCache.tooManyRequests = 1
+				logCache.retryAfter = "3600"
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithRetry(3, client.WithMaxRetryAfter(time.Millisecond)),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("serves meta information from the cache", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMetaCache(time.Hour),
+				)
+
+				meta, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).To(HaveLen(2))
+
+				meta, err = logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).To(HaveLen(2))
+				Expect(logCache.requests()).To(HaveLen(1))
+
+				_, err = logcache_client.MetaFresh(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.requests()).To(HaveLen(2))
+			})
+
+			It("refreshes expired meta information in the background", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithMetaCache(10*time.Millisecond),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				time.Sleep(20 * time.Millisecond)
+
+				meta, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(meta).To(HaveLen(2))
+				Eventually(logCache.requests).Should(HaveLen(2))
+			})
+
+			It("merges the meta information of every node", func() {
+				node0 := newStubLogCache()
+				node0.result["GET/api/v1/meta"] = []byte(`{
+		"meta": {
+			"source-0": {"count": "3", "expired": "1", "oldestTimestamp": "100", "newestTimestamp": "200"},
+			"source-1": {"count": "1", "oldestTimestamp": "50", "newestTimestamp": "50"}
+		}
+	}`)
+				node1 := newStubLogCache()
+				node1.result["GET/api/v1/meta"] = []byte(`{
+		"meta": {
+			"source-0": {"count": "2", "expired": "4", "oldestTimestamp": "90", "newestTimestamp": "150"}
+		}
+	}`)
+				unreachable := newStubLogCache()
+				unreachable.server.Close()
+
+				logcache_client := client.NewClient(node0.addr(), client.WithAPIVersion(client.APIv1))
+
+				meta, err := logcache_client.MetaAll(context.Background(), []string{
+					node0.addr(),
+					node1.addr(),
+					unreachable.addr(),
+				})
+
+				nodeErrs, ok := err.(client.NodeErrors)
+				Expect(ok).To(BeTrue())
+				Expect(nodeErrs).To(HaveLen(1))
+				Expect(nodeErrs).To(HaveKey(unreachable.addr()))
+
+				Expect(meta).To(HaveLen(2))
+				Expect(meta["source-0"].Count).To(BeEquivalentTo(5))
+				Expect(meta["source-0"].Expired).To(BeEquivalentTo(5))
+				Expect(meta["source-0"].OldestTimestamp).To(BeEquivalentTo(90))
+				Expect(meta["source-0"].NewestTimestamp).To(BeEquivalentTo(200))
+				Expect(meta["source-1"].Count).To(BeEquivalentTo(1))
+
+				assertQueryParam(node0.requests()[0].URL, "local_only", "true")
+			})
+
+			It("reads the union of the nodes", func() {
+				node0 := newStubLogCache()
+				node1 := newStubLogCache()
+				node1.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 100, "source_id": "some-id"},
+				{"timestamp": 100, "source_id": "some-id", "instance_id": "1"},
+				{"timestamp": 101, "source_id": "some-id"}
+			]
+		}
+	}`)
+				unreachable := newStubLogCache()
+				unreachable.server.Close()
+
+				logcache_client := client.NewClient(node0.addr(), client.WithAPIVersion(client.APIv1))
+
+				envelopes, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+					node0.addr(),
+					node1.addr(),
+					unreachable.addr(),
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(envelopes).To(HaveLen(4))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(99))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(100))
+				Expect(envelopes[2].Timestamp).To(BeEquivalentTo(100))
+				Expect(envelopes[3].Timestamp).To(BeEquivalentTo(101))
+			})
 
-				assertQueryParam(logCache.reqs[1].URL, "start_time", "99")
-				assertQueryParam(logCache.reqs[1].URL, "end_time", "101")
-				assertQueryParam(logCache.reqs[1].URL, "limit", "103")
-				assertQueryParam(logCache.reqs[1].URL, "envelope_types", "LOG", "GAUGE")
-				assertQueryParam(logCache.reqs[1].URL, "name_filter", "name.*")
-				assertQueryParam(logCache.reqs[1].URL, "descending", "true")
+			It("orders and limits the union like a read", func() {
+				node0 := newStubLogCache()
+				node1 := newStubLogCache()
+				node1.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 101, "source_id": "some-id"}
+			]
+		}
+	}`)
 
-				Expect(logCache.reqs[1].URL.Query()).To(HaveLen(6))
-			})
+				logcache_client := client.NewClient(node0.addr(), client.WithAPIVersion(client.APIv1))
 
-			It("closes the body", func() {
-				spyHTTPClient := newSpyHTTPClient()
-				logcache_client := client.NewClient("", client.WithHTTPClient(spyHTTPClient))
-				logcache_client.Read(context.Background(), "some-name", time.Now())
+				envelopes, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+					node0.addr(),
+					node1.addr(),
+				}, client.WithDescending(), client.WithLimit(2))
+				Expect(err).ToNot(HaveOccurred())
 
-				Expect(spyHTTPClient.body.closed).To(BeTrue())
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(101))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(100))
 			})
 
-			It("returns an error on a non-200 status", func() {
-				logCache := newStubLogCache()
-				logCache.statusCode = 500
-				logcache_client := client.NewClient(logCache.addr())
+			It("orders and limits the union with the default options and max limit", func() {
+				node0 := newStubLogCache()
+				node1 := newStubLogCache()
+				node1.result["GET/api/v1/read/some-id"] = []byte(`{
+		"envelopes": {
+			"batch": [
+				{"timestamp": 101, "source_id": "some-id"}
+			]
+		}
+	}`)
 
-				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
-				Expect(err).To(HaveOccurred())
-			})
+				logcache_client := client.NewClient(node0.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithDefaultReadOptions(client.WithDescending()),
+					client.WithMaxLimit(2),
+				)
 
-			It("returns an error on invalid JSON", func() {
-				logCache := newStubLogCache()
-				logCache.result["GET/api/v1/read/some-id"] = []byte("invalid")
-				logcache_client := client.NewClient(logCache.addr())
+				envelopes, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+					node0.addr(),
+					node1.addr(),
+				}, client.WithLimit(10))
+				Expect(err).ToNot(HaveOccurred())
 
-				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
-				Expect(err).To(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+				Expect(envelopes[0].Timestamp).To(BeEquivalentTo(101))
+				Expect(envelopes[1].Timestamp).To(BeEquivalentTo(100))
 			})
 
-			It("returns an error on empty JSON", func() {
-				logCache := newStubLogCache()
-				logCache.result["GET/api/v1/read/some-id"] = []byte("{}")
-				logcache_client := client.NewClient(logCache.addr())
+			It("does not count an empty node as failed with WithEmptyResultError", func() {
+				node0 := newStubLogCache()
+				node1 := newStubLogCache()
+				node1.result["GET/api/v1/read/some-id"] = []byte(`{"envelopes": {"batch": []}}`)
 
-				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				logcache_client := client.NewClient(node0.addr(),
+					client.WithAPIVersion(client.APIv1),
+					client.WithEmptyResultError(),
+				)
+
+				envelopes, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+					node0.addr(),
+					node1.addr(),
+				})
 				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
 			})
 
-			It("returns an error on an invalid URL", func() {
-				logcache_client := client.NewClient("http://invalid.url")
+			It("is canceled by Shutdown", func() {
+				node0 := newStubLogCache()
+				node0.block = true
+				logcache_client := client.NewClient(node0.addr(), client.WithAPIVersion(client.APIv1))
 
-				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
-				Expect(err).To(HaveOccurred())
+				errs := make(chan error, 1)
+				go func() {
+					_, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+						node0.addr(),
+					})
+					errs <- err
+				}()
 
-				logcache_client = client.NewClient("-:-invalid")
+				// Give the read time to block on the LogCache.
+				time.Sleep(100 * time.Millisecond)
 
-				_, err = logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
-				Expect(err).To(HaveOccurred())
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				Expect(logcache_client.Shutdown(ctx)).To(Succeed())
+
+				Eventually(errs).Should(Receive(HaveOccurred()))
 			})
 
-			It("returns an error when the read is cancelled", func() {
-				logCache := newStubLogCache()
-				logCache.block = true
-				logcache_client := client.NewClient(logCache.addr())
+			It("returns an error if no majority of the nodes could be read", func() {
+				node0 := newStubLogCache()
+				unreachable := newStubLogCache()
+				unreachable.server.Close()
 
-				ctx, cancel := context.WithCancel(context.Background())
-				cancel()
+				logcache_client := client.NewClient(node0.addr(), client.WithAPIVersion(client.APIv1))
 
-				_, err := logcache_client.Read(ctx, "some-id", time.Unix(0, 99))
-				Expect(err).To(HaveOccurred())
+				envelopes, err := logcache_client.ReadQuorum(context.Background(), "some-id", time.Unix(0, 99), []string{
+					node0.addr(),
+					unreachable.addr(),
+				})
+
+				nodeErrs, ok := err.(client.NodeErrors)
+				Expect(ok).To(BeTrue())
+				Expect(nodeErrs).To(HaveKey(unreachable.addr()))
+				Expect(envelopes).To(HaveLen(2))
 			})
-		})
 
-		Describe("Meta", func() {
-			It("retrieves meta information", func() {
+			It("summarizes meta information sorted by source ID", func() {
 				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/meta"] = []byte(`{
+		"meta": {
+			"source-1": {"count": "3", "expired": "1", "oldestTimestamp": "100", "newestTimestamp": "200"},
+			"source-0": {}
+		}
+	}`)
 				logcache_client := client.NewClient(logCache.addr())
 
-				meta, err := logcache_client.Meta(context.Background())
+				summary, err := logcache_client.MetaSummary(context.Background())
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(meta).To(HaveLen(2))
-				Expect(meta).To(HaveKey("source-0"))
-				Expect(meta).To(HaveKey("source-1"))
+				Expect(summary).To(Equal([]client.SourceMeta{
+					{
+						SourceID:        "source-0",
+						OldestTimestamp: time.Unix(0, 0),
+						NewestTimestamp: time.Unix(0, 0),
+					},
+					{
+						SourceID:        "source-1",
+						Count:           3,
+						Expired:         1,
+						OldestTimestamp: time.Unix(0, 100),
+						NewestTimestamp: time.Unix(0, 200),
+					},
+				}))
 			})
 
 			It("falls back to the pre-1.4.7 endpoint", func() {
@@ -312,6 +2130,59 @@ var _ = Describe("Log Cache Client", func() {
 				Expect(logCache.reqs[0].URL.Query()).To(HaveLen(2))
 			})
 
+			It("applies the default options before the given ones", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithDefaultPromQLOptions(
+						client.WithPromQLTime(time.Unix(99, 0)),
+						client.WithPromQLTimeout(time.Minute),
+					),
+				)
+
+				_, err := logcache_client.PromQL(
+					context.Background(),
+					"some-query",
+					client.WithPromQLTime(time.Unix(101, 455700000)),
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				assertQueryParam(logCache.reqs[0].URL, "time", "101.456")
+				assertQueryParam(logCache.reqs[0].URL, "timeout", "1m")
+			})
+
+			It("sets the timeout in the Prometheus duration syntax", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.PromQL(context.Background(), "some-query",
+					client.WithPromQLTimeout(90*time.Second),
+				)
+				Expect(err).ToNot(HaveOccurred())
+				assertQueryParam(logCache.reqs[0].URL, "timeout", "90s")
+
+				_, err = logcache_client.PromQL(context.Background(), "some-query",
+					client.WithPromQLTimeout(1500*time.Millisecond),
+				)
+				Expect(err).ToNot(HaveOccurred())
+				assertQueryParam(logCache.reqs[1].URL, "timeout", "1500ms")
+			})
+
+			It("returns an error for a timeout that is not positive", func() {
+				logCache := newStubLogCache()
+				logcache_client := client.NewClient(logCache.addr())
+
+				_, err := logcache_client.PromQL(context.Background(), "some-query",
+					client.WithPromQLTimeout(0),
+				)
+				Expect(err).To(HaveOccurred())
+
+				_, err = logcache_client.PromQLRange(context.Background(), "some-query",
+					client.WithPromQLTimeout(-time.Second),
+				)
+				Expect(err).To(HaveOccurred())
+				Expect(logCache.reqs).To(BeEmpty())
+			})
+
 			It("closes the body", func() {
 				spyHTTPClient := newSpyHTTPClient()
 				logcache_client := client.NewClient("", client.WithHTTPClient(spyHTTPClient))
@@ -550,6 +2421,47 @@ var _ = Describe("Log Cache Client", func() {
 			})
 		})
 
+		Describe("PromQLRangeStream", func() {
+			It("visits each series until the visitor is done", func() {
+				logCache := newStubLogCache()
+				logCache.result["GET/api/v1/query_range"] = []byte(`
+    {
+	  "status": "success",
+	  "data": {
+		"resultType": "matrix",
+        "result": [
+          {"metric": {"deployment": "cf-0"}, "values": [[1234, "99"]]},
+          {"metric": {"deployment": "cf-1"}, "values": [[1234, "100"]]},
+          {"metric": {"deployment": "cf-2"}, "values": [[1234, "101"]]}
+        ]
+      }
+    }
+			`)
+				logcache_client := client.NewClient(logCache.addr())
+
+				var visited []string
+				err := logcache_client.PromQLRangeStream(context.Background(), "some-query", nil,
+					func(series *rpc.PromQL_Series) bool {
+						visited = append(visited, series.GetMetric()["deployment"])
+						return len(visited) < 2
+					},
+				)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(visited).To(Equal([]string{"cf-0", "cf-1"}))
+			})
+
+			It("returns an error on a non-200 status", func() {
+				logCache := newStubLogCache()
+				logCache.statusCode = 500
+				logcache_client := client.NewClient(logCache.addr())
+
+				err := logcache_client.PromQLRangeStream(context.Background(), "some-query", nil,
+					func(*rpc.PromQL_Series) bool { return true },
+				)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		Describe("PromQLRangeRaw", func() {
 			It("retrieves points", func() {
 				logCache := newStubLogCache()
@@ -644,6 +2556,51 @@ var _ = Describe("Log Cache Client", func() {
 
 	Context("gRPC client", func() {
 		Describe("Read", func() {
+			It("connects via a unix socket", func() {
+				dir, err := ioutil.TempDir("", "log-cache-client")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.RemoveAll(dir)
+				socket := filepath.Join(dir, "log-cache.sock")
+
+				lis, err := net.Listen("unix", socket)
+				Expect(err).ToNot(HaveOccurred())
+				srv := grpc.NewServer()
+				rpc.RegisterEgressServer(srv, &stubGrpcLogCache{})
+				go srv.Serve(lis)
+				defer srv.Stop()
+
+				logcache_client := client.NewClient("log-cache",
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithUnixSocket(socket),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+			})
+
+			It("captures the encoded request and response", func() {
+				logCache := newStubGrpcLogCache()
+				var rawReq, rawResp []byte
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithCapture(func(req, resp []byte) {
+						rawReq, rawResp = req, resp
+					}),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+
+				var req rpc.ReadRequest
+				Expect(proto.Unmarshal(rawReq, &req)).To(Succeed())
+				Expect(req.SourceId).To(Equal("some-id"))
+
+				var resp rpc.ReadResponse
+				Expect(proto.Unmarshal(rawResp, &resp)).To(Succeed())
+				Expect(resp.GetEnvelopes().GetBatch()).To(HaveLen(2))
+			})
+
 			It("reads envelopes", func() {
 				logCache := newStubGrpcLogCache()
 				logcache_client := client.NewClient(logCache.addr(), client.WithViaGRPC(grpc.WithInsecure()))
@@ -683,6 +2640,57 @@ var _ = Describe("Log Cache Client", func() {
 				)))
 			})
 
+			It("sends the configured authority", func() {
+				logCache := newStubGrpcLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithGRPCAuthority("log-cache.example.com"),
+				)
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logCache.authorities).To(ConsistOf("log-cache.example.com"))
+			})
+
+			It("compresses the calls with the given compressor", func() {
+				logCache := newStubGrpcLogCache()
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithGRPCCompression("gzip"),
+				)
+
+				envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(envelopes).To(HaveLen(2))
+
+				logcache_client = client.NewClient(logCache.addr(),
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithGRPCCompression("unknown"),
+				)
+
+				_, err = logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("applies keepalive parameters regardless of the option order", func() {
+				logCache := newStubGrpcLogCache()
+				params := keepalive.ClientParameters{
+					Time:                time.Minute,
+					PermitWithoutStream: true,
+				}
+
+				for _, opts := range [][]client.ClientOption{
+					{client.WithGRPCKeepalive(params), client.WithViaGRPC(grpc.WithInsecure())},
+					{client.WithViaGRPC(grpc.WithInsecure()), client.WithGRPCKeepalive(params)},
+				} {
+					logcache_client := client.NewClient(logCache.addr(), opts...)
+
+					envelopes, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(envelopes).To(HaveLen(2))
+				}
+			})
+
 			It("returns an error when the context is cancelled", func() {
 				logCache := newStubGrpcLogCache()
 				logCache.block = true
@@ -703,6 +2711,38 @@ var _ = Describe("Log Cache Client", func() {
 			})
 		})
 
+		Describe("Shutdown", func() {
+			It("closes the gRPC connection", func() {
+				logCache := newStubGrpcLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithViaGRPC(grpc.WithInsecure()))
+
+				Expect(logcache_client.Shutdown(context.Background())).To(Succeed())
+
+				_, err := logcache_client.Read(context.Background(), "some-id", time.Unix(0, 99))
+				Expect(err).To(Equal(client.ErrShutdown))
+			})
+		})
+
+		Describe("PromQLRangeStream", func() {
+			It("visits each series", func() {
+				logCache := newStubGrpcLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithViaGRPC(grpc.WithInsecure()))
+
+				var visited []*rpc.PromQL_Series
+				err := logcache_client.PromQLRangeStream(context.Background(), "some-query",
+					[]client.PromQLOption{client.WithPromQLStep("1m")},
+					func(series *rpc.PromQL_Series) bool {
+						visited = append(visited, series)
+						return true
+					},
+				)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(visited).To(HaveLen(1))
+				Expect(visited[0].GetMetric()).To(HaveKeyWithValue("__name__", "test"))
+			})
+		})
+
 		Describe("Meta", func() {
 			It("retrieves meta information", func() {
 				logCache := newStubGrpcLogCache()
@@ -716,6 +2756,22 @@ var _ = Describe("Log Cache Client", func() {
 				Expect(meta).To(HaveKey("source-1"))
 			})
 
+			It("reports the call to the debug logger", func() {
+				logCache := newStubGrpcLogCache()
+				var calls []string
+				logcache_client := client.NewClient(logCache.addr(),
+					client.WithViaGRPC(grpc.WithInsecure()),
+					client.WithGRPCDebugLogger(func(method string, code codes.Code, dur time.Duration) {
+						calls = append(calls, fmt.Sprintf("%s %s", method, code))
+					}),
+				)
+
+				_, err := logcache_client.Meta(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(calls).To(Equal([]string{"/logcache.v1.Egress/Meta OK"}))
+			})
+
 			It("returns an error when the context is cancelled", func() {
 				logCache := newStubGrpcLogCache()
 				logcache_client := client.NewClient(logCache.addr(), client.WithViaGRPC(grpc.WithInsecure()))
@@ -735,6 +2791,7 @@ var _ = Describe("Log Cache Client", func() {
 
 				result, err := logcache_client.PromQL(context.Background(), "some-query",
 					client.WithPromQLTime(time.Unix(99, 0)),
+					client.WithPromQLTimeout(2*time.Minute),
 				)
 
 				Expect(err).ToNot(HaveOccurred())
@@ -746,13 +2803,49 @@ var _ = Describe("Log Cache Client", func() {
 				Expect(logCache.promInstantReqs).To(ConsistOf(PointTo(
 					MatchFields(IgnoreExtras,
 						Fields{
-							"Query": Equal("some-query"),
-							"Time":  Equal("99.000"),
+							"Query":   Equal("some-query"),
+							"Time":    Equal("99.000"),
+							"Timeout": Equal("2m"),
 						},
 					),
 				)))
 			})
 
+			It("issues raw instant and range query requests", func() {
+				logCache := newStubGrpcLogCache()
+				logcache_client := client.NewClient(logCache.addr(), client.WithViaGRPC(grpc.WithInsecure()))
+
+				instant, err := logcache_client.InstantQueryRaw(context.Background(), &rpc.PromQL_InstantQueryRequest{
+					Query: "some-query",
+					Time:  "99.000",
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(instant.GetScalar().GetValue()).To(BeEquivalentTo(101))
+				Expect(logCache.promQLRequests()).To(ConsistOf(PointTo(
+					MatchFields(IgnoreExtras, Fields{
+						"Query": Equal("some-query"),
+						"Time":  Equal("99.000"),
+					}),
+				)))
+
+				matrix, err := logcache_client.RangeQueryRaw(context.Background(), &rpc.PromQL_RangeQueryRequest{
+					Query: "some-query",
+					Step:  "1m",
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(matrix.GetMatrix().GetSeries()).To(HaveLen(1))
+			})
+
+			It("returns an error for raw queries via HTTP", func() {
+				logcache_client := client.NewClient("")
+
+				_, err := logcache_client.InstantQueryRaw(context.Background(), &rpc.PromQL_InstantQueryRequest{})
+				Expect(err).To(Equal(client.ErrNotViaGRPC))
+
+				_, err = logcache_client.RangeQueryRaw(context.Background(), &rpc.PromQL_RangeQueryRequest{})
+				Expect(err).To(Equal(client.ErrNotViaGRPC))
+			})
+
 			It("returns an error when the context is cancelled", func() {
 				logCache := newStubGrpcLogCache()
 				logCache.block = true
@@ -772,12 +2865,22 @@ var _ = Describe("Log Cache Client", func() {
 })
 
 type stubLogCache struct {
+	mu         sync.Mutex
 	statusCode int
 	server     *httptest.Server
 	reqs       []*http.Request
 	bodies     [][]byte
 	result     map[string][]byte
 	block      bool
+	delay      time.Duration
+
+	// unavailable is the number of requests to fail with a 503.
+	unavailable int
+
+	// tooManyRequests is the number of requests to fail with a 429 and the
+	// retryAfter header.
+	tooManyRequests int
+	retryAfter      string
 }
 
 func newStubLogCache() *stubLogCache {
@@ -926,13 +3029,30 @@ func (s *stubLogCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var block chan struct{}
 		<-block
 	}
+	time.Sleep(s.delay)
 
 	body, err := ioutil.ReadAll(r.Body)
 	Expect(err).ToNot(HaveOccurred())
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.bodies = append(s.bodies, body)
 	s.reqs = append(s.reqs, r)
 
+	if s.unavailable > 0 {
+		s.unavailable--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.tooManyRequests > 0 {
+		s.tooManyRequests--
+		w.Header().Set("Retry-After", s.retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
 	if _, ok := s.result[r.Method+r.URL.Path]; ok {
 		w.WriteHeader(s.statusCode)
 		w.Write(s.result[r.Method+r.URL.Path])
@@ -941,10 +3061,37 @@ func (s *stubLogCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *stubLogCache) requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := make([]*http.Request, len(s.reqs))
+	copy(r, s.reqs)
+	return r
+}
+
 func assertQueryParam(u *url.URL, name string, values ...string) {
 	Expect(u.Query()).To(HaveKeyWithValue(name, ConsistOf(values)))
 }
 
+type spyDecoder struct {
+	client.DefaultDecoder
+	body string
+}
+
+func (d *spyDecoder) DecodeRead(r io.Reader, resp *rpc.ReadResponse) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d.body = string(body)
+
+	resp.Envelopes = &loggregator_v2.EnvelopeBatch{
+		Batch: []*loggregator_v2.Envelope{{Timestamp: 1}},
+	}
+	return nil
+}
+
 type stubGrpcLogCache struct {
 	mu              sync.Mutex
 	reqs            []*rpc.ReadRequest
@@ -952,6 +3099,7 @@ type stubGrpcLogCache struct {
 	promRangeReqs   []*rpc.PromQL_RangeQueryRequest
 	lis             net.Listener
 	block           bool
+	authorities     []string
 }
 
 func newStubGrpcLogCache() *stubGrpcLogCache {
@@ -982,6 +3130,9 @@ func (s *stubGrpcLogCache) Read(c context.Context, r *rpc.ReadRequest) (*rpc.Rea
 	defer s.mu.Unlock()
 	s.reqs = append(s.reqs, r)
 
+	md, _ := metadata.FromIncomingContext(c)
+	s.authorities = append(s.authorities, md[":authority"]...)
+
 	return &rpc.ReadResponse{
 		Envelopes: &loggregator_v2.EnvelopeBatch{
 			Batch: []*loggregator_v2.Envelope{
@@ -1076,7 +3227,9 @@ type stubBufferCloser struct {
 }
 
 func newStubBufferCloser() *stubBufferCloser {
-	return &stubBufferCloser{}
+	return &stubBufferCloser{
+		Buffer: &bytes.Buffer{},
+	}
 }
 
 func (s *stubBufferCloser) Close() error {
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// DeltaPoint is the increase of a counter since its previous value.
+type DeltaPoint struct {
+	Timestamp time.Time
+	Delta     uint64
+}
+
+// CounterDeltas returns the difference between consecutive totals of the
+// counter envelopes with the given name. Other envelopes are ignored. The
+// envelopes are expected in ascending order (e.g., as returned by Read). A
+// total that is lower than its predecessor means that the counter was reset,
+// and the total itself is then the delta. The first counter envelope has no
+// predecessor and therefore no DeltaPoint.
+func CounterDeltas(envs []*loggregator_v2.Envelope, metricName string) []DeltaPoint {
+	var (
+		points   []DeltaPoint
+		previous uint64
+		found    bool
+	)
+
+	for _, e := range envs {
+		counter := e.GetCounter()
+		if counter == nil || counter.GetName() != metricName {
+			continue
+		}
+
+		total := counter.GetTotal()
+		if !found {
+			previous, found = total, true
+			continue
+		}
+
+		delta := total - previous
+		if total < previous {
+			delta = total
+		}
+		previous = total
+
+		points = append(points, DeltaPoint{
+			Timestamp: time.Unix(0, e.GetTimestamp()),
+			Delta:     delta,
+		})
+	}
+
+	return points
+}
+
+// RatePoint is the per-second rate of a counter since its previous value.
+type RatePoint struct {
+	Timestamp time.Time
+	Rate      float64
+}
+
+// CounterRate returns the per-second rate between consecutive totals of the
+// counter envelopes with the given name, much like PromQL's rate(). Other
+// envelopes are ignored. The envelopes are expected in ascending order
+// (e.g., as returned by Read). Unlike CounterDeltas, there is no RatePoint
+// for an interval in which the counter was reset, as its rate is unknown.
+// Neither is there one for consecutive envelopes with the same timestamp.
+func CounterRate(envs []*loggregator_v2.Envelope, metricName string) []RatePoint {
+	var (
+		points   []RatePoint
+		previous *loggregator_v2.Envelope
+	)
+
+	for _, e := range envs {
+		counter := e.GetCounter()
+		if counter == nil || counter.GetName() != metricName {
+			continue
+		}
+
+		if previous == nil {
+			previous = e
+			continue
+		}
+
+		total, previousTotal := counter.GetTotal(), previous.GetCounter().GetTotal()
+		elapsed := time.Duration(e.GetTimestamp() - previous.GetTimestamp())
+		previous = e
+
+		if total < previousTotal || elapsed <= 0 {
+			continue
+		}
+
+		points = append(points, RatePoint{
+			Timestamp: time.Unix(0, e.GetTimestamp()),
+			Rate:      float64(total-previousTotal) / elapsed.Seconds(),
+		})
+	}
+
+	return points
+}
@@ -0,0 +1,83 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/pkg/client"
+)
+
+func TestCounterDeltas(t *testing.T) {
+	t.Parallel()
+
+	envs := []*loggregator_v2.Envelope{
+		counterEnvelope(1, "requests", 10),
+		counterEnvelope(2, "other", 100),
+		counterEnvelope(3, "requests", 15),
+		{Timestamp: 4},
+		counterEnvelope(5, "requests", 15),
+		// The counter was reset.
+		counterEnvelope(6, "requests", 3),
+	}
+
+	deltas := client.CounterDeltas(envs, "requests")
+
+	expected := []client.DeltaPoint{
+		{Timestamp: time.Unix(0, 3), Delta: 5},
+		{Timestamp: time.Unix(0, 5), Delta: 0},
+		{Timestamp: time.Unix(0, 6), Delta: 3},
+	}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Fatalf("expected deltas to equal %v: %v", expected, deltas)
+	}
+}
+
+func TestCounterDeltasWithoutPredecessor(t *testing.T) {
+	t.Parallel()
+
+	deltas := client.CounterDeltas([]*loggregator_v2.Envelope{
+		counterEnvelope(1, "requests", 10),
+	}, "requests")
+
+	if len(deltas) != 0 {
+		t.Fatalf("expected no deltas: %v", deltas)
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	t.Parallel()
+
+	second := int64(time.Second)
+	envs := []*loggregator_v2.Envelope{
+		counterEnvelope(1*second, "requests", 10),
+		counterEnvelope(2*second, "other", 100),
+		counterEnvelope(3*second, "requests", 30),
+		counterEnvelope(4*second, "requests", 35),
+		// The counter was reset.
+		counterEnvelope(5*second, "requests", 3),
+		counterEnvelope(5*second, "requests", 4),
+		counterEnvelope(7*second, "requests", 8),
+	}
+
+	rates := client.CounterRate(envs, "requests")
+
+	expected := []client.RatePoint{
+		{Timestamp: time.Unix(3, 0), Rate: 10},
+		{Timestamp: time.Unix(4, 0), Rate: 5},
+		{Timestamp: time.Unix(7, 0), Rate: 2},
+	}
+	if !reflect.DeepEqual(rates, expected) {
+		t.Fatalf("expected rates to equal %v: %v", expected, rates)
+	}
+}
+
+func counterEnvelope(timestamp int64, name string, total uint64) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: timestamp,
+		Message: &loggregator_v2.Envelope_Counter{
+			Counter: &loggregator_v2.Counter{Name: name, Total: total},
+		},
+	}
+}
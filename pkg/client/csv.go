@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+// MarshalMatrixCSV writes the given range query result as CSV. The first
+// column holds the timestamp and every following column the values of one
+// series. The header row names each series by its label set (e.g.,
+// `{source_id="a"}`). The rows are ordered by timestamp and hold a point for
+// every timestamp of any series. A series without a point at a timestamp
+// has an empty cell.
+func MarshalMatrixCSV(w io.Writer, result *logcache_v1.PromQL_RangeQueryResult) error {
+	series := result.GetMatrix().GetSeries()
+
+	header := []string{"timestamp"}
+	values := make([]map[string]float64, len(series))
+	var timestamps []string
+	seen := make(map[string]bool)
+
+	for i, s := range series {
+		header = append(header, formatLabelSet(s.GetMetric()))
+
+		values[i] = make(map[string]float64)
+		for _, p := range s.GetPoints() {
+			values[i][p.GetTime()] = p.GetValue()
+
+			if !seen[p.GetTime()] {
+				seen[p.GetTime()] = true
+				timestamps = append(timestamps, p.GetTime())
+			}
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return lessTimestamp(timestamps[i], timestamps[j])
+	})
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, t := range timestamps {
+		row := []string{t}
+		for i := range series {
+			v, ok := values[i][t]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatLabelSet formats the given labels sorted by name in the PromQL
+// syntax.
+func formatLabelSet(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// lessTimestamp orders numeric timestamps by their value and falls back to
+// comparing them as strings.
+func lessTimestamp(a, b string) bool {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+
+	return x < y
+}
@@ -0,0 +1,63 @@
+package client_test
+
+import (
+	"bytes"
+	"testing"
+
+	"code.cloudfoundry.org/log-cache/pkg/client"
+	rpc "code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+func TestMarshalMatrixCSV(t *testing.T) {
+	t.Parallel()
+
+	result := &rpc.PromQL_RangeQueryResult{
+		Result: &rpc.PromQL_RangeQueryResult_Matrix{
+			Matrix: &rpc.PromQL_Matrix{
+				Series: []*rpc.PromQL_Series{
+					{
+						Metric: map[string]string{"source_id": "a", "deployment": "cf"},
+						Points: []*rpc.PromQL_Point{
+							{Time: "9.000", Value: 1},
+							{Time: "10.000", Value: 2.5},
+						},
+					},
+					{
+						Metric: map[string]string{"source_id": "b"},
+						Points: []*rpc.PromQL_Point{
+							{Time: "10.000", Value: 3},
+							{Time: "11.000", Value: 4},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := client.MarshalMatrixCSV(&buf, result); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	expected := `timestamp,"{deployment=""cf"",source_id=""a""}","{source_id=""b""}"
+9.000,1,
+10.000,2.5,3
+11.000,,4
+`
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestMarshalMatrixCSVWithoutSeries(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := client.MarshalMatrixCSV(&buf, &rpc.PromQL_RangeQueryResult{}); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	if buf.String() != "timestamp\n" {
+		t.Fatalf("expected only the header, got %q", buf.String())
+	}
+}
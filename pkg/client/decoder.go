@@ -0,0 +1,66 @@
+package client
+
+import (
+	"io"
+
+	"code.cloudfoundry.org/log-cache/pkg/marshaler"
+	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+)
+
+// ResultDecoder decodes the bodies of the HTTP responses of LogCache.
+type ResultDecoder interface {
+	// DecodeRead decodes the response of a read.
+	DecodeRead(r io.Reader, resp *logcache_v1.ReadResponse) error
+
+	// DecodeMeta decodes the response of a meta query.
+	DecodeMeta(r io.Reader, resp *logcache_v1.MetaResponse) error
+
+	// DecodeInstantQuery decodes the result of a PromQL instant query.
+	DecodeInstantQuery(r io.Reader, result *logcache_v1.PromQL_InstantQueryResult) error
+
+	// DecodeRangeQuery decodes the result of a PromQL range query.
+	DecodeRangeQuery(r io.Reader, result *logcache_v1.PromQL_RangeQueryResult) error
+}
+
+// WithDecoder configures the Client to decode the HTTP responses of LogCache
+// with the given ResultDecoder, e.g. with a faster JSON library. It
+// defaults to the DefaultDecoder. It doesn't apply via gRPC.
+func WithDecoder(d ResultDecoder) ClientOption {
+	return clientOptionFunc(func(c interface{}) {
+		switch c := c.(type) {
+		case *Client:
+			c.decoder = d
+		default:
+			panic("unknown type")
+		}
+	})
+}
+
+// DefaultDecoder decodes the responses via the protobuf JSON unmarshaler,
+// and the PromQL results via the marshaler of the LogCache gateway.
+type DefaultDecoder struct{}
+
+// DecodeRead implements ResultDecoder.
+func (DefaultDecoder) DecodeRead(r io.Reader, resp *logcache_v1.ReadResponse) error {
+	// The protobuf JSON unmarshaler decodes the int64 timestamps exactly,
+	// whether they are encoded as JSON strings or numbers. Decoding them via
+	// float64 would lose the precision of nanoseconds.
+	return jsonpb.Unmarshal(r, resp)
+}
+
+// DecodeMeta implements ResultDecoder.
+func (DefaultDecoder) DecodeMeta(r io.Reader, resp *logcache_v1.MetaResponse) error {
+	return jsonpb.Unmarshal(r, resp)
+}
+
+// DecodeInstantQuery implements ResultDecoder.
+func (DefaultDecoder) DecodeInstantQuery(r io.Reader, result *logcache_v1.PromQL_InstantQueryResult) error {
+	return marshaler.NewPromqlMarshaler(&runtime.JSONPb{}).NewDecoder(r).Decode(result)
+}
+
+// DecodeRangeQuery implements ResultDecoder.
+func (DefaultDecoder) DecodeRangeQuery(r io.Reader, result *logcache_v1.PromQL_RangeQueryResult) error {
+	return marshaler.NewPromqlMarshaler(&runtime.JSONPb{}).NewDecoder(r).Decode(result)
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// NewClientFromEnv creates a Client that is configured via the following
+// environment variables:
+//
+// LOG_CACHE_ADDR (required) is the address of LogCache. It is passed to
+// NewClient as is.
+//
+// LOG_CACHE_TOKEN is sent as the Authorization header of each request. It
+// is sent as is, and therefore has to include the token type (e.g.,
+// "bearer ...").
+//
+// LOG_CACHE_SKIP_TLS_VERIFY disables the verification of the certificate of
+// LogCache if set to true.
+//
+// LOG_CACHE_VIA_GRPC enables gRPC (see WithViaGRPC) if set to true. The
+// connection is secured via TLS.
+//
+// The given options are applied after the ones derived from the environment
+// and therefore take precedence.
+func NewClientFromEnv(opts ...ClientOption) (*Client, error) {
+	addr := os.Getenv("LOG_CACHE_ADDR")
+	if addr == "" {
+		return nil, errors.New("LOG_CACHE_ADDR is required")
+	}
+
+	skipTLSVerify, err := envBool("LOG_CACHE_SKIP_TLS_VERIFY")
+	if err != nil {
+		return nil, err
+	}
+
+	viaGRPC, err := envBool("LOG_CACHE_VIA_GRPC")
+	if err != nil {
+		return nil, err
+	}
+
+	token := os.Getenv("LOG_CACHE_TOKEN")
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipTLSVerify}
+
+	var envOpts []ClientOption
+	if viaGRPC {
+		dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+		if token != "" {
+			dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+		}
+		envOpts = append(envOpts, WithViaGRPC(dialOpts...))
+	} else {
+		var h HTTPClient = &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		if token != "" {
+			h = &tokenHTTPClient{c: h, token: token}
+		}
+		envOpts = append(envOpts, WithHTTPClient(h))
+	}
+
+	return NewClient(addr, append(envOpts, opts...)...), nil
+}
+
+// envBool parses the given environment variable as bool. It defaults to
+// false.
+func envBool(name string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a bool: %s", name, v)
+	}
+
+	return b, nil
+}
+
+// tokenHTTPClient sets the Authorization header of any outgoing request
+// that doesn't have one yet.
+type tokenHTTPClient struct {
+	c     HTTPClient
+	token string
+}
+
+// Do implements HTTPClient.
+func (c *tokenHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", c.token)
+	}
+
+	return c.c.Do(req)
+}
+
+// tokenCredentials sends the token as authorization metadata of each gRPC
+// call.
+type tokenCredentials string
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": string(t)}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials.
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
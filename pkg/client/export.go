@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// Format is the encoding of exported envelopes.
+type Format int
+
+const (
+	// FormatNDJSON encodes each envelope as JSON on its own line.
+	FormatNDJSON Format = iota
+
+	// FormatCSV encodes each envelope as a CSV row (see Exporter).
+	FormatCSV
+)
+
+// Exporter exports every envelope of a source in a time window.
+type Exporter struct {
+	c *Client
+}
+
+// NewExporter creates an Exporter that reads via the given Client.
+func NewExporter(c *Client) *Exporter {
+	return &Exporter{c: c}
+}
+
+// Export reads every envelope of the given source from start until end in
+// pages, and writes them to the given writer in the given format. The
+// output is flushed after each page, so it can be consumed while the export
+// is still running. Export stops with the context's error once the context
+// is done.
+//
+// The CSV format has a header row, followed by a row per log, counter,
+// timer and event envelope, and a row per metric of a gauge envelope. The
+// columns are timestamp (in nanoseconds), source_id, instance_id, type,
+// name and value. The value of a log is its payload, the value of a timer
+// its duration in nanoseconds, and the value of an event its body. Logs
+// have no name, and the name of an event is its title.
+func (e *Exporter) Export(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	end time.Time,
+	w io.Writer,
+	format Format,
+) error {
+	bw := bufio.NewWriter(w)
+
+	var enc envelopeEncoder
+	switch format {
+	case FormatNDJSON:
+		enc = &ndjsonEncoder{w: bw}
+	case FormatCSV:
+		csvEnc, err := newCSVEncoder(bw)
+		if err != nil {
+			return err
+		}
+		enc = csvEnc
+	default:
+		return fmt.Errorf("unknown format: %d", format)
+	}
+
+	err := e.c.scan(ctx, sourceID, start, end, nil, func(envelopes []*loggregator_v2.Envelope) error {
+		for _, env := range envelopes {
+			if err := enc.encode(env); err != nil {
+				return err
+			}
+		}
+
+		if err := enc.flush(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := enc.flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// envelopeEncoder encodes envelopes in an export format.
+type envelopeEncoder interface {
+	encode(*loggregator_v2.Envelope) error
+	flush() error
+}
+
+type ndjsonEncoder struct {
+	w io.Writer
+	m jsonpb.Marshaler
+}
+
+func (e *ndjsonEncoder) encode(env *loggregator_v2.Envelope) error {
+	if err := e.m.Marshal(e.w, env); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(e.w, "\n")
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w)}
+	if err := e.w.Write([]string{"timestamp", "source_id", "instance_id", "type", "name", "value"}); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *csvEncoder) encode(env *loggregator_v2.Envelope) error {
+	row := func(typ, name, value string) error {
+		return e.w.Write([]string{
+			strconv.FormatInt(env.GetTimestamp(), 10),
+			env.GetSourceId(),
+			env.GetInstanceId(),
+			typ,
+			name,
+			value,
+		})
+	}
+
+	switch m := env.Message.(type) {
+	case *loggregator_v2.Envelope_Log:
+		return row("log", "", string(m.Log.GetPayload()))
+	case *loggregator_v2.Envelope_Counter:
+		return row("counter", m.Counter.GetName(), strconv.FormatUint(m.Counter.GetTotal(), 10))
+	case *loggregator_v2.Envelope_Gauge:
+		names := make([]string, 0, len(m.Gauge.GetMetrics()))
+		for name := range m.Gauge.GetMetrics() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := strconv.FormatFloat(m.Gauge.GetMetrics()[name].GetValue(), 'f', -1, 64)
+			if err := row("gauge", name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *loggregator_v2.Envelope_Timer:
+		return row("timer", m.Timer.GetName(), strconv.FormatInt(m.Timer.GetStop()-m.Timer.GetStart(), 10))
+	case *loggregator_v2.Envelope_Event:
+		return row("event", m.Event.GetTitle(), m.Event.GetBody())
+	default:
+		return row("", "", "")
+	}
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
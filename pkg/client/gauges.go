@@ -0,0 +1,56 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// RangePoint is the value of a gauge metric at a point in time.
+type RangePoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// GaugePoints returns the values of the gauge metric with the given name.
+// Other envelopes and metrics are ignored. The points keep the order of the
+// envelopes.
+func GaugePoints(envs []*loggregator_v2.Envelope, metricName string) []RangePoint {
+	var points []RangePoint
+	for _, e := range envs {
+		m, ok := e.GetGauge().GetMetrics()[metricName]
+		if !ok {
+			continue
+		}
+
+		points = append(points, RangePoint{
+			Timestamp: time.Unix(0, e.GetTimestamp()),
+			Value:     m.GetValue(),
+		})
+	}
+
+	return points
+}
+
+// SmoothGauge smooths the given points via an exponentially weighted moving
+// average, e.g. to display a noisy gauge. Each value is replaced by alpha
+// times the value plus 1-alpha times the previous smoothed value, so a
+// lower alpha smooths more and an alpha of 1 keeps the values. The first
+// point is returned unchanged. The points are expected in ascending order.
+// It returns an error if alpha is not in (0, 1].
+func SmoothGauge(points []RangePoint, alpha float64) ([]RangePoint, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("alpha must be in (0, 1]: %g", alpha)
+	}
+
+	smoothed := make([]RangePoint, len(points))
+	for i, p := range points {
+		if i > 0 {
+			p.Value = alpha*p.Value + (1-alpha)*smoothed[i-1].Value
+		}
+		smoothed[i] = p
+	}
+
+	return smoothed, nil
+}
@@ -0,0 +1,83 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/pkg/client"
+)
+
+func TestGaugePoints(t *testing.T) {
+	t.Parallel()
+
+	envs := []*loggregator_v2.Envelope{
+		gaugeEnvelope(1, "cpu", 10),
+		gaugeEnvelope(2, "memory", 100),
+		counterEnvelope(3, "cpu", 5),
+		gaugeEnvelope(4, "cpu", 20),
+	}
+
+	points := client.GaugePoints(envs, "cpu")
+
+	expected := []client.RangePoint{
+		{Timestamp: time.Unix(0, 1), Value: 10},
+		{Timestamp: time.Unix(0, 4), Value: 20},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Fatalf("expected points to equal %v: %v", expected, points)
+	}
+}
+
+func TestSmoothGauge(t *testing.T) {
+	t.Parallel()
+
+	points := []client.RangePoint{
+		{Timestamp: time.Unix(0, 1), Value: 10},
+		{Timestamp: time.Unix(0, 2), Value: 20},
+		{Timestamp: time.Unix(0, 3), Value: 0},
+	}
+
+	smoothed, err := client.SmoothGauge(points, 0.5)
+	if err != nil {
+		t.Fatalf("expected no error: %s", err)
+	}
+
+	// The first point is passed through unchanged.
+	expected := []client.RangePoint{
+		{Timestamp: time.Unix(0, 1), Value: 10},
+		{Timestamp: time.Unix(0, 2), Value: 15},
+		{Timestamp: time.Unix(0, 3), Value: 7.5},
+	}
+	if !reflect.DeepEqual(smoothed, expected) {
+		t.Fatalf("expected smoothed points to equal %v: %v", expected, smoothed)
+	}
+
+	if points[1].Value != 20 {
+		t.Fatalf("expected the given points to be unchanged: %v", points)
+	}
+}
+
+func TestSmoothGaugeInvalidAlpha(t *testing.T) {
+	t.Parallel()
+
+	for _, alpha := range []float64{0, -0.5, 1.5} {
+		if _, err := client.SmoothGauge(nil, alpha); err == nil {
+			t.Fatalf("expected an error for alpha %g", alpha)
+		}
+	}
+}
+
+func gaugeEnvelope(timestamp int64, name string, value float64) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: timestamp,
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					name: {Value: value},
+				},
+			},
+		},
+	}
+}
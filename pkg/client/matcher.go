@@ -0,0 +1,38 @@
+package client
+
+import (
+	"sort"
+	"strings"
+)
+
+// labelValueEscaper escapes the characters that can't be part of a quoted
+// PromQL label value as is.
+var labelValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+)
+
+// BuildMatcher returns a PromQL selector for the given metric that matches
+// each of the given labels exactly, e.g., `cpu{deployment="cf",source_id="x"}`.
+// The labels are sorted by name, and backslashes, double quotes and
+// newlines in their values are escaped. Without labels, the metric name is
+// returned as is.
+func BuildMatcher(metric string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return metric
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, name+`="`+labelValueEscaper.Replace(labels[name])+`"`)
+	}
+
+	return metric + "{" + strings.Join(matchers, ",") + "}"
+}
@@ -0,0 +1,48 @@
+package client_test
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/log-cache/pkg/client"
+)
+
+func TestBuildMatcher(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected string
+	}{
+		{
+			name:     "no labels",
+			expected: `cpu`,
+		},
+		{
+			name:     "sorted labels",
+			labels:   map[string]string{"source_id": "x", "deployment": "cf"},
+			expected: `cpu{deployment="cf",source_id="x"}`,
+		},
+		{
+			name:     "quotes",
+			labels:   map[string]string{"source_id": `a"b`},
+			expected: `cpu{source_id="a\"b"}`,
+		},
+		{
+			name:     "backslashes",
+			labels:   map[string]string{"source_id": `a\b`},
+			expected: `cpu{source_id="a\\b"}`,
+		},
+		{
+			name:     "newlines",
+			labels:   map[string]string{"source_id": "a\nb"},
+			expected: `cpu{source_id="a\nb"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		if actual := client.BuildMatcher("cpu", tt.labels); actual != tt.expected {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"sort"
+
+	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+// MetaChange is the difference between two meta snapshots.
+type MetaChange struct {
+	// Added are the sources that are only in the new snapshot.
+	Added []string
+
+	// Removed are the sources that are only in the old snapshot.
+	Removed []string
+
+	// Changed are the sources in both snapshots whose count or timestamp
+	// range differs.
+	Changed []SourceChange
+}
+
+// SourceChange is the change of a source between two meta snapshots.
+type SourceChange struct {
+	SourceID string
+
+	// CountDelta is the new count minus the old count.
+	CountDelta int64
+}
+
+// MetaDiff compares two meta snapshots (e.g., returned by Meta). The
+// sources of each field of the MetaChange are sorted by source ID.
+func MetaDiff(old, new map[string]*logcache_v1.MetaInfo) MetaChange {
+	var change MetaChange
+
+	for sourceID, n := range new {
+		o, ok := old[sourceID]
+		if !ok {
+			change.Added = append(change.Added, sourceID)
+			continue
+		}
+
+		if o.GetCount() != n.GetCount() ||
+			o.GetOldestTimestamp() != n.GetOldestTimestamp() ||
+			o.GetNewestTimestamp() != n.GetNewestTimestamp() {
+			change.Changed = append(change.Changed, SourceChange{
+				SourceID:   sourceID,
+				CountDelta: n.GetCount() - o.GetCount(),
+			})
+		}
+	}
+
+	for sourceID := range old {
+		if _, ok := new[sourceID]; !ok {
+			change.Removed = append(change.Removed, sourceID)
+		}
+	}
+
+	sort.Strings(change.Added)
+	sort.Strings(change.Removed)
+	sort.Slice(change.Changed, func(i, j int) bool {
+		return change.Changed[i].SourceID < change.Changed[j].SourceID
+	})
+
+	return change
+}
@@ -0,0 +1,54 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/log-cache/pkg/client"
+	rpc "code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+func TestMetaDiff(t *testing.T) {
+	t.Parallel()
+
+	old := map[string]*rpc.MetaInfo{
+		"removed":   {Count: 1},
+		"unchanged": {Count: 5, OldestTimestamp: 1, NewestTimestamp: 2},
+		"grown":     {Count: 5, OldestTimestamp: 1, NewestTimestamp: 2},
+		"moved":     {Count: 5, OldestTimestamp: 1, NewestTimestamp: 2},
+	}
+	new := map[string]*rpc.MetaInfo{
+		"unchanged": {Count: 5, OldestTimestamp: 1, NewestTimestamp: 2},
+		"grown":     {Count: 8, OldestTimestamp: 1, NewestTimestamp: 3},
+		"moved":     {Count: 5, OldestTimestamp: 2, NewestTimestamp: 3},
+		"b-added":   {Count: 1},
+		"a-added":   {Count: 1},
+	}
+
+	change := client.MetaDiff(old, new)
+
+	expected := client.MetaChange{
+		Added:   []string{"a-added", "b-added"},
+		Removed: []string{"removed"},
+		Changed: []client.SourceChange{
+			{SourceID: "grown", CountDelta: 3},
+			{SourceID: "moved", CountDelta: 0},
+		},
+	}
+	if !reflect.DeepEqual(change, expected) {
+		t.Fatalf("expected change to equal %+v: %+v", expected, change)
+	}
+}
+
+func TestMetaDiffWithoutChanges(t *testing.T) {
+	t.Parallel()
+
+	meta := map[string]*rpc.MetaInfo{
+		"some-id": {Count: 5},
+	}
+
+	change := client.MetaDiff(meta, meta)
+	if len(change.Added) != 0 || len(change.Removed) != 0 || len(change.Changed) != 0 {
+		t.Fatalf("expected no changes: %+v", change)
+	}
+}
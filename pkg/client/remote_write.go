@@ -0,0 +1,101 @@
+package client
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelNameChars  = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// MarshalRemoteWrite converts the given envelopes into a snappy compressed
+// Prometheus remote write request. Each counter envelope becomes a sample
+// of its total, and each metric of a gauge envelope a sample of its value.
+// Every other envelope type is skipped.
+//
+// The metric name is the name of the counter or gauge metric and is set as
+// the __name__ label. The source ID is set as the source_id label and each
+// tag as a label of the same name. Characters that are invalid in Prometheus
+// metric or label names are replaced with an underscore, and names starting
+// with a digit are prefixed with one. Tags whose names are reserved (i.e.,
+// start with __ or are source_id) are skipped, as are tags whose names
+// collide with another tag's once sanitized. Of colliding tags, the one
+// with the lexically smallest original name is kept. The timestamp is
+// converted to milliseconds.
+func MarshalRemoteWrite(envs []*loggregator_v2.Envelope) ([]byte, error) {
+	var req prompb.WriteRequest
+
+	for _, e := range envs {
+		switch m := e.Message.(type) {
+		case *loggregator_v2.Envelope_Counter:
+			req.Timeseries = append(req.Timeseries, remoteWriteSeries(e, m.Counter.GetName(), float64(m.Counter.GetTotal())))
+		case *loggregator_v2.Envelope_Gauge:
+			for name, value := range m.Gauge.GetMetrics() {
+				req.Timeseries = append(req.Timeseries, remoteWriteSeries(e, name, value.GetValue()))
+			}
+		}
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return snappy.Encode(nil, data), nil
+}
+
+func remoteWriteSeries(e *loggregator_v2.Envelope, name string, value float64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: sanitizeName(invalidMetricNameChars, name)},
+		{Name: "source_id", Value: e.GetSourceId()},
+	}
+
+	// The tags are added in order of their original names, so that the
+	// same one wins a collision each time.
+	keys := make([]string, 0, len(e.GetTags()))
+	for k := range e.GetTags() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]bool{"source_id": true}
+	for _, k := range keys {
+		label := sanitizeName(invalidLabelNameChars, k)
+		if label == "" || strings.HasPrefix(label, "__") || seen[label] {
+			continue
+		}
+		seen[label] = true
+
+		labels = append(labels, prompb.Label{Name: label, Value: e.GetTags()[k]})
+	}
+
+	// Remote write expects the labels sorted by name.
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return prompb.TimeSeries{
+		Labels: labels,
+		Samples: []prompb.Sample{
+			{Value: value, Timestamp: e.GetTimestamp() / 1e6},
+		},
+	}
+}
+
+// sanitizeName replaces the invalid characters of the given name with an
+// underscore, and prefixes it with one if it starts with a digit.
+func sanitizeName(invalidChars *regexp.Regexp, name string) string {
+	name = invalidChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
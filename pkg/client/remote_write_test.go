@@ -0,0 +1,124 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/pkg/client"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestMarshalRemoteWrite(t *testing.T) {
+	t.Parallel()
+
+	data, err := client.MarshalRemoteWrite([]*loggregator_v2.Envelope{
+		{
+			Timestamp: 2e6,
+			SourceId:  "some-id",
+			Tags:      map[string]string{"deployment": "cf", "job-name": "router"},
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{Name: "requests", Total: 99},
+			},
+		},
+		{
+			Timestamp: 3e6,
+			SourceId:  "some-id",
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{Payload: []byte("some-log")},
+			},
+		},
+		{
+			Timestamp: 4e6,
+			SourceId:  "some-id",
+			Message: &loggregator_v2.Envelope_Gauge{
+				Gauge: &loggregator_v2.Gauge{
+					Metrics: map[string]*loggregator_v2.GaugeValue{
+						"cpu.percentage": {Unit: "percentage", Value: 12.5},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected err to be nil: %s", err)
+	}
+
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		t.Fatalf("expected data to be snappy compressed: %s", err)
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(decoded); err != nil {
+		t.Fatalf("expected data to be a write request: %s", err)
+	}
+
+	expected := []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "requests"},
+				{Name: "deployment", Value: "cf"},
+				{Name: "job_name", Value: "router"},
+				{Name: "source_id", Value: "some-id"},
+			},
+			Samples: []prompb.Sample{{Value: 99, Timestamp: 2}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "cpu_percentage"},
+				{Name: "source_id", Value: "some-id"},
+			},
+			Samples: []prompb.Sample{{Value: 12.5, Timestamp: 4}},
+		},
+	}
+	if !reflect.DeepEqual(req.Timeseries, expected) {
+		t.Fatalf("expected timeseries to equal %v: %v", expected, req.Timeseries)
+	}
+}
+
+func TestMarshalRemoteWriteSanitizesLabels(t *testing.T) {
+	t.Parallel()
+
+	data, err := client.MarshalRemoteWrite([]*loggregator_v2.Envelope{
+		{
+			Timestamp: 2e6,
+			SourceId:  "some-id",
+			Tags: map[string]string{
+				"a_b":       "first",
+				"a-b":       "second",
+				"1st":       "digit",
+				"__meta":    "reserved",
+				"__name__":  "reserved",
+				"source_id": "reserved",
+			},
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{Name: "5xx", Total: 99},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected err to be nil: %s", err)
+	}
+
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		t.Fatalf("expected data to be snappy compressed: %s", err)
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(decoded); err != nil {
+		t.Fatalf("expected data to be a write request: %s", err)
+	}
+
+	expected := []prompb.Label{
+		{Name: "_1st", Value: "digit"},
+		{Name: "__name__", Value: "_5xx"},
+		{Name: "a_b", Value: "second"},
+		{Name: "source_id", Value: "some-id"},
+	}
+	if len(req.Timeseries) != 1 || !reflect.DeepEqual(req.Timeseries[0].Labels, expected) {
+		t.Fatalf("expected labels to equal %v: %v", expected, req.Timeseries)
+	}
+}
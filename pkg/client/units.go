@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unitFamily is a set of units that can be converted into each other. Each
+// unit is mapped to its factor relative to the family's base unit.
+type unitFamily map[string]float64
+
+var unitFamilies = []unitFamily{
+	// Bytes use binary multiples (e.g., 1 KB = 1024 bytes), as Cloud Foundry
+	// does for memory and disk.
+	{
+		"bytes":     1,
+		"b":         1,
+		"kb":        1 << 10,
+		"kilobytes": 1 << 10,
+		"mb":        1 << 20,
+		"megabytes": 1 << 20,
+		"gb":        1 << 30,
+		"gigabytes": 1 << 30,
+	},
+	{
+		"ns":           1,
+		"nanoseconds":  1,
+		"us":           1e3,
+		"µs":           1e3,
+		"microseconds": 1e3,
+		"ms":           1e6,
+		"milliseconds": 1e6,
+		"s":            1e9,
+		"seconds":      1e9,
+	},
+	{
+		"percentage": 1,
+		"percent":    1,
+		"%":          1,
+	},
+}
+
+// ConvertGauge converts a gauge value from one unit to another. The units
+// are case insensitive and can be abbreviated (e.g., "MB" or "megabytes").
+// It handles bytes (bytes, KB, MB, GB), durations (ns, us, ms, s) and
+// percentages. An error is returned for unknown units or units of different
+// families (e.g., bytes to seconds).
+func ConvertGauge(value float64, fromUnit, toUnit string) (float64, error) {
+	from := strings.ToLower(fromUnit)
+	to := strings.ToLower(toUnit)
+
+	for _, family := range unitFamilies {
+		fromFactor, fromOK := family[from]
+		toFactor, toOK := family[to]
+
+		switch {
+		case fromOK && toOK:
+			return value * fromFactor / toFactor, nil
+		case fromOK || toOK:
+			return 0, fmt.Errorf("can not convert %q to %q: incompatible units", fromUnit, toUnit)
+		}
+	}
+
+	return 0, fmt.Errorf("can not convert %q to %q: unknown units", fromUnit, toUnit)
+}
@@ -0,0 +1,48 @@
+package client_test
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/log-cache/pkg/client"
+)
+
+func TestConvertGauge(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		expected float64
+	}{
+		{value: 1048576, from: "bytes", to: "MB", expected: 1},
+		{value: 2, from: "GB", to: "megabytes", expected: 2048},
+		{value: 1500000, from: "ns", to: "ms", expected: 1.5},
+		{value: 2, from: "seconds", to: "Milliseconds", expected: 2000},
+		{value: 99.5, from: "percentage", to: "%", expected: 99.5},
+	}
+
+	for _, tt := range tests {
+		actual, err := client.ConvertGauge(tt.value, tt.from, tt.to)
+		if err != nil {
+			t.Fatalf("expected err to be nil: %s", err)
+		}
+
+		if actual != tt.expected {
+			t.Fatalf("expected %v %s to convert to %v %s: %v", tt.value, tt.from, tt.expected, tt.to, actual)
+		}
+	}
+}
+
+func TestConvertGaugeReturnsErrorForIncompatibleUnits(t *testing.T) {
+	if _, err := client.ConvertGauge(1, "bytes", "seconds"); err == nil {
+		t.Fatal("expected err to not be nil")
+	}
+
+	if _, err := client.ConvertGauge(1, "percentage", "ms"); err == nil {
+		t.Fatal("expected err to not be nil")
+	}
+}
+
+func TestConvertGaugeReturnsErrorForUnknownUnits(t *testing.T) {
+	if _, err := client.ConvertGauge(1, "furlongs", "fortnights"); err == nil {
+		t.Fatal("expected err to not be nil")
+	}
+}
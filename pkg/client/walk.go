@@ -2,12 +2,14 @@ package client
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"log"
 	"time"
 
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+	"github.com/golang/protobuf/proto"
 )
 
 // Reader reads envelopes from LogCache. It will be invoked by Walker several
@@ -36,6 +38,10 @@ func Walk(ctx context.Context, sourceID string, v Visitor, r Reader, opts ...Wal
 		o.configure(c)
 	}
 
+	if c.strategy != nil {
+		c.backoff = &strategyBackoff{ctx: ctx, strategy: c.strategy}
+	}
+
 	var readOpts []ReadOption
 	if !c.end.IsZero() {
 		readOpts = append(readOpts, WithEndTime(c.end))
@@ -105,6 +111,19 @@ func Walk(ctx context.Context, sourceID string, v Visitor, r Reader, opts ...Wal
 		c.backoff.Reset()
 		receivedEmpty = false
 
+		var exceeded bool
+		if c.maxBytes > 0 {
+			es, exceeded = c.budget(es)
+		}
+
+		if exceeded {
+			c.log.Print(ErrBudgetExceeded)
+			if len(es) > 0 {
+				v(es)
+			}
+			return
+		}
+
 		// If visitor is done or the next timestamp would be outside of our
 		// window (only when end is set), then be done.
 		if !v(es) || (!c.end.IsZero() && es[len(es)-1].Timestamp+1 >= c.end.UnixNano()) {
@@ -115,6 +134,92 @@ func Walk(ctx context.Context, sourceID string, v Visitor, r Reader, opts ...Wal
 	}
 }
 
+// ReadChan walks the given source from the start time and sends each
+// envelope on the returned envelope channel. Once it reached the newest
+// envelope, it polls for new envelopes every second. Both channels are
+// closed once the context is done or a read fails. A failed read is sent on
+// the error channel before it is closed.
+func (c *Client) ReadChan(
+	ctx context.Context,
+	sourceID string,
+	start time.Time,
+	opts ...ReadOption,
+) (<-chan *loggregator_v2.Envelope, <-chan error) {
+	envelopes := make(chan *loggregator_v2.Envelope, 100)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(envelopes)
+		defer close(errs)
+
+		// The full slice expression keeps append from writing into the
+		// caller's array.
+		opts := opts[:len(opts):len(opts)]
+
+		b := &readChanBackoff{ctx: ctx, interval: time.Second}
+		r := func(ctx context.Context, sourceID string, start time.Time, walkOpts ...ReadOption) ([]*loggregator_v2.Envelope, error) {
+			return c.Read(ctx, sourceID, start, append(opts, walkOpts...)...)
+		}
+
+		walkOpts := []WalkOption{WithWalkStartTime(start), WithWalkBackoff(b)}
+		if c.maxLimit > 0 {
+			walkOpts = append(walkOpts, WithWalkLimit(c.maxLimit))
+		}
+
+		Walk(ctx, sourceID, func(es []*loggregator_v2.Envelope) bool {
+			for _, e := range es {
+				select {
+				case envelopes <- e:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}, r, walkOpts...)
+
+		if b.err != nil && ctx.Err() == nil {
+			errs <- b.err
+		}
+	}()
+
+	return envelopes, errs
+}
+
+// readChanBackoff stops on the first error and polls on an empty batch until
+// the context is done. ErrNoData (see WithEmptyResultError) is an empty
+// batch.
+type readChanBackoff struct {
+	ctx      context.Context
+	interval time.Duration
+	err      error
+}
+
+// OnErr implements Backoff.
+func (b *readChanBackoff) OnErr(err error) bool {
+	if errors.Is(err, ErrNoData) {
+		return b.OnEmpty()
+	}
+
+	b.err = err
+	return false
+}
+
+// OnEmpty implements Backoff.
+func (b *readChanBackoff) OnEmpty() bool {
+	t := time.NewTimer(b.interval)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
+
+// Reset implements Backoff.
+func (b *readChanBackoff) Reset() {}
+
 // WalkOption overrides defaults for Walk.
 type WalkOption interface {
 	configure(*walkConfig)
@@ -163,6 +268,16 @@ func WithWalkNameFilter(nameFilter string) WalkOption {
 	})
 }
 
+// WithWalkMaxBytes stops the Walk once the envelopes it visited exceed the
+// given number of bytes. The envelopes within the budget are still
+// visited. Like with WithMaxBytes, the size is estimated via the protobuf
+// encoded size of each envelope.
+func WithWalkMaxBytes(n int64) WalkOption {
+	return walkOptionFunc(func(c *walkConfig) {
+		c.maxBytes = n
+	})
+}
+
 // WithWalkBackoff sets the backoff strategy for an empty batch or error. It
 // defaults to stopping on an error or empty batch via AlwaysDoneBackoff.
 func WithWalkBackoff(b Backoff) WalkOption {
@@ -304,10 +419,28 @@ func (f walkOptionFunc) configure(c *walkConfig) {
 type walkConfig struct {
 	log           *log.Logger
 	backoff       Backoff
+	strategy      BackoffStrategy
 	start         int64
 	end           time.Time
 	limit         *int
 	envelopeTypes []logcache_v1.EnvelopeType
 	delay         time.Duration
 	nameFilter    string
+
+	maxBytes     int64
+	visitedBytes int64
+}
+
+// budget drops the envelopes beyond the max bytes and adds the others to
+// the visited bytes. It reports whether any were dropped.
+func (c *walkConfig) budget(es []*loggregator_v2.Envelope) ([]*loggregator_v2.Envelope, bool) {
+	for i, e := range es {
+		size := int64(proto.Size(e))
+		if c.visitedBytes+size > c.maxBytes {
+			return es[:i], true
+		}
+		c.visitedBytes += size
+	}
+
+	return es, false
 }
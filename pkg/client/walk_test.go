@@ -266,6 +266,33 @@ func TestWalkRetriesOnError(t *testing.T) {
 	}
 }
 
+func TestWalkRetriesWithBackoffStrategy(t *testing.T) {
+	t.Parallel()
+
+	r := &stubReader{
+		envelopes: [][]*loggregator_v2.Envelope{
+			nil,
+			nil,
+			{{Timestamp: 1}},
+		},
+		errs: []error{errors.New("some-error"), nil, nil},
+	}
+
+	var called int
+	client.Walk(context.Background(), "some-id", func(e []*loggregator_v2.Envelope) bool {
+		called++
+		return false
+	}, r.read, client.WithBackoff(client.ConstantBackoff{Interval: time.Millisecond}))
+
+	if len(r.sourceIDs) != 3 {
+		t.Fatalf("expected read to be invoked 3 times: %d", len(r.sourceIDs))
+	}
+
+	if called != 1 {
+		t.Fatalf("expected visitor to be invoked once: %d", called)
+	}
+}
+
 func TestWalkCancels(t *testing.T) {
 	t.Parallel()
 
@@ -457,6 +484,37 @@ func (s *stubBackoff) Reset() {
 	s.resetCalled++
 }
 
+func TestWalkStopsOnceMaxBytesAreExceeded(t *testing.T) {
+	t.Parallel()
+
+	// Each envelope has an encoded size of 2 bytes.
+	r := &stubReader{
+		envelopes: [][]*loggregator_v2.Envelope{
+			{{Timestamp: 1}, {Timestamp: 2}},
+			{{Timestamp: 3}, {Timestamp: 4}},
+		},
+		errs: []error{nil, nil},
+	}
+
+	var visited []int64
+	client.Walk(context.Background(), "some-id", func(es []*loggregator_v2.Envelope) bool {
+		for _, e := range es {
+			visited = append(visited, e.Timestamp)
+		}
+		return true
+	}, r.read,
+		client.WithWalkMaxBytes(6),
+	)
+
+	if !reflect.DeepEqual(visited, []int64{1, 2, 3}) {
+		t.Fatalf("expected to visit the envelopes within the budget: %v", visited)
+	}
+
+	if len(r.sourceIDs) != 2 {
+		t.Fatalf("expected read to be invoked twice: %d", len(r.sourceIDs))
+	}
+}
+
 type stubReader struct {
 	sourceIDs []string
 	starts    []int64
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/pkg/rpc/logcache_v1"
+)
+
+// LatestValue returns the newest value of the given gauge or counter metric
+// of the given source along with its timestamp. For a counter, the value is
+// its total. It returns ErrNoData if the source has no such metric.
+func (c *Client) LatestValue(
+	ctx context.Context,
+	metricName string,
+	sourceID string,
+) (float64, time.Time, error) {
+	envelopes, err := c.Read(ctx, sourceID, time.Unix(0, 0),
+		WithEnvelopeTypes(logcache_v1.EnvelopeType_GAUGE, logcache_v1.EnvelopeType_COUNTER),
+		WithNameFilter("^"+regexp.QuoteMeta(metricName)+"$"),
+		WithDescending(),
+		WithLimit(1),
+	)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	for _, e := range envelopes {
+		t := time.Unix(0, e.GetTimestamp())
+
+		if m, ok := e.GetGauge().GetMetrics()[metricName]; ok {
+			return m.GetValue(), t, nil
+		}
+
+		if e.GetCounter().GetName() == metricName {
+			return float64(e.GetCounter().GetTotal()), t, nil
+		}
+	}
+
+	return 0, time.Time{}, ErrNoData
+}
+
+// WatchMetric polls the latest value of the given metric of the given
+// source on the given interval, and invokes the callback whenever the
+// predicate becomes true for it. The callback is not invoked again until the
+// predicate has been false for a polled value. Failed polls are skipped. It
+// blocks until the context is done.
+func (c *Client) WatchMetric(
+	ctx context.Context,
+	metricName string,
+	sourceID string,
+	interval time.Duration,
+	predicate func(float64) bool,
+	cb func(float64, time.Time),
+) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var matched bool
+	for {
+		value, timestamp, err := c.LatestValue(ctx, metricName, sourceID)
+		if err == nil {
+			match := predicate(value)
+			if match && !matched {
+				cb(value, timestamp)
+			}
+			matched = match
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
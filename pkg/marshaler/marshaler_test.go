@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
 	"strings"
 
 	"code.cloudfoundry.org/log-cache/pkg/marshaler"
@@ -428,6 +429,43 @@ var _ = Describe("PromqlMarshaler", func() {
 			}`))
 		})
 
+		It("encodes the special values like Prometheus", func() {
+			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
+
+			result, err := marshaler.Marshal(&logcache_v1.PromQL_RangeQueryResult{
+				Result: &logcache_v1.PromQL_RangeQueryResult_Matrix{
+					Matrix: &logcache_v1.PromQL_Matrix{
+						Series: []*logcache_v1.PromQL_Series{
+							{
+								Points: []*logcache_v1.PromQL_Point{
+									{Time: "1", Value: math.NaN()},
+									{Time: "2", Value: math.Inf(1)},
+									{Time: "3", Value: math.Inf(-1)},
+								},
+							},
+						},
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(MatchJSON(`{
+				"status": "success",
+				"data": {
+					"resultType": "matrix",
+					"result": [
+						{
+							"metric": {},
+							"values": [
+								[ 1.000, "NaN" ],
+								[ 2.000, "+Inf" ],
+								[ 3.000, "-Inf" ]
+							]
+						}
+					]
+				}
+			}`))
+		})
+
 		It("reports errors for invalid timestamps", func() {
 			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
 
@@ -745,6 +783,78 @@ var _ = Describe("PromqlMarshaler", func() {
 			}))
 		})
 
+		It("decodes NaN", func() {
+			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
+
+			var result logcache_v1.PromQL_InstantQueryResult
+			err := marshaler.Unmarshal([]byte(`{
+				"status": "success",
+				"data": {
+					"resultType": "scalar",
+					"result": [1, "NaN"]
+				}
+			}`), &result)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(math.IsNaN(result.GetScalar().GetValue())).To(BeTrue())
+		})
+
+		It("decodes +Inf", func() {
+			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
+
+			var result logcache_v1.PromQL_InstantQueryResult
+			err := marshaler.Unmarshal([]byte(`{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{
+							"metric": {},
+							"value": [1, "+Inf"]
+						}
+					]
+				}
+			}`), &result)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(result.GetVector().GetSamples()[0].GetPoint().GetValue()).To(Equal(math.Inf(1)))
+		})
+
+		It("decodes -Inf", func() {
+			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
+
+			var result logcache_v1.PromQL_RangeQueryResult
+			err := marshaler.Unmarshal([]byte(`{
+				"status": "success",
+				"data": {
+					"resultType": "matrix",
+					"result": [
+						{
+							"metric": {},
+							"values": [[1, "-Inf"]]
+						}
+					]
+				}
+			}`), &result)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(result.GetMatrix().GetSeries()[0].GetPoints()[0].GetValue()).To(Equal(math.Inf(-1)))
+		})
+
+		It("reports errors for invalid values", func() {
+			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
+
+			var result logcache_v1.PromQL_InstantQueryResult
+			err := marshaler.Unmarshal([]byte(`{
+				"status": "success",
+				"data": {
+					"resultType": "scalar",
+					"result": [1, "potato"]
+				}
+			}`), &result)
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("falls back to the fallback marshaler", func() {
 			marshaler := marshaler.NewPromqlMarshaler(&mockMarshaler{})
 
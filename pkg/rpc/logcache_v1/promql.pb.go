@@ -57,6 +57,7 @@ var xxx_messageInfo_PromQL proto.InternalMessageInfo
 type PromQL_InstantQueryRequest struct {
 	Query                string   `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
 	Time                 string   `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	Timeout              string   `protobuf:"bytes,3,opt,name=timeout,proto3" json:"timeout,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -100,11 +101,19 @@ func (m *PromQL_InstantQueryRequest) GetTime() string {
 	return ""
 }
 
+func (m *PromQL_InstantQueryRequest) GetTimeout() string {
+	if m != nil {
+		return m.Timeout
+	}
+	return ""
+}
+
 type PromQL_RangeQueryRequest struct {
 	Query                string   `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
 	Start                string   `protobuf:"bytes,2,opt,name=start,proto3" json:"start,omitempty"`
 	End                  string   `protobuf:"bytes,3,opt,name=end,proto3" json:"end,omitempty"`
 	Step                 string   `protobuf:"bytes,4,opt,name=step,proto3" json:"step,omitempty"`
+	Timeout              string   `protobuf:"bytes,5,opt,name=timeout,proto3" json:"timeout,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -162,6 +171,13 @@ func (m *PromQL_RangeQueryRequest) GetStep() string {
 	return ""
 }
 
+func (m *PromQL_RangeQueryRequest) GetTimeout() string {
+	if m != nil {
+		return m.Timeout
+	}
+	return ""
+}
+
 type PromQL_InstantQueryResult struct {
 	// Types that are valid to be assigned to Result:
 	//	*PromQL_InstantQueryResult_Scalar
@@ -836,39 +852,39 @@ var _PromQLQuerier_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("promql.proto", fileDescriptor_promql_8af6a03dca3ddd7b) }
 
 var fileDescriptor_promql_8af6a03dca3ddd7b = []byte{
-	// 533 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x94, 0xc1, 0x6e, 0x13, 0x31,
-	0x10, 0x86, 0x71, 0xda, 0x98, 0x76, 0xd2, 0x8a, 0xe2, 0xb6, 0xd2, 0x62, 0x38, 0x54, 0x15, 0x14,
-	0x4e, 0x1b, 0x25, 0x70, 0x00, 0x84, 0x8a, 0x84, 0x84, 0x04, 0x12, 0x95, 0x5a, 0x23, 0xf5, 0x8a,
-	0xcc, 0x62, 0x85, 0x15, 0xbb, 0xeb, 0x8d, 0xed, 0xac, 0xe8, 0x95, 0x57, 0xe0, 0xca, 0x63, 0x20,
-	0xce, 0xbc, 0x03, 0xaf, 0xc0, 0x7b, 0x80, 0x3c, 0x76, 0x68, 0x22, 0x36, 0xa4, 0xc0, 0x6d, 0xbc,
-	0xfa, 0xfe, 0xf9, 0x67, 0xc6, 0xde, 0x81, 0x8d, 0xda, 0xe8, 0x72, 0x5c, 0xa4, 0xb5, 0xd1, 0x4e,
-	0xb3, 0x5e, 0xa1, 0x47, 0x99, 0xcc, 0xde, 0xaa, 0xb4, 0x19, 0xf0, 0x1b, 0x23, 0xad, 0x47, 0x85,
-	0xea, 0xcb, 0x3a, 0xef, 0xcb, 0xaa, 0xd2, 0x4e, 0xba, 0x5c, 0x57, 0x36, 0xa0, 0xfb, 0x9f, 0xd6,
-	0x80, 0x1e, 0x1b, 0x5d, 0x9e, 0xbc, 0xe0, 0x8f, 0x61, 0xfb, 0x79, 0x65, 0x9d, 0xac, 0xdc, 0xc9,
-	0x44, 0x99, 0x33, 0xa1, 0xc6, 0x13, 0x65, 0x1d, 0xdb, 0x81, 0xee, 0xd8, 0x9f, 0x13, 0xb2, 0x47,
-	0xee, 0xac, 0x8b, 0x70, 0x60, 0x0c, 0x56, 0x5d, 0x5e, 0xaa, 0xa4, 0x83, 0x1f, 0x31, 0xe6, 0x0a,
-	0xae, 0x0a, 0x59, 0x8d, 0xd4, 0x05, 0xe4, 0x3b, 0xd0, 0xb5, 0x4e, 0x1a, 0x17, 0xf5, 0xe1, 0xc0,
-	0xb6, 0x60, 0x45, 0x55, 0x6f, 0x92, 0x15, 0xfc, 0xe6, 0x43, 0x6f, 0x63, 0x9d, 0xaa, 0x93, 0xd5,
-	0x60, 0xe3, 0x63, 0xfe, 0x95, 0x00, 0x9b, 0x2f, 0xd4, 0x4e, 0x0a, 0xc7, 0xee, 0x01, 0xb5, 0x99,
-	0x2c, 0xa4, 0x41, 0xa7, 0xde, 0x90, 0xa7, 0x33, 0x53, 0x48, 0x43, 0x8f, 0xe9, 0x4b, 0x24, 0x9e,
-	0x5d, 0x12, 0x91, 0xf5, 0xaa, 0x46, 0x65, 0x4e, 0x1b, 0xac, 0x64, 0x81, 0xea, 0x14, 0x09, 0xaf,
-	0x0a, 0xac, 0x57, 0x95, 0xd2, 0x99, 0xfc, 0x3d, 0xd6, 0xba, 0x40, 0x75, 0x84, 0x84, 0x57, 0x05,
-	0xf6, 0xc9, 0x1a, 0xd0, 0x50, 0x2b, 0x17, 0xb0, 0x35, 0x3b, 0xa9, 0x69, 0xfd, 0x31, 0x27, 0xf9,
-	0xa7, 0x9c, 0x43, 0xa0, 0xa1, 0xbb, 0x5f, 0x77, 0x43, 0xce, 0xef, 0xc6, 0x0f, 0xbc, 0x91, 0xc5,
-	0x24, 0x5c, 0x18, 0x11, 0xe1, 0xc0, 0x0f, 0x81, 0x9e, 0x4e, 0x3b, 0xba, 0x6c, 0x65, 0x59, 0x17,
-	0xca, 0x26, 0x64, 0x6f, 0x65, 0xe1, 0xf8, 0x10, 0x11, 0x53, 0x94, 0x0f, 0xa0, 0x7b, 0xac, 0xf3,
-	0xca, 0xfd, 0x85, 0xe5, 0x67, 0x02, 0x34, 0xa4, 0x61, 0x87, 0x40, 0x4b, 0xe5, 0x4c, 0x9e, 0x45,
-	0xcb, 0x83, 0xc5, 0x96, 0xe9, 0x11, 0x82, 0x4f, 0x2b, 0x67, 0xce, 0x44, 0x54, 0xb1, 0x3e, 0x74,
-	0x6b, 0xef, 0x1e, 0xaf, 0xee, 0x5a, 0x9b, 0x1c, 0xcb, 0x13, 0x81, 0xe3, 0x0f, 0xa0, 0x37, 0x93,
-	0xc7, 0x3f, 0xb7, 0x77, 0x6a, 0xfa, 0x30, 0x7d, 0x38, 0x5f, 0xf2, 0x7a, 0x2c, 0xf9, 0x61, 0xe7,
-	0x3e, 0xe1, 0x8f, 0x80, 0x86, 0xd9, 0xb3, 0x21, 0x50, 0xab, 0x4c, 0xbe, 0x64, 0x50, 0x48, 0x88,
-	0x48, 0xf2, 0x2f, 0xbe, 0x69, 0x0c, 0x2f, 0xd8, 0x34, 0xb2, 0xad, 0x4d, 0x0f, 0x80, 0x62, 0x33,
-	0x36, 0xe9, 0xa0, 0xfe, 0x0f, 0x5d, 0x47, 0xf0, 0x3f, 0xda, 0x1e, 0xfe, 0x20, 0xb0, 0x19, 0x72,
-	0xfa, 0xa7, 0x9a, 0x2b, 0xc3, 0x1a, 0xd8, 0x98, 0xfd, 0xf9, 0xd8, 0xed, 0x36, 0xff, 0x96, 0x3d,
-	0xc2, 0x0f, 0x96, 0x83, 0xfe, 0x1d, 0xef, 0xef, 0x7e, 0xf8, 0xf6, 0xfd, 0x63, 0xe7, 0x0a, 0xdb,
-	0xc4, 0x8d, 0xd5, 0x0c, 0xfa, 0x61, 0x63, 0x34, 0x00, 0xe7, 0xbf, 0x0c, 0xbb, 0xd5, 0x96, 0xec,
-	0xb7, 0xe5, 0xc3, 0x6f, 0x2e, 0xc3, 0xd0, 0xf1, 0x3a, 0x3a, 0xee, 0xb2, 0xed, 0x39, 0xc7, 0x57,
-	0xc6, 0x73, 0xaf, 0x29, 0xee, 0xc9, 0xbb, 0x3f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xd8, 0xdc, 0x69,
-	0xcb, 0x62, 0x05, 0x00, 0x00,
+	// 544 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa5, 0x54, 0xd1, 0x6a, 0xd4, 0x40,
+	0x14, 0x35, 0xbb, 0xdd, 0xd4, 0xde, 0x6d, 0xb1, 0x4e, 0x5b, 0x88, 0xa3, 0x0f, 0x52, 0xb4, 0xf6,
+	0x29, 0xcb, 0xae, 0x3e, 0xa8, 0x88, 0x0f, 0x82, 0xa0, 0x60, 0xa1, 0x8d, 0x50, 0xf0, 0x49, 0xc6,
+	0x38, 0xac, 0xa1, 0x49, 0x26, 0x9b, 0x99, 0x84, 0xf6, 0x49, 0xf0, 0x17, 0xfc, 0x15, 0xe9, 0xb3,
+	0x9f, 0x20, 0xf8, 0x0b, 0xfe, 0x87, 0xce, 0xdc, 0x99, 0x68, 0x16, 0xb3, 0x6e, 0xd5, 0xa7, 0xdc,
+	0x19, 0xce, 0xb9, 0xf7, 0x9c, 0x7b, 0x27, 0x17, 0xd6, 0x8b, 0x52, 0x64, 0xb3, 0x34, 0xd4, 0x1f,
+	0x25, 0xc8, 0x30, 0x15, 0xd3, 0x98, 0xc5, 0xef, 0x78, 0x58, 0x8f, 0xe9, 0x8d, 0xa9, 0x10, 0xd3,
+	0x94, 0x8f, 0x58, 0x91, 0x8c, 0x58, 0x9e, 0x0b, 0xc5, 0x54, 0x22, 0x72, 0x69, 0xa1, 0xbb, 0x5f,
+	0x2e, 0x83, 0x7f, 0xa8, 0xb9, 0x47, 0x2f, 0xe8, 0x2b, 0xd8, 0x7a, 0x9e, 0x4b, 0xc5, 0x72, 0x75,
+	0x54, 0xf1, 0xf2, 0x2c, 0xe2, 0xb3, 0x8a, 0x4b, 0x45, 0xb6, 0x61, 0x30, 0x33, 0xe7, 0xc0, 0xbb,
+	0xe9, 0xed, 0xaf, 0x45, 0xf6, 0x40, 0x08, 0xac, 0xa8, 0x24, 0xe3, 0x41, 0x0f, 0x2f, 0x31, 0x26,
+	0x01, 0xac, 0x9a, 0xaf, 0xa8, 0x54, 0xd0, 0xc7, 0xeb, 0xe6, 0x48, 0xdf, 0xc3, 0xd5, 0x88, 0xe5,
+	0x53, 0x7e, 0x81, 0xc4, 0xfa, 0x56, 0x6b, 0x28, 0x95, 0xcb, 0x6c, 0x0f, 0x64, 0x13, 0xfa, 0x3c,
+	0x7f, 0xeb, 0xd2, 0x9a, 0xd0, 0x08, 0x90, 0x8a, 0x17, 0xc1, 0x8a, 0x15, 0x60, 0xe2, 0xb6, 0x80,
+	0xc1, 0xbc, 0x80, 0xcf, 0x1e, 0x90, 0x79, 0x73, 0xb2, 0x4a, 0x15, 0xb9, 0x07, 0xbe, 0x8c, 0x59,
+	0xca, 0x4a, 0xd4, 0x30, 0x9c, 0xd0, 0xb0, 0xd5, 0xb9, 0xd0, 0xf6, 0x25, 0x7c, 0x89, 0x88, 0x67,
+	0x97, 0x22, 0x87, 0x35, 0xac, 0x9a, 0xc7, 0x4a, 0x94, 0xa8, 0x71, 0x01, 0xeb, 0x18, 0x11, 0x86,
+	0x65, 0xb1, 0x86, 0x95, 0x31, 0x55, 0x26, 0xa7, 0xe8, 0x62, 0x01, 0xeb, 0x00, 0x11, 0x86, 0x65,
+	0xb1, 0x4f, 0xf4, 0x78, 0xac, 0x56, 0x1a, 0xc1, 0x66, 0xbb, 0x87, 0x8d, 0x7e, 0x97, 0xd3, 0xfb,
+	0xa7, 0x9c, 0x13, 0xf0, 0xad, 0xbb, 0x9f, 0xf3, 0xf4, 0x5a, 0xf3, 0xd4, 0xa3, 0xa8, 0x59, 0x5a,
+	0xd9, 0x21, 0x7b, 0x91, 0x3d, 0xd0, 0xc7, 0xe0, 0x1f, 0x37, 0x8e, 0x56, 0x25, 0xcb, 0x8a, 0x94,
+	0x4b, 0x4d, 0xeb, 0x2f, 0x6c, 0x1f, 0x42, 0xa2, 0x06, 0x4a, 0xc7, 0x30, 0x38, 0x14, 0x49, 0xae,
+	0xfe, 0xa2, 0xe4, 0x27, 0x4f, 0xeb, 0x44, 0x3a, 0xd1, 0xd5, 0x33, 0xae, 0x5d, 0xc4, 0xae, 0xe4,
+	0xde, 0xe2, 0x92, 0xe1, 0x01, 0x02, 0x9f, 0xe6, 0x4a, 0xf7, 0xcb, 0xb1, 0xc8, 0x08, 0x06, 0x85,
+	0xa9, 0xee, 0x46, 0x77, 0xad, 0x8b, 0x8e, 0xf2, 0x22, 0x8b, 0xa3, 0x0f, 0x60, 0xd8, 0xca, 0x63,
+	0x1e, 0xe2, 0x09, 0x6f, 0x9e, 0xac, 0x09, 0xe7, 0x25, 0xaf, 0x39, 0xc9, 0x0f, 0x7b, 0xf7, 0x3d,
+	0xfa, 0x08, 0x7c, 0xdb, 0x7b, 0xa2, 0xfb, 0x2c, 0x79, 0x99, 0x2c, 0x69, 0x14, 0x22, 0x22, 0x87,
+	0xa4, 0xe7, 0xc6, 0x34, 0x86, 0x17, 0x34, 0x8d, 0xd8, 0x4e, 0xd3, 0x63, 0xf0, 0xd1, 0x8c, 0xd4,
+	0x1a, 0xfb, 0x7f, 0x76, 0xed, 0x80, 0xff, 0x61, 0x7b, 0xf2, 0xdd, 0x83, 0x0d, 0x9b, 0xd3, 0x3c,
+	0xd5, 0x84, 0x97, 0xa4, 0x86, 0xf5, 0xf6, 0xcf, 0x47, 0xee, 0x74, 0xd5, 0xef, 0xd8, 0x3d, 0x74,
+	0x6f, 0x39, 0xd0, 0xbc, 0xe3, 0xdd, 0x9d, 0x0f, 0x5f, 0xbf, 0x7d, 0xec, 0x5d, 0x21, 0x1b, 0xb8,
+	0xe5, 0xea, 0xf1, 0xc8, 0xee, 0x92, 0x1a, 0xe0, 0xd7, 0x2f, 0x43, 0x6e, 0x77, 0x25, 0xfb, 0x6d,
+	0x2d, 0xd1, 0x5b, 0xcb, 0x60, 0x58, 0xf1, 0x3a, 0x56, 0xdc, 0x21, 0x5b, 0x73, 0x15, 0x5f, 0x97,
+	0x06, 0xf7, 0xc6, 0xc7, 0xdd, 0x7a, 0xf7, 0x07, 0xcc, 0x1c, 0xd5, 0x48, 0x96, 0x05, 0x00, 0x00,
 }